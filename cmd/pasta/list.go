@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/* ListOptions define which pastas are listed and how */
+type ListOptions struct {
+	Remote  string // only pastas on this remote (URL or alias)
+	Name    string // only pastas with a filename matching this glob pattern
+	Since   int64  // only pastas created at or after this unix timestamp
+	Until   int64  // only pastas created at or before this unix timestamp
+	State   string // "alive" (default), "expired" or "all"
+	Sort    string // "date" (default), "name", "expire", "size" or "url"
+	Reverse bool   // reverse sort order
+	JSON    bool   // print as JSON
+	Format  string // print each pasta using this text/template
+	Check   bool   // check if the pastas still exist on the server
+}
+
+/* ListEntry is a single pasta as listed. This is also the data that is available in --format templates and the --json output */
+type ListEntry struct {
+	Index    int    `json:"index"` // Index in the storage, as used by rm
+	Url      string `json:"url"`
+	Token    string `json:"token"`
+	Date     int64  `json:"date"`
+	Expire   int64  `json:"expire"`
+	Filename string `json:"filename"`
+	Remote   string `json:"remote"`
+	Mime     string `json:"mime"`
+	Size     int64  `json:"size"`
+	Notes    string `json:"notes"`
+	Expired  bool   `json:"expired"`
+	Status   string `json:"status,omitempty"` // Only with --check: "ok", "gone" or "error: ..."
+}
+
+// Time returns the creation date of the pasta as time.Time
+func (entry ListEntry) Time() time.Time {
+	return time.Unix(entry.Date, 0)
+}
+
+/* Parse a date for --since and --until. Accepts dates (2006-01-02), date and time (2006-01-02 15:04:05), RFC3339 or a duration relative to now (e.g. 12h or 7d) */
+func parseDate(txt string) (int64, error) {
+	txt = strings.TrimSpace(txt)
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, txt, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	if duration, err := parseDuration(txt); err == nil {
+		return time.Now().Add(-duration).Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid date: %s", txt)
+}
+
+/* Parse a duration. In addition to time.ParseDuration this accepts days (d), weeks (w) and plain seconds */
+func parseDuration(txt string) (time.Duration, error) {
+	txt = strings.TrimSpace(txt)
+	if secs, err := strconv.ParseInt(txt, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if strings.HasSuffix(txt, suffix) {
+			if n, err := strconv.ParseFloat(strings.TrimSuffix(txt, suffix), 64); err == nil {
+				return time.Duration(n * float64(unit)), nil
+			}
+		}
+	}
+	return time.ParseDuration(txt)
+}
+
+/* Checks if the pasta belongs to the given remote (URL) */
+func matchesRemote(pasta Pasta, remote string) bool {
+	remote = strings.TrimSuffix(remote, "/")
+	if pasta.Remote != "" {
+		return strings.TrimSuffix(pasta.Remote, "/") == remote
+	}
+	// Pastas from older versions don't have the remote stored, compare with the url
+	return strings.HasPrefix(pasta.Url, remote+"/")
+}
+
+// Filter and sort the pastas in the storage according to the given options
+func (opts *ListOptions) Select(pastas []Pasta) ([]ListEntry, error) {
+	remote := opts.Remote
+	if remote != "" {
+		if found, host := cf.FindRemoteAlias(remote); found {
+			remote = host.URL
+		}
+	}
+	if opts.Name != "" {
+		if _, err := path.Match(opts.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid filename pattern: %s", opts.Name)
+		}
+	}
+
+	entries := make([]ListEntry, 0)
+	for i, pasta := range pastas {
+		expired := pasta.Expired()
+		if opts.State == "" || opts.State == "alive" {
+			if expired {
+				continue
+			}
+		} else if opts.State == "expired" {
+			if !expired {
+				continue
+			}
+		}
+		if remote != "" && !matchesRemote(pasta, remote) {
+			continue
+		}
+		if opts.Name != "" {
+			if ok, _ := path.Match(opts.Name, pasta.Filename); !ok {
+				continue
+			}
+		}
+		if opts.Since > 0 && pasta.Date < opts.Since {
+			continue
+		}
+		if opts.Until > 0 && pasta.Date > opts.Until {
+			continue
+		}
+		entries = append(entries, ListEntry{Index: i, Url: pasta.Url, Token: pasta.Token, Date: pasta.Date, Expire: pasta.Expire, Filename: pasta.Filename, Remote: pasta.Remote, Mime: pasta.Mime, Size: pasta.Size, Notes: pasta.Notes, Expired: expired})
+	}
+
+	var less func(a, b ListEntry) bool
+	switch opts.Sort {
+	case "", "date":
+		less = func(a, b ListEntry) bool { return a.Date < b.Date }
+	case "name", "filename":
+		less = func(a, b ListEntry) bool { return a.Filename < b.Filename }
+	case "expire":
+		// Pastas that never expire go last
+		less = func(a, b ListEntry) bool {
+			if a.Expire == 0 || b.Expire == 0 {
+				return a.Expire != 0 && b.Expire == 0
+			}
+			return a.Expire < b.Expire
+		}
+	case "size":
+		less = func(a, b ListEntry) bool { return a.Size < b.Size }
+	case "url":
+		less = func(a, b ListEntry) bool { return a.Url < b.Url }
+	default:
+		return nil, fmt.Errorf("invalid sort key: %s", opts.Sort)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if opts.Reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return entries, nil
+}
+
+// Check if the listed pastas still exist on the server (using at most jobs concurrent requests) and set their status accordingly
+func checkEntries(entries []ListEntry, jobs int) {
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		urls = append(urls, entry.Url)
+	}
+	for i, result := range probeAll(urls, jobs) {
+		entries[i].Status = result.Status()
+	}
+}
+
+// Print the given entries in the requested output format
+func (opts *ListOptions) Print(w io.Writer, entries []ListEntry) error {
+	if opts.JSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	if opts.Format != "" {
+		format := opts.Format
+		if !strings.HasSuffix(format, "\n") {
+			format += "\n"
+		}
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := tmpl.Execute(w, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if opts.Check {
+		fmt.Fprintf(w, "Id   %-30s   %-19s   %-6s   %s\n", "Filename", "Date", "Status", "URL")
+	} else {
+		fmt.Fprintf(w, "Id   %-30s   %-19s   %s\n", "Filename", "Date", "URL")
+	}
+	for _, entry := range entries {
+		filename := entry.Filename
+		if filename == "" {
+			filename = "<none>"
+		}
+		date := entry.Time().Format("2006-01-02 15:04:05")
+		if opts.Check {
+			status := entry.Status
+			if strings.HasPrefix(status, "error") {
+				status = "error"
+			}
+			fmt.Fprintf(w, "%-3d  %-30s   %-19s   %-6s   %s\n", entry.Index, filename, date, status, entry.Url)
+		} else {
+			fmt.Fprintf(w, "%-3d  %-30s   %-19s   %s\n", entry.Index, filename, date, entry.Url)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListSelect(t *testing.T) {
+	oldCf := cf
+	defer func() { cf = oldCf }()
+	cf = Config{RemoteHosts: []RemoteHost{{URL: "https://work.example.org/", Alias: "work"}}}
+
+	now := time.Now().Unix()
+	pastas := []Pasta{
+		{Url: "http://localhost:8199/a", Date: now - 3000, Filename: "notes.txt", Remote: "http://localhost:8199", Size: 30},
+		{Url: "https://work.example.org/b", Date: now - 1000, Filename: "report.pdf", Size: 10, Expire: now + 600},
+		{Url: "http://localhost:8199/c", Date: now - 2000, Filename: "todo.txt", Remote: "http://localhost:8199/", Size: 20, Expire: now - 10},
+		{Url: "https://work.example.org/d", Date: now - 4000, Remote: "https://work.example.org", Size: 40, Expire: now + 60},
+	}
+	urls := func(opts ListOptions) string {
+		entries, err := opts.Select(pastas)
+		if err != nil {
+			t.Fatalf("Error selecting pastas with %+v: %s", opts, err)
+		}
+		ret := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			ret = append(ret, entry.Url[len(entry.Url)-1:])
+		}
+		return strings.Join(ret, " ")
+	}
+	checks := []struct {
+		opts     ListOptions
+		expected string
+	}{
+		{ListOptions{}, "d a b"},
+		{ListOptions{State: "expired"}, "c"},
+		{ListOptions{State: "all"}, "d a c b"},
+		{ListOptions{State: "all", Remote: "http://localhost:8199/"}, "a c"},
+		{ListOptions{Remote: "work"}, "d b"}, // aliases and pastas without stored remote
+		{ListOptions{State: "all", Name: "*.txt"}, "a c"},
+		{ListOptions{State: "all", Since: now - 2500, Until: now - 1500}, "c"},
+		{ListOptions{State: "all", Sort: "name"}, "d a b c"},
+		{ListOptions{State: "all", Sort: "size", Reverse: true}, "d a c b"},
+		{ListOptions{State: "all", Sort: "expire"}, "c d b a"}, // pastas that never expire go last
+		{ListOptions{Sort: "url", Reverse: true}, "d b a"},
+	}
+	for _, check := range checks {
+		if result := urls(check.opts); result != check.expected {
+			t.Errorf("Unexpected pastas for %+v: %s, expected %s", check.opts, result, check.expected)
+		}
+	}
+	// The index refers to the storage, as used by rm
+	if entries, _ := (&ListOptions{Name: "report.pdf"}).Select(pastas); len(entries) != 1 || entries[0].Index != 1 {
+		t.Errorf("Unexpected index: %v", entries)
+	}
+	if _, err := (&ListOptions{Sort: "color"}).Select(pastas); err == nil {
+		t.Error("Invalid sort key accepted")
+	}
+	if _, err := (&ListOptions{Name: "[a-"}).Select(pastas); err == nil {
+		t.Error("Invalid filename pattern accepted")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	for _, value := range []string{"2024-03-01", "2024-03-01 00:00:00", "2024-03-01T00:00:00", day.Format(time.RFC3339)} {
+		if date, err := parseDate(value); err != nil || date != day.Unix() {
+			t.Errorf("Unexpected date for %s: %d %v", value, date, err)
+		}
+	}
+	// Durations are relative to now
+	if date, err := parseDate("7d"); err != nil || time.Now().Unix()-date-7*24*3600 > 1 {
+		t.Errorf("Unexpected date for 7d: %d %v", date, err)
+	}
+	if _, err := parseDate("yesterday"); err == nil {
+		t.Error("Invalid date accepted")
+	}
+}
+
+func TestListPrint(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.Local).Unix()
+	entries := []ListEntry{
+		{Index: 0, Url: "http://localhost:8199/a", Date: date, Filename: "notes.txt", Size: 30, Status: "ok"},
+		{Index: 3, Url: "http://localhost:8199/b", Date: date, Size: 10, Status: "error: timeout"},
+	}
+	printed := func(opts ListOptions) string {
+		var buf bytes.Buffer
+		if err := opts.Print(&buf, entries); err != nil {
+			t.Fatalf("Error printing pastas with %+v: %s", opts, err)
+		}
+		return buf.String()
+	}
+
+	lines := strings.Split(printed(ListOptions{}), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "Id ") || !strings.HasPrefix(lines[1], "0    notes.txt ") || !strings.Contains(lines[1], "2024-03-01 12:30:00") || !strings.Contains(lines[2], "<none>") {
+		t.Errorf("Unexpected table:\n%s", strings.Join(lines, "\n"))
+	}
+	if output := printed(ListOptions{Check: true}); !strings.Contains(output, "Status") || !strings.Contains(output, " error ") || strings.Contains(output, "timeout") {
+		t.Errorf("Unexpected table with status:\n%s", output)
+	}
+	if output := printed(ListOptions{Format: "{{.Index}} {{.Url}} {{.Size}}"}); output != "0 http://localhost:8199/a 30\n3 http://localhost:8199/b 10\n" {
+		t.Errorf("Unexpected formatted output: %q", output)
+	}
+	if output := printed(ListOptions{Format: "{{.Time.Year}}\n"}); output != "2024\n2024\n" {
+		t.Errorf("Unexpected formatted output: %q", output)
+	}
+	if err := (&ListOptions{Format: "{{.Unknown"}).Print(&bytes.Buffer{}, entries); err == nil {
+		t.Error("Invalid format accepted")
+	}
+
+	var decoded []ListEntry
+	if err := json.Unmarshal([]byte(printed(ListOptions{JSON: true})), &decoded); err != nil {
+		t.Fatalf("Invalid json output: %s", err)
+	}
+	if len(decoded) != 2 || decoded[0] != entries[0] || decoded[1] != entries[1] {
+		t.Errorf("Unexpected json output: %v", decoded)
+	}
+	// Empty lists are printed as empty json array and without table header
+	var buf bytes.Buffer
+	(&ListOptions{JSON: true}).Print(&buf, []ListEntry{})
+	if strings.TrimSpace(buf.String()) != "[]" {
+		t.Errorf("Unexpected json output for empty list: %s", buf.String())
+	}
+	buf.Reset()
+	(&ListOptions{}).Print(&buf, []ListEntry{})
+	if buf.Len() != 0 {
+		t.Errorf("Unexpected output for empty list: %s", buf.String())
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+/* FileLock is an exclusive advisory lock, held on a lock file */
+type FileLock struct {
+	file *os.File
+}
+
+// lockFile acquires an exclusive lock on the given file, blocking until the lock is available. The file is created if not existing
+func lockFile(filename string) (*FileLock, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileLock{file: file}, nil
+}
+
+func (lock *FileLock) Unlock() error {
+	if lock.file == nil {
+		return nil
+	}
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	err := lock.file.Close()
+	lock.file = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+/* FileLock is a no-op on windows, where flock is not available. Concurrent pasta invocations are not protected here */
+type FileLock struct{}
+
+func lockFile(filename string) (*FileLock, error) {
+	return &FileLock{}, nil
+}
+
+func (lock *FileLock) Unlock() error {
+	return nil
+}
@@ -23,23 +23,18 @@ type Config struct {
 	RemoteHost  string       `toml:"RemoteHost"`
 	RemoteHosts []RemoteHost `toml:"Remote"`
 }
-type RemoteHost struct {
-	URL     string   `toml:"url"`     // URL of the remote host
-	Alias   string   `toml:"alias"`   // Alias for the remote host
-	Aliases []string `toml:"aliases"` // List of additional aliases for the remote host
-}
 
 var cf Config
 
 // Search for the given remote alias. Returns true and the remote if found, otherwise false and an empty instance
 func (cf *Config) FindRemoteAlias(remote string) (bool, RemoteHost) {
-	for _, remote := range cf.RemoteHosts {
-		if cf.RemoteHost == remote.Alias {
-			return true, remote
+	for _, host := range cf.RemoteHosts {
+		if remote == host.Alias {
+			return true, host
 		}
-		for _, alias := range remote.Aliases {
-			if cf.RemoteHost == alias {
-				return true, remote
+		for _, alias := range host.Aliases {
+			if remote == alias {
+				return true, host
 			}
 		}
 	}
@@ -72,21 +67,47 @@ func usage() {
 	fmt.Println("     -r, --remote HOST          Define remote host or alias (Default: http://localhost:8199)")
 	fmt.Println("     -c, --config FILE          Define config file (Default: ~/.pasta.toml)")
 	fmt.Println("     -f, --file FILE            Send FILE to server")
+	fmt.Println("     -e, --expire DURATION      Expiration for new pastas in seconds or as duration (e.g. 12h or 7d)")
+	fmt.Println("     --public                   Put new pastas on the public list of the server")
+	fmt.Println("     --private                  Don't put new pastas on the public list, even if set for the remote")
 	fmt.Println("")
 	fmt.Println("     --ls, --list               List known pasta pushes")
 	fmt.Println("     --gc                       Garbage collector (clean expired pastas)")
+	fmt.Println("     --sync                     Sync the known pastas with the servers (remove deleted pastas, update expiration)")
+	fmt.Println("     -j, --jobs N               Number of concurrent requests for --sync and --check (Default: 8)")
 	fmt.Println("     --version                  Show client version")
 	fmt.Println("")
+	fmt.Println("LIST OPTIONS")
+	fmt.Println("     --host REMOTE              Only list pastas on the given remote (URL or alias)")
+	fmt.Println("     --name GLOB                Only list pastas with a filename matching GLOB")
+	fmt.Println("     --since DATE               Only list pastas created since DATE (2006-01-02, RFC3339 or a duration like 7d)")
+	fmt.Println("     --until DATE               Only list pastas created until DATE")
+	fmt.Println("     --alive, --expired, --all  List only alive (default), only expired or all pastas")
+	fmt.Println("     --sort KEY                 Sort by date (default), name, expire, size or url")
+	fmt.Println("     --reverse                  Reverse sort order")
+	fmt.Println("     --json                     Print as JSON")
+	fmt.Println("     --format TEMPLATE          Print each pasta using the given go template, e.g. '{{.Url}} {{.Filename}}'")
+	fmt.Println("     --check                    Check if the pastas still exist on the server")
+	fmt.Println("")
 	fmt.Println("One or more files can be pushed to the server.")
 	fmt.Println("If no file is given, the input from stdin will be pushed.")
 }
 
-func push(filename string, mime string, src io.Reader) (Pasta, error) {
+/* Options for pushing a new pasta */
+type PushOptions struct {
+	Expire int64 // Expiration in seconds, 0 for the server default
+	Public bool  // Put the pasta on the public list
+}
+
+func push(remote RemoteHost, opts PushOptions, filename string, mime string, src io.Reader) (Pasta, error) {
 	pasta := Pasta{}
 
-	client := &http.Client{}
+	client, err := remote.HttpClient()
+	if err != nil {
+		return pasta, err
+	}
 	// For compatability reasons, set the return format in URL and header for some time
-	req, err := http.NewRequest("POST", cf.RemoteHost+"?ret=json", src)
+	req, err := remote.NewRequest("POST", cf.RemoteHost+"?ret=json", src)
 	if err != nil {
 		return pasta, err
 	}
@@ -97,15 +118,23 @@ func push(filename string, mime string, src io.Reader) (Pasta, error) {
 	if filename != "" {
 		req.Header.Set("Filename", filename)
 	}
+	if opts.Expire > 0 {
+		req.Header.Set("Expire", strconv.FormatInt(opts.Expire, 10))
+	}
+	if opts.Public {
+		req.Header.Set("Public", "true")
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return pasta, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return pasta, fmt.Errorf("http status code: %d", resp.StatusCode)
+		return pasta, responseError(resp)
 	}
 	pasta.Date = time.Now().Unix()
+	pasta.Remote = cf.RemoteHost
+	pasta.Mime = mime
 	err = json.NewDecoder(resp.Body).Decode(&pasta)
 	if err != nil {
 		return pasta, err
@@ -113,9 +142,25 @@ func push(filename string, mime string, src io.Reader) (Pasta, error) {
 	return pasta, nil
 }
 
+/* Create a HttpError from the given response, including a small error message if present */
+func responseError(resp *http.Response) error {
+	// Try to fetch a small error message
+	buf := make([]byte, 200)
+	n, err := io.ReadFull(resp.Body, buf)
+	if (err != nil && err != io.ErrUnexpectedEOF) || n == 0 || n >= 200 {
+		return &HttpError{err: fmt.Sprintf("http code %d", resp.StatusCode), StatusCode: resp.StatusCode}
+	}
+	return &HttpError{err: fmt.Sprintf("http code %d: %s", resp.StatusCode, strings.TrimSpace(string(buf[:n]))), StatusCode: resp.StatusCode}
+}
+
+/* Perform a http request to the given url, using the settings of the matching remote */
 func httpRequest(url string, method string) error {
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
+	remote := cf.RemoteFor(url)
+	client, err := remote.HttpClient()
+	if err != nil {
+		return err
+	}
+	req, err := remote.NewRequest(method, url, nil)
 	if err != nil {
 		return err
 	}
@@ -123,17 +168,11 @@ func httpRequest(url string, method string) error {
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 200 {
 		return nil
-	} else {
-		// Try to fetch a small error message
-		buf := make([]byte, 200)
-		n, err := resp.Body.Read(buf)
-		if err != nil || n == 0 || n >= 200 {
-			return &HttpError{err: fmt.Sprintf("http code %d", resp.StatusCode), StatusCode: resp.StatusCode}
-		}
-		return &HttpError{err: fmt.Sprintf("http code %d: %s", resp.StatusCode, string(buf)), StatusCode: resp.StatusCode}
 	}
+	return responseError(resp)
 }
 
 func rm(pasta Pasta) error {
@@ -212,9 +251,21 @@ func main() {
 	}
 	// Files to be pushed
 	files := make([]string, 0)
+	listOpts := ListOptions{}
+	jobs := 8 // concurrent requests for sync and check
+	expire := ""
+	visibility := ""  // "public" or "private", if given. Otherwise the setting of the remote applies
 	explicit := false // marking files as explicitly given. This disabled the shortcut commands (ls, rm, gc)
 	// Parse program arguments
 	args := os.Args[1:]
+	// nextArg returns the value for the current argument or terminates if there is none
+	nextArg := func(i int) string {
+		if i+1 >= len(args) {
+			fmt.Fprintf(os.Stderr, "Missing value for argument %s\n", args[i])
+			os.Exit(1)
+		}
+		return args[i+1]
+	}
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
 		if arg == "" {
@@ -242,6 +293,59 @@ func main() {
 				action = "rm"
 			} else if arg == "--gc" {
 				action = "gc"
+			} else if arg == "-e" || arg == "--expire" {
+				expire = nextArg(i)
+				i++
+			} else if arg == "--public" {
+				visibility = "public"
+			} else if arg == "--private" {
+				visibility = "private"
+			} else if arg == "--sync" {
+				action = "sync"
+			} else if arg == "-j" || arg == "--jobs" {
+				n, err := strconv.Atoi(nextArg(i))
+				if err != nil || n < 1 {
+					fmt.Fprintf(os.Stderr, "Invalid number of jobs: %s\n", nextArg(i))
+					os.Exit(1)
+				}
+				jobs = n
+				i++
+			} else if arg == "--host" {
+				listOpts.Remote = nextArg(i)
+				i++
+			} else if arg == "--name" {
+				listOpts.Name = nextArg(i)
+				i++
+			} else if arg == "--since" || arg == "--until" {
+				date, err := parseDate(nextArg(i))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", arg, err)
+					os.Exit(1)
+				}
+				if arg == "--since" {
+					listOpts.Since = date
+				} else {
+					listOpts.Until = date
+				}
+				i++
+			} else if arg == "--expired" {
+				listOpts.State = "expired"
+			} else if arg == "--alive" {
+				listOpts.State = "alive"
+			} else if arg == "--all" {
+				listOpts.State = "all"
+			} else if arg == "--sort" {
+				listOpts.Sort = nextArg(i)
+				i++
+			} else if arg == "--reverse" {
+				listOpts.Reverse = true
+			} else if arg == "--json" {
+				listOpts.JSON = true
+			} else if arg == "--format" {
+				listOpts.Format = nextArg(i)
+				i++
+			} else if arg == "--check" {
+				listOpts.Check = true
 			} else if arg == "--version" {
 				fmt.Printf("pasta version %s\n", VERSION)
 				os.Exit(1)
@@ -269,8 +373,29 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Invalid remote: %s\n", cf.RemoteHost)
 		os.Exit(1)
 	}
-	// Load stored pastas
-	stor, err := OpenStorage(homeDir + "/.pastas.dat")
+	// Settings for new pastas. Program arguments have precedence over the remote settings
+	remote := cf.RemoteFor(cf.RemoteHost)
+	pushOpts := PushOptions{Public: remote.Public}
+	if visibility != "" {
+		pushOpts.Public = visibility == "public"
+	}
+	if expire != "" {
+		remote.Expire = expire
+	}
+	if expire, err := remote.ExpireSeconds(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	} else {
+		pushOpts.Expire = expire
+	}
+	// Load stored pastas. Pastas from the legacy ~/.pastas.dat file are migrated once
+	storageFile := DefaultStorageFile()
+	if n, err := MigrateLegacyStorage(homeDir+"/.pastas.dat", storageFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot migrate legacy pasta storage: %s\n", err)
+	} else if n > 0 {
+		fmt.Fprintf(os.Stderr, "Migrated %d pastas from ~/.pastas.dat to %s\n", n, storageFile)
+	}
+	stor, err := OpenStorage(storageFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot open pasta storage: %s\n", err)
 	}
@@ -303,6 +428,15 @@ func main() {
 			action = "gc"
 			files = files[1:]
 		}
+		// Special action: "pasta sync" is the same as "pasta --sync"
+		if len(files) == 1 && files[0] == "sync" {
+			if FileExists(files[0]) {
+				fmt.Fprintf(os.Stderr, "Ambiguous command %s (file '%s' exists) - please use '-f %s' to upload or --sync to sync pastas\n", files[0], files[0], files[0])
+				os.Exit(1)
+			}
+			action = "sync"
+			files = files[1:]
+		}
 	}
 
 	if action == "push" || action == "" {
@@ -314,7 +448,8 @@ func main() {
 					os.Exit(1)
 				}
 				defer file.Close()
-				if stat, err := file.Stat(); err != nil {
+				stat, err := file.Stat()
+				if err != nil {
 					fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
 					os.Exit(1)
 				} else if stat.Size() == 0 {
@@ -323,8 +458,9 @@ func main() {
 				}
 				// Push file
 				f_name := getFilename(filename)
-				pasta, err := push(f_name, "", file)
+				pasta, err := push(remote, pushOpts, f_name, "", file)
 				pasta.Filename = f_name
+				pasta.Size = stat.Size()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "%s\n", err)
 					os.Exit(1)
@@ -342,7 +478,7 @@ func main() {
 		} else {
 			fmt.Fprintln(os.Stderr, "Reading from stdin")
 			reader := bufio.NewReader(os.Stdin)
-			pasta, err := push("", "text/plain", reader)
+			pasta, err := push(remote, pushOpts, "", "text/plain", reader)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s\n", err)
 				os.Exit(1)
@@ -353,16 +489,17 @@ func main() {
 			fmt.Println(pasta.Url)
 		}
 	} else if action == "list" { // list known pastas
-		if len(stor.Pastas) > 0 {
-			fmt.Printf("Id   %-30s   %-19s   %s\n", "Filename", "Date", "URL")
-			for i, pasta := range stor.Pastas {
-				t := time.Unix(pasta.Date, 0)
-				filename := pasta.Filename
-				if filename == "" {
-					filename = "<none>"
-				}
-				fmt.Printf("%-3d  %-30s   %-19s   %s\n", i, filename, t.Format("2006-01-02 15:04:05"), pasta.Url)
-			}
+		entries, err := listOpts.Select(stor.Pastas)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		if listOpts.Check {
+			checkEntries(entries, jobs)
+		}
+		if err := listOpts.Print(os.Stdout, entries); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
 		}
 	} else if action == "rm" { // remove pastas
 		// List of pastas to be deleted
@@ -423,9 +560,21 @@ func main() {
 		if err = stor.Write(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing to local storage: %s\n", err)
 		}
+	} else if action == "sync" {
+		stats := syncStorage(&stor, jobs)
+		if err = stor.Write(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing to local storage: %s\n", err)
+			os.Exit(1)
+		}
+		printSyncStats(os.Stdout, stats)
 	} else if action == "gc" || action == "clean" {
-		// Cleanup happens when loading pastas
-		expired := stor.ExpiredPastas()
+		expired := stor.RemoveExpired()
+		if expired > 0 {
+			if err = stor.Write(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing to local storage: %s\n", err)
+				os.Exit(1)
+			}
+		}
 		if expired == 0 {
 			fmt.Println("all good")
 		} else if expired == 1 {
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/* ProbeResult is the result of checking a pasta on the server with a HEAD request */
+type ProbeResult struct {
+	StatusCode int   // http status code, if a response was received
+	Expires    int64 // Expiration date as reported by the server, 0 if not present
+	Err        error // Error if the server could not be reached or replied with an invalid Expires header
+}
+
+// Gone returns true, if the server reports that the pasta does not exist (anymore)
+func (result ProbeResult) Gone() bool {
+	return result.Err == nil && (result.StatusCode == http.StatusNotFound || result.StatusCode == http.StatusGone)
+}
+
+// Status returns a short human readable status ("ok", "gone" or "error: ...")
+func (result ProbeResult) Status() string {
+	if result.Err != nil {
+		return fmt.Sprintf("error: %s", result.Err)
+	}
+	if result.Gone() {
+		return "gone"
+	}
+	if result.StatusCode != http.StatusOK {
+		return fmt.Sprintf("error: http code %d", result.StatusCode)
+	}
+	return "ok"
+}
+
+/* Parse the Expires header as sent by pastad. Older servers use a custom format instead of the http date format.
+ * Returns 0 if the header is not present and an error if it cannot be parsed */
+func parseExpires(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02-15:04:05", value, time.Local); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid Expires header: %q", value)
+}
+
+// probe checks if the given pasta url still exists using a HEAD request
+func probe(url string) ProbeResult {
+	remote := cf.RemoteFor(url)
+	client, err := remote.HttpClient()
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	client.Timeout = 30 * time.Second
+	req, err := remote.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ProbeResult{Err: err}
+	}
+	resp.Body.Close()
+	result := ProbeResult{StatusCode: resp.StatusCode}
+	if resp.StatusCode == http.StatusOK {
+		result.Expires, result.Err = parseExpires(resp.Header.Get("Expires"))
+	}
+	return result
+}
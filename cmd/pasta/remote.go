@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type RemoteHost struct {
+	URL     string   `toml:"url"`     // URL of the remote host
+	Alias   string   `toml:"alias"`   // Alias for the remote host
+	Aliases []string `toml:"aliases"` // List of additional aliases for the remote host
+	// Authentication
+	Token           string `toml:"token"`            // API token, sent as bearer token
+	TokenEnv        string `toml:"token_env"`        // Read the API token from this environment variable
+	TokenCommand    string `toml:"token_command"`    // Use the output of this command as API token, e.g. "pass show pasta/token"
+	Username        string `toml:"username"`         // Username for basic authentication
+	Password        string `toml:"password"`         // Password for basic authentication
+	PasswordEnv     string `toml:"password_env"`     // Read the basic authentication password from this environment variable
+	PasswordCommand string `toml:"password_command"` // Use the output of this command as basic authentication password
+	// Defaults for new pastas
+	Expire string `toml:"expire"` // Default expiration for new pastas, in seconds or as duration (e.g. "7d")
+	Public bool   `toml:"public"` // Put new pastas on the public list by default
+	// Connection settings
+	CACert     string `toml:"ca_cert"`     // PEM file with additional CA certificates to trust
+	ClientCert string `toml:"client_cert"` // PEM file with the client certificate for TLS client authentication
+	ClientKey  string `toml:"client_key"`  // PEM file with the key for the client certificate
+	Proxy      string `toml:"proxy"`       // Proxy URL. If empty, the proxy from the environment (HTTP_PROXY, HTTPS_PROXY) is used
+}
+
+var secretCache = make(map[string]string, 0)
+var secretMutex sync.Mutex
+
+/* Resolve a secret, which is either given directly, in an environment variable or as output of a command. Command outputs are cached */
+func resolveSecret(value string, env string, command string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if env != "" {
+		if value := os.Getenv(env); value != "" {
+			return value, nil
+		}
+	}
+	if command == "" {
+		return "", nil
+	}
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+	if value, ok := secretCache[command]; ok {
+		return value, nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	// Stdin is not passed on, the command must not consume the pasta content piped into pasta
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", command, err)
+	}
+	// Like pass, use only the first line of the output
+	value = strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+	secretCache[command] = value
+	return value, nil
+}
+
+// RemoteFor returns the remote configuration for the given url. If no remote is configured for it, an empty configuration is returned
+func (cf *Config) RemoteFor(rawurl string) RemoteHost {
+	var ret RemoteHost
+	rawurl = strings.TrimSuffix(rawurl, "/")
+	for _, host := range cf.RemoteHosts {
+		prefix := strings.TrimSuffix(host.URL, "/")
+		if prefix == "" || len(prefix) <= len(ret.URL) {
+			continue
+		}
+		// Longest matching prefix wins
+		if rawurl == prefix || strings.HasPrefix(rawurl, prefix+"/") || strings.HasPrefix(rawurl, prefix+"?") {
+			ret = host
+		}
+	}
+	if ret.URL == "" {
+		ret.URL = rawurl
+	}
+	return ret
+}
+
+// ExpireSeconds returns the configured default expiration in seconds or 0 if not set
+func (remote *RemoteHost) ExpireSeconds() (int64, error) {
+	if remote.Expire == "" {
+		return 0, nil
+	}
+	duration, err := parseDuration(remote.Expire)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expire setting for remote %s: %s", remote.URL, remote.Expire)
+	}
+	return int64(duration.Seconds()), nil
+}
+
+// HttpClient creates a http client with the TLS and proxy settings of this remote
+func (remote *RemoteHost) HttpClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if remote.Proxy != "" {
+		proxy, err := url.Parse(remote.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if remote.CACert != "" || remote.ClientCert != "" {
+		tlsConfig := &tls.Config{}
+		if remote.CACert != "" {
+			pem, err := os.ReadFile(remote.CACert)
+			if err != nil {
+				return nil, err
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificates found", remote.CACert)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if remote.ClientCert != "" {
+			key := remote.ClientKey
+			if key == "" {
+				key = remote.ClientCert // key and certificate in the same file
+			}
+			cert, err := tls.LoadX509KeyPair(remote.ClientCert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Authorize applies the configured credentials of this remote to the given request
+func (remote *RemoteHost) Authorize(req *http.Request) error {
+	token, err := resolveSecret(remote.Token, remote.TokenEnv, remote.TokenCommand)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	if remote.Username != "" {
+		password, err := resolveSecret(remote.Password, remote.PasswordEnv, remote.PasswordCommand)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(remote.Username, password)
+	}
+	return nil
+}
+
+// NewRequest creates a request to this remote with its credentials applied
+func (remote *RemoteHost) NewRequest(method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return req, remote.Authorize(req)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteFor(t *testing.T) {
+	config := Config{RemoteHosts: []RemoteHost{
+		{URL: "https://pasta.example.org/", Alias: "root"},
+		{URL: "https://pasta.example.org/team", Alias: "team"},
+		{URL: "https://pasta.example.org/team/private", Alias: "private"},
+		{URL: "", Alias: "empty"},
+	}}
+	checks := map[string]string{
+		"https://pasta.example.org":                  "root",
+		"https://pasta.example.org/abcd":             "root",
+		"https://pasta.example.org/team/":            "team",
+		"https://pasta.example.org/team?ret=json":    "team",
+		"https://pasta.example.org/team/abcd":        "team",
+		"https://pasta.example.org/teamwork":         "root", // only whole path segments match
+		"https://pasta.example.org/team/private/abc": "private",
+	}
+	for url, alias := range checks {
+		if remote := config.RemoteFor(url); remote.Alias != alias {
+			t.Errorf("Unexpected remote for %s: %s", url, remote.Alias)
+		}
+	}
+	// Unknown remotes get an empty configuration
+	if remote := config.RemoteFor("https://other.example.org/"); remote.Alias != "" || remote.URL != "https://other.example.org" {
+		t.Errorf("Unexpected remote for unknown url: %+v", remote)
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("PASTA_TEST_SECRET", "from-env")
+	if value, _ := resolveSecret("direct", "PASTA_TEST_SECRET", "echo command"); value != "direct" {
+		t.Errorf("Direct value not preferred: %s", value)
+	}
+	if value, _ := resolveSecret("", "PASTA_TEST_SECRET", "echo command"); value != "from-env" {
+		t.Errorf("Environment variable not preferred: %s", value)
+	}
+	if value, _ := resolveSecret("", "PASTA_TEST_UNSET", ""); value != "" {
+		t.Errorf("Unexpected secret: %s", value)
+	}
+
+	// Only the first line of the command output is used and the output is cached
+	counter := filepath.Join(t.TempDir(), "counter")
+	command := "echo >> " + counter + "; printf 'secret\\nsecond line\\n'"
+	for i := 0; i < 2; i++ {
+		value, err := resolveSecret("", "PASTA_TEST_UNSET", command)
+		if err != nil {
+			t.Fatalf("Error resolving secret: %s", err)
+		}
+		if value != "secret" {
+			t.Fatalf("Unexpected secret from command: %q", value)
+		}
+	}
+	if buf, err := os.ReadFile(counter); err != nil || len(buf) != 1 {
+		t.Fatalf("Command not cached: %q %v", buf, err)
+	}
+	if _, err := resolveSecret("", "", "exit 1"); err == nil {
+		t.Fatal("Failing command accepted")
+	}
+	// The command doesn't read the pasta content piped into pasta
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %s", err)
+	}
+	oldStdin := os.Stdin
+	defer func() { os.Stdin = oldStdin }()
+	os.Stdin = reader
+	writer.Write([]byte("pasta content\n"))
+	writer.Close()
+	if value, err := resolveSecret("", "", "cat; echo stdin"); err != nil || value != "stdin" {
+		t.Fatalf("Command reads stdin: %q %v", value, err)
+	}
+	if buf, _ := io.ReadAll(os.Stdin); string(buf) != "pasta content\n" {
+		t.Fatalf("Pasta content consumed: %q", buf)
+	}
+
+	// Credentials are applied to the requests
+	remote := RemoteHost{TokenEnv: "PASTA_TEST_SECRET"}
+	req, err := remote.NewRequest("GET", "http://localhost/", nil)
+	if err != nil || req.Header.Get("Authorization") != "Bearer from-env" {
+		t.Errorf("Token not applied: %s %v", req.Header.Get("Authorization"), err)
+	}
+	remote = RemoteHost{Username: "me", PasswordCommand: command}
+	req, err = remote.NewRequest("GET", "http://localhost/", nil)
+	if username, password, ok := req.BasicAuth(); err != nil || !ok || username != "me" || password != "secret" {
+		t.Errorf("Basic authentication not applied: %s %s %v", username, password, err)
+	}
+}
+
+// Write a self-signed certificate and its key as PEM files and return the certificate
+func writeTestCertificate(t *testing.T, certFile string, keyFile string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error encoding key: %s", err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func TestHttpClient(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	cert := writeTestCertificate(t, clientCert, clientKey)
+
+	// TLS server, that requires the client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+	caCert := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	get := func(remote RemoteHost) error {
+		client, err := remote.HttpClient()
+		if err != nil {
+			return err
+		}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := get(RemoteHost{ClientCert: clientCert, ClientKey: clientKey}); err == nil {
+		t.Error("Untrusted server certificate accepted")
+	}
+	if err := get(RemoteHost{CACert: caCert}); err == nil {
+		t.Error("Request without client certificate accepted")
+	}
+	if err := get(RemoteHost{CACert: caCert, ClientCert: clientCert, ClientKey: clientKey}); err != nil {
+		t.Errorf("Request with CA and client certificate failed: %s", err)
+	}
+	if _, err := (&RemoteHost{CACert: clientKey}).HttpClient(); err == nil {
+		t.Error("CA file without certificates accepted")
+	}
+
+	// Proxy
+	client, err := (&RemoteHost{Proxy: "http://proxy.example.org:3128"}).HttpClient()
+	if err != nil {
+		t.Fatalf("Error creating client with proxy: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "https://pasta.example.org/", nil)
+	proxy, err := client.Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example.org:3128" {
+		t.Errorf("Proxy not applied: %v %v", proxy, err)
+	}
+	if _, err := (&RemoteHost{Proxy: "http://[invalid"}).HttpClient(); err == nil || !strings.Contains(err.Error(), "invalid proxy") {
+		t.Errorf("Invalid proxy accepted: %v", err)
+	}
+}
@@ -2,116 +2,275 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// Version of the local storage format. Increase this when the format changes in an incompatible way
+const STORAGE_VERSION = 1
+
 type Pasta struct {
 	Url      string `json:"url"`
 	Token    string `json:"token"`
 	Date     int64  `json:"date"`
 	Expire   int64  `json:"expire"`
-	Filename string `json:"filename"`
+	Filename string `json:"filename,omitempty"`
+	Remote   string `json:"remote,omitempty"` // URL of the remote host the pasta has been pushed to
+	Mime     string `json:"mime,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Notes    string `json:"notes,omitempty"`
+}
+
+/* Header line of the storage file */
+type storageHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
 }
 
+/* Storage is the local store of pushed pastas.
+ * The store is a JSON Lines file. The first line is a header containing the format version, every following line is one pasta.
+ * All modifications happen while holding an exclusive lock on a lock file next to the storage file, so that concurrent pasta invocations don't corrupt it. */
 type Storage struct {
 	Pastas   []Pasta
-	file     *os.File
 	filename string
-	expired  int // number of expired pastas when loading
+	removed  []Pasta // pastas that have been removed since loading
+}
+
+func (pasta *Pasta) key() string {
+	return pasta.Url + "\x00" + pasta.Token
+}
+
+// Expired returns true if the pasta has an expiration date that lies in the past
+func (pasta *Pasta) Expired() bool {
+	return pasta.Expire != 0 && time.Now().Unix() > pasta.Expire
 }
 
-/* Format for writing to storage*/
-func (pasta *Pasta) format() string {
-	return fmt.Sprintf("%s:%d:%d:%s:%s", pasta.Token, pasta.Date, pasta.Expire, strings.Replace(pasta.Filename, ":", "", -1), pasta.Url)
+// DefaultStorageFile returns the default location of the storage file, following the XDG base directory specification
+func DefaultStorageFile() string {
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		homeDir, _ := os.UserHomeDir()
+		dataDir = filepath.Join(homeDir, ".local", "share")
+	}
+	return filepath.Join(dataDir, "pasta", "pastas.jsonl")
 }
 
 func OpenStorage(filename string) (Storage, error) {
 	stor := Storage{filename: filename}
-	return stor, stor.Open(filename)
+	err := stor.Open(filename)
+	return stor, err
 }
 
 func (stor *Storage) Open(filename string) error {
-	var err error
 	stor.filename = filename
-	stor.file, err = os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0640)
+	stor.Pastas = make([]Pasta, 0)
+	stor.removed = make([]Pasta, 0)
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	lock, err := lockFile(stor.lockFilename())
 	if err != nil {
 		return err
 	}
-	stor.Pastas = make([]Pasta, 0)
-	dirty := false // dirty flag used to rewrite the file if some pastas are expired
-	stor.expired = 0
-	now := time.Now().Unix()
-	// Read file
-	scanner := bufio.NewScanner(stor.file)
+	defer lock.Unlock()
+
+	stor.Pastas, err = stor.read()
+	return err
+}
+
+// Close releases the storage. All modifications are written immediately, so there is nothing left to do here
+func (stor *Storage) Close() error {
+	return nil
+}
+
+func (stor *Storage) lockFilename() string {
+	return stor.filename + ".lock"
+}
+
+/* Read all pastas from the storage file. Must be called while holding the lock */
+func (stor *Storage) read() ([]Pasta, error) {
+	pastas := make([]Pasta, 0)
+	file, err := os.OpenFile(stor.filename, os.O_RDONLY, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pastas, nil
+		}
+		return pastas, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	first := true
 	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			stor.file.Close()
-			stor.file = nil
-			return err
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if first {
+			first = false
+			var header storageHeader
+			if err := json.Unmarshal([]byte(line), &header); err != nil || header.Format != "pasta" {
+				return pastas, fmt.Errorf("%s: invalid storage header", stor.filename)
+			}
+			if header.Version > STORAGE_VERSION {
+				return pastas, fmt.Errorf("%s: unsupported storage version %d", stor.filename, header.Version)
+			}
+			continue
 		}
-		split := strings.Split(scanner.Text(), ":")
-		if len(split) < 5 {
+		var pasta Pasta
+		if err := json.Unmarshal([]byte(line), &pasta); err != nil {
+			// Ignore broken lines, e.g. an incomplete last line after a crash
 			continue
 		}
-		pasta := Pasta{Token: split[0], Filename: split[3], Url: strings.Join(split[4:], ":")}
-		pasta.Date, _ = strconv.ParseInt(split[1], 10, 64)
-		pasta.Expire, _ = strconv.ParseInt(split[2], 10, 64)
-		// Don't add expired pastas and mark storage as dirty for re-write in the end
-		if pasta.Expire != 0 && now > pasta.Expire {
-			dirty = true
-			stor.expired++
-		} else {
-			stor.Pastas = append(stor.Pastas, pasta)
+		if pasta.Url == "" {
+			continue
 		}
+		pastas = append(pastas, pasta)
 	}
+	return pastas, scanner.Err()
+}
 
-	// Rewrite storage if expired pastas have been removed
-	if dirty {
-		return stor.Write()
+/* Atomically replace the storage file with the given pastas. Must be called while holding the lock */
+func (stor *Storage) write(pastas []Pasta) error {
+	file, err := os.CreateTemp(filepath.Dir(stor.filename), ".pastas-*.tmp")
+	if err != nil {
+		return err
 	}
-	return nil
+	tempname := file.Name()
+	defer os.Remove(tempname) // no-op after a successful rename
+	defer file.Close()
+	if err := file.Chmod(0600); err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := writeJSONLine(writer, storageHeader{Format: "pasta", Version: STORAGE_VERSION}); err != nil {
+		return err
+	}
+	for _, pasta := range pastas {
+		if pasta.Url == "" {
+			continue
+		}
+		if err := writeJSONLine(writer, pasta); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempname, stor.filename)
 }
 
-func (stor *Storage) Close() error {
-	if stor.file == nil {
-		return nil
+func writeJSONLine(writer *bufio.Writer, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
-	return stor.file.Close()
+	buf = append(buf, '\n')
+	_, err = writer.Write(buf)
+	return err
 }
 
 func (stor *Storage) Append(pasta Pasta) error {
-	if _, err := stor.file.Write([]byte(pasta.format() + "\n")); err != nil {
+	lock, err := lockFile(stor.lockFilename())
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	file, err := os.OpenFile(stor.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
 		return err
 	}
-	return stor.file.Sync()
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if stat, err := file.Stat(); err != nil {
+		return err
+	} else if stat.Size() == 0 {
+		if err := writeJSONLine(writer, storageHeader{Format: "pasta", Version: STORAGE_VERSION}); err != nil {
+			return err
+		}
+	}
+	if err := writeJSONLine(writer, pasta); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	stor.Pastas = append(stor.Pastas, pasta)
+	return file.Sync()
 }
 
-/* Rewrite the whole storage file */
+/* Rewrite the whole storage file.
+ * The storage is re-read while holding the lock, so that pastas that have been added by other pasta instances in the meantime are not lost.
+ * Removed pastas are dropped and pastas present in memory replace their stored counterpart. */
 func (stor *Storage) Write() error {
-	var err error
-	stor.file.Close()
-	stor.file, err = os.OpenFile(stor.filename, os.O_RDWR|os.O_TRUNC, 0640)
+	lock, err := lockFile(stor.lockFilename())
 	if err != nil {
 		return err
 	}
+	defer lock.Unlock()
+
+	stored, err := stor.read()
+	if err != nil {
+		return err
+	}
+	removed := make(map[string]bool, 0)
+	for _, pasta := range stor.removed {
+		removed[pasta.key()] = true
+	}
+	current := make(map[string]Pasta, 0)
 	for _, pasta := range stor.Pastas {
-		if pasta.Url == "" {
+		current[pasta.key()] = pasta
+	}
+	pastas := make([]Pasta, 0)
+	for _, pasta := range stored {
+		if removed[pasta.key()] {
 			continue
 		}
-		_, err = stor.file.Write([]byte(pasta.format() + "\n"))
-		if err != nil {
-			return err
+		if updated, ok := current[pasta.key()]; ok {
+			pasta = updated
 		}
+		pastas = append(pastas, pasta)
 	}
-	return stor.file.Sync()
+	return stor.write(pastas)
 }
 
+// ExpiredPastas returns the number of expired pastas in the storage
 func (stor *Storage) ExpiredPastas() int {
-	return stor.expired
+	expired := 0
+	for _, pasta := range stor.Pastas {
+		if pasta.Expired() {
+			expired++
+		}
+	}
+	return expired
+}
+
+// RemoveExpired marks all expired pastas as removed and returns their number. Call Write to persist the changes
+func (stor *Storage) RemoveExpired() int {
+	pastas := make([]Pasta, 0)
+	expired := 0
+	for _, pasta := range stor.Pastas {
+		if pasta.Expired() {
+			stor.removed = append(stor.removed, pasta)
+			expired++
+		} else {
+			pastas = append(pastas, pasta)
+		}
+	}
+	stor.Pastas = pastas
+	return expired
 }
 
 func getPastaId(url string) string {
@@ -157,9 +316,71 @@ func (stor *Storage) Remove(url string, token string) bool {
 	if i < 0 {
 		return false
 	}
+	stor.removed = append(stor.removed, stor.Pastas[i])
 	after := stor.Pastas[i+1:]
 	stor.Pastas = stor.Pastas[:i]
 	stor.Pastas = append(stor.Pastas, after...)
 	return true
 
 }
+
+/* Parse a line of the legacy ~/.pastas.dat file (token:date:expire:filename:url) */
+func parseLegacyPasta(line string) (Pasta, bool) {
+	split := strings.Split(line, ":")
+	if len(split) < 5 {
+		return Pasta{}, false
+	}
+	pasta := Pasta{Token: split[0], Filename: split[3], Url: strings.Join(split[4:], ":")}
+	pasta.Date, _ = strconv.ParseInt(split[1], 10, 64)
+	pasta.Expire, _ = strconv.ParseInt(split[2], 10, 64)
+	return pasta, true
+}
+
+/* MigrateLegacyStorage imports the pastas from the legacy colon-separated storage file into the storage at filename.
+ * The migration happens only once: on success the legacy file is renamed to LEGACY.migrated.
+ * Returns the number of migrated pastas */
+func MigrateLegacyStorage(legacy string, filename string) (int, error) {
+	if !FileExists(legacy) {
+		return 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return 0, err
+	}
+	stor := Storage{filename: filename}
+	lock, err := lockFile(stor.lockFilename())
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	// Another pasta instance might have migrated the file while we were waiting for the lock
+	if !FileExists(legacy) {
+		return 0, nil
+	}
+
+	file, err := os.OpenFile(legacy, os.O_RDONLY, 0400)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	legacyPastas := make([]Pasta, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pasta, ok := parseLegacyPasta(scanner.Text()); ok {
+			legacyPastas = append(legacyPastas, pasta)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	// Keep pastas that are already in the new storage
+	pastas, err := stor.read()
+	if err != nil {
+		return 0, err
+	}
+	pastas = append(legacyPastas, pastas...)
+	if err := stor.write(pastas); err != nil {
+		return 0, err
+	}
+	file.Close()
+	return len(legacyPastas), os.Rename(legacy, legacy+".migrated")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStorageRoundtrip(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pasta", "pastas.jsonl")
+	stor, err := OpenStorage(filename)
+	if err != nil {
+		t.Fatalf("Error opening storage: %s", err)
+	}
+	p1 := Pasta{Url: "http://localhost:8199/abc", Token: "t1", Date: time.Now().Unix(), Filename: "file:with:colons.txt", Remote: "http://localhost:8199", Mime: "text/plain", Size: 42}
+	p2 := Pasta{Url: "http://localhost:8199/def", Token: "t2", Date: time.Now().Unix(), Expire: time.Now().Unix() - 10}
+	if err := stor.Append(p1); err != nil {
+		t.Fatalf("Error appending pasta 1: %s", err)
+	}
+	if err := stor.Append(p2); err != nil {
+		t.Fatalf("Error appending pasta 2: %s", err)
+	}
+
+	stor, err = OpenStorage(filename)
+	if err != nil {
+		t.Fatalf("Error re-opening storage: %s", err)
+	}
+	if stor.ExpiredPastas() != 1 {
+		t.Fatalf("Expected one expired pasta, got %d", stor.ExpiredPastas())
+	}
+	if stor.RemoveExpired() != 1 {
+		t.Fatal("Expected one expired pasta to be removed")
+	}
+	if len(stor.Pastas) != 1 || stor.Pastas[0] != p1 {
+		t.Fatalf("Pasta 1 mismatch after reloading: %v", stor.Pastas)
+	}
+	if !stor.Remove(p1.Url, p1.Token) {
+		t.Fatal("Cannot remove pasta 1")
+	}
+	if err := stor.Write(); err != nil {
+		t.Fatalf("Error writing storage: %s", err)
+	}
+	stor, err = OpenStorage(filename)
+	if err != nil {
+		t.Fatalf("Error re-opening storage: %s", err)
+	}
+	if len(stor.Pastas) != 0 {
+		t.Fatalf("Storage not empty after removing all pastas: %v", stor.Pastas)
+	}
+}
+
+func TestStorageMigration(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, ".pastas.dat")
+	filename := filepath.Join(dir, "pasta", "pastas.jsonl")
+	content := "token1:1600000000:0:file.txt:http://localhost:8199/abc\ntoken2:1600000001:0:other:https://example.org:8443/def\n"
+	if err := os.WriteFile(legacy, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing legacy storage: %s", err)
+	}
+	n, err := MigrateLegacyStorage(legacy, filename)
+	if err != nil {
+		t.Fatalf("Migration failed: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 migrated pastas, got %d", n)
+	}
+	if FileExists(legacy) || !FileExists(legacy+".migrated") {
+		t.Fatal("Legacy storage has not been renamed")
+	}
+	// A second migration must be a no-op
+	if n, err := MigrateLegacyStorage(legacy, filename); err != nil || n != 0 {
+		t.Fatalf("Second migration not a no-op: %d, %v", n, err)
+	}
+	stor, err := OpenStorage(filename)
+	if err != nil {
+		t.Fatalf("Error opening migrated storage: %s", err)
+	}
+	if len(stor.Pastas) != 2 {
+		t.Fatalf("Expected 2 pastas in migrated storage, got %d", len(stor.Pastas))
+	}
+	if stor.Pastas[1].Url != "https://example.org:8443/def" || stor.Pastas[1].Token != "token2" || stor.Pastas[1].Date != 1600000001 {
+		t.Fatalf("Migrated pasta mismatch: %v", stor.Pastas[1])
+	}
+}
+
+func TestStorageConcurrentAccess(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "pastas.jsonl")
+	var wg sync.WaitGroup
+	n := 20
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Each instance opens the storage itself, just like concurrent pasta invocations
+			stor, err := OpenStorage(filename)
+			if err != nil {
+				t.Errorf("Error opening storage: %s", err)
+				return
+			}
+			pasta := Pasta{Url: fmt.Sprintf("http://localhost:8199/%d", i), Token: "token"}
+			if err := stor.Append(pasta); err != nil {
+				t.Errorf("Error appending pasta %d: %s", i, err)
+			}
+			// Rewriting must not drop pastas appended by other instances
+			if err := stor.Write(); err != nil {
+				t.Errorf("Error writing storage: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stor, err := OpenStorage(filename)
+	if err != nil {
+		t.Fatalf("Error opening storage: %s", err)
+	}
+	if len(stor.Pastas) != n {
+		t.Fatalf("Expected %d pastas, got %d", n, len(stor.Pastas))
+	}
+}
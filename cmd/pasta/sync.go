@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* SyncStats summarizes the sync of the pastas on one remote */
+type SyncStats struct {
+	Remote  string // alias or URL of the remote
+	Checked int    // number of checked pastas
+	Removed int    // pastas removed from the local storage because they don't exist on the server anymore
+	Updated int    // pastas with an updated expiration date
+	Errors  int    // pastas that could not be checked
+}
+
+// probeAll checks all given urls with at most jobs concurrent requests. The results are in the same order as the given urls
+func probeAll(urls []string, jobs int) []ProbeResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+	results := make([]ProbeResult, len(urls))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(urls); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = probe(urls[i])
+			}
+		}()
+	}
+	for i := range urls {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+/* Determine the remote URL of a pasta. Pastas from older versions don't have the remote stored, there we derive it from the pasta url */
+func pastaRemote(pasta Pasta) string {
+	if pasta.Remote != "" {
+		return strings.TrimSuffix(pasta.Remote, "/")
+	}
+	for _, host := range cf.RemoteHosts {
+		if host.URL != "" && strings.HasPrefix(pasta.Url, strings.TrimSuffix(host.URL, "/")+"/") {
+			return strings.TrimSuffix(host.URL, "/")
+		}
+	}
+	if u, err := url.Parse(pasta.Url); err == nil && u.Host != "" {
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+	}
+	return getFilename(pasta.Url)
+}
+
+/* Get the display name (alias if defined, otherwise the URL) for the given remote URL */
+func remoteName(remote string) string {
+	for _, host := range cf.RemoteHosts {
+		if host.Alias != "" && strings.TrimSuffix(host.URL, "/") == remote {
+			return host.Alias
+		}
+	}
+	return remote
+}
+
+/* Sync the local storage against the servers.
+ * Every stored pasta is checked with a HEAD request. Pastas that don't exist anymore on the server are removed and the expiration date is updated from the servers response.
+ * Returns the statistics per remote. The storage needs to be written afterwards to persist the changes */
+func syncStorage(stor *Storage, jobs int) []*SyncStats {
+	pastas := make([]Pasta, len(stor.Pastas))
+	copy(pastas, stor.Pastas)
+	urls := make([]string, 0, len(pastas))
+	for _, pasta := range pastas {
+		urls = append(urls, pasta.Url)
+	}
+	results := probeAll(urls, jobs)
+
+	stats := make(map[string]*SyncStats, 0)
+	for i, pasta := range pastas {
+		remote := remoteName(pastaRemote(pasta))
+		stat, ok := stats[remote]
+		if !ok {
+			stat = &SyncStats{Remote: remote}
+			stats[remote] = stat
+		}
+		stat.Checked++
+		result := results[i]
+		if result.Gone() {
+			stor.Remove(pasta.Url, pasta.Token)
+			stat.Removed++
+		} else if result.Err != nil || result.StatusCode != 200 {
+			stat.Errors++
+		} else if result.Expires != 0 && result.Expires != pasta.Expire {
+			// Only update the expiration date, if the server reports one
+			if j := stor.find(pasta.Url, pasta.Token); j >= 0 {
+				stor.Pastas[j].Expire = result.Expires
+				stat.Updated++
+			}
+		}
+	}
+
+	ret := make([]*SyncStats, 0, len(stats))
+	for _, stat := range stats {
+		ret = append(ret, stat)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Remote < ret[j].Remote })
+	return ret
+}
+
+func printSyncStats(w io.Writer, stats []*SyncStats) {
+	if len(stats) == 0 {
+		fmt.Fprintln(w, "no pastas to sync")
+		return
+	}
+	fmt.Fprintf(w, "%-40s   %7s   %7s   %7s   %6s\n", "Remote", "Checked", "Removed", "Updated", "Errors")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "%-40s   %7d   %7d   %7d   %6d\n", stat.Remote, stat.Checked, stat.Removed, stat.Updated, stat.Errors)
+	}
+}
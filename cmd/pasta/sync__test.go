@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseExpires(t *testing.T) {
+	expire := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if value, err := parseExpires(expire.Format(http.TimeFormat)); err != nil || value != expire.Unix() {
+		t.Errorf("Unexpected expiration for http date: %d %v", value, err)
+	}
+	legacy := time.Date(2030, 1, 2, 3, 4, 5, 0, time.Local)
+	if value, err := parseExpires(legacy.Format("2006-01-02-15:04:05")); err != nil || value != legacy.Unix() {
+		t.Errorf("Unexpected expiration for legacy format: %d %v", value, err)
+	}
+	if value, err := parseExpires(""); err != nil || value != 0 {
+		t.Errorf("Unexpected expiration without header: %d %v", value, err)
+	}
+	for _, invalid := range []string{"never", "2030-01-02"} {
+		if value, err := parseExpires(invalid); err == nil || value != 0 {
+			t.Errorf("Invalid expiration %q accepted: %d", invalid, value)
+		}
+	}
+}
+
+// Test server, that replies to every pasta according to its name
+func newSyncServer(t *testing.T, expire time.Time) (*httptest.Server, *int) {
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if r.Method != "HEAD" {
+			t.Errorf("Unexpected request method: %s", r.Method)
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/") {
+		case "alive":
+			w.Header().Set("Expires", expire.UTC().Format(http.TimeFormat))
+		case "unchanged":
+		case "invalid":
+			w.Header().Set("Expires", "never")
+		case "gone":
+			w.WriteHeader(http.StatusNotFound)
+		case "expired":
+			w.WriteHeader(http.StatusGone)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &maxRunning
+}
+
+func TestProbeAll(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Truncate(time.Second)
+	server, maxRunning := newSyncServer(t, expire)
+	urls := []string{server.URL + "/alive", server.URL + "/gone", server.URL + "/expired", server.URL + "/broken", "http://127.0.0.1:1/unreachable", server.URL + "/unchanged", server.URL + "/invalid"}
+	results := probeAll(urls, 2)
+	if len(results) != len(urls) {
+		t.Fatalf("Unexpected number of results: %d", len(results))
+	}
+	expected := []string{"ok", "gone", "gone", "error: http code 500", "error", "ok", "error: invalid Expires header"}
+	for i, result := range results {
+		if status := result.Status(); !strings.HasPrefix(status, expected[i]) {
+			t.Errorf("Unexpected status for %s: %s", urls[i], status)
+		}
+	}
+	if results[0].Expires != expire.Unix() || results[5].Expires != 0 {
+		t.Errorf("Unexpected expiration: %d %d", results[0].Expires, results[5].Expires)
+	}
+	if *maxRunning > 2 {
+		t.Errorf("More concurrent requests than jobs: %d", *maxRunning)
+	}
+	if results := probeAll(nil, 4); len(results) != 0 {
+		t.Errorf("Unexpected results without urls: %v", results)
+	}
+}
+
+func TestSyncStorage(t *testing.T) {
+	oldCf := cf
+	defer func() { cf = oldCf }()
+	expire := time.Now().Add(time.Hour).Truncate(time.Second)
+	server, _ := newSyncServer(t, expire)
+	cf = Config{RemoteHosts: []RemoteHost{{URL: server.URL, Alias: "test"}}}
+
+	now := time.Now().Unix()
+	stor := Storage{Pastas: []Pasta{
+		{Url: server.URL + "/alive", Token: "1", Date: now},
+		{Url: server.URL + "/unchanged", Token: "2", Date: now, Expire: now + 600},
+		{Url: server.URL + "/gone", Token: "3", Date: now, Remote: server.URL},
+		{Url: server.URL + "/expired", Token: "4", Date: now, Expire: now - 10},
+		{Url: server.URL + "/broken", Token: "5", Date: now},
+		{Url: "http://127.0.0.1:1/unreachable", Token: "6", Date: now},
+		{Url: server.URL + "/invalid", Token: "7", Date: now, Expire: now + 600},
+	}}
+	stats := syncStorage(&stor, 4)
+	if len(stats) != 2 || stats[0].Remote != "http://127.0.0.1:1" || stats[1].Remote != "test" {
+		t.Fatalf("Unexpected remotes: %v", stats)
+	}
+	if stat := *stats[1]; stat.Checked != 6 || stat.Removed != 2 || stat.Updated != 1 || stat.Errors != 2 {
+		t.Errorf("Unexpected stats: %+v", stat)
+	}
+	if stat := *stats[0]; stat.Checked != 1 || stat.Errors != 1 {
+		t.Errorf("Unexpected stats for unreachable remote: %+v", stat)
+	}
+	// Pastas that don't exist anymore are removed, the expiration date is updated
+	if len(stor.Pastas) != 5 {
+		t.Fatalf("Gone pastas not removed: %v", stor.Pastas)
+	}
+	if stor.Pastas[0].Expire != expire.Unix() {
+		t.Errorf("Expiration not updated: %v", stor.Pastas)
+	}
+	// A missing or invalid Expires header doesn't overwrite the expiration date
+	if stor.Pastas[1].Expire != now+600 || stor.Pastas[4].Expire != now+600 {
+		t.Errorf("Expiration overwritten: %v", stor.Pastas)
+	}
+
+	var buf bytes.Buffer
+	printSyncStats(&buf, stats)
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[2], "test ") {
+		t.Errorf("Unexpected sync stats:\n%s", buf.String())
+	}
+}
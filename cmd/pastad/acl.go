@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+/* AccessList restricts an action to client IPs. Denied networks have precedence. If no allowed networks are given, all clients not denied are allowed */
+type AccessList struct {
+	Allow NetList
+	Deny  NetList
+}
+
+/* Access lists for the different actions */
+type AccessLists struct {
+	Create AccessList
+	Delete AccessList
+	Read   AccessList
+}
+
+var acls AccessLists
+
+// Permitted checks if the given client IP is allowed by the access list
+func (acl *AccessList) Permitted(ip string) bool {
+	if acl.Deny.Contains(ip) {
+		return false
+	}
+	return acl.Allow.Empty() || acl.Allow.Contains(ip)
+}
+
+/* Parse the access lists from the config. Returns the networks of create, delete and read, each with the allowed and denied networks */
+func parseAccessLists(cf *Config) ([][]*net.IPNet, error) {
+	lists := [][]string{cf.AllowCreate, cf.DenyCreate, cf.AllowDelete, cf.DenyDelete, cf.AllowRead, cf.DenyRead}
+	nets := make([][]*net.IPNet, len(lists))
+	for i, list := range lists {
+		var err error
+		if nets[i], err = parseCIDRs(list); err != nil {
+			return nil, err
+		}
+	}
+	return nets, nil
+}
+
+/* Apply the access lists from the config. On error, no list is changed */
+func (acls *AccessLists) Load(cf *Config) error {
+	nets, err := parseAccessLists(cf)
+	if err != nil {
+		return err
+	}
+	acls.Set(nets)
+	return nil
+}
+
+// Set replaces the networks of the access lists, as returned by parseAccessLists
+func (acls *AccessLists) Set(nets [][]*net.IPNet) {
+	acls.Create.Allow.Set(nets[0])
+	acls.Create.Deny.Set(nets[1])
+	acls.Delete.Allow.Set(nets[2])
+	acls.Delete.Deny.Set(nets[3])
+	acls.Read.Allow.Set(nets[4])
+	acls.Read.Deny.Set(nets[5])
+}
+
+/* Check if the client of the request is permitted by the given access list. If not, a "403 Forbidden" is sent and false is returned */
+func checkAccess(w http.ResponseWriter, r *http.Request, acl *AccessList, action string) bool {
+	ip := clientIP(r)
+	if acl.Permitted(ip) {
+		return true
+	}
+	slog.Warn("request rejected by access list", "action", action, "client", ip)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "forbidden")
+	return false
+}
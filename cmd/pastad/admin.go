@@ -0,0 +1,599 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+/* AdminPasta is the metadata of a pasta as reported to administrators */
+type AdminPasta struct {
+	Id       string `json:"id"`
+	Filename string `json:"filename,omitempty"`
+	Mime     string `json:"mime,omitempty"`
+	Size     int64  `json:"size"`
+	Expire   int64  `json:"expire"` // Unix timestamp, 0 = never
+	Expired  bool   `json:"expired"`
+	Owner    string `json:"owner,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Public   bool   `json:"public"`
+	Pinned   bool   `json:"pinned"`
+}
+
+/* AdminStats are the storage totals of a bowl */
+type AdminStats struct {
+	Pastas       int            `json:"pastas"`
+	Bytes        int64          `json:"bytes"`
+	Expired      int            `json:"expired"`
+	ExpiredBytes int64          `json:"expired_bytes"`
+	Public       int            `json:"public"`
+	Owners       map[string]int `json:"owners"` // Number of pastas per API key label
+}
+
+/* AdminReload is the result of a config reload */
+type AdminReload struct {
+	Reloaded        bool     `json:"reloaded"`
+	RestartRequired []string `json:"restart_required"` // Changed settings, that are only applied after a restart
+}
+
+var errNoPasta = errors.New("pasta not found")
+
+func adminPasta(pasta Pasta, public map[string]bool) AdminPasta {
+	return AdminPasta{Id: pasta.Id, Filename: pasta.ContentFilename, Mime: pasta.Mime, Size: pasta.Size, Expire: pasta.ExpireDate, Expired: pasta.Expired(), Owner: pasta.Owner, Client: pasta.Client, Public: public[pasta.Id], Pinned: pasta.Pinned}
+}
+
+func publicSet(bowl *PastaBowl) (map[string]bool, error) {
+	ids, err := bowl.GetPublicPastas()
+	ret := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		ret[id] = true
+	}
+	return ret, err
+}
+
+// adminListPastas returns all pastas in the bowl, ordered by id
+func adminListPastas(bowl *PastaBowl) ([]AdminPasta, error) {
+	ret := make([]AdminPasta, 0)
+	public, err := publicSet(bowl)
+	if err != nil {
+		return ret, err
+	}
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return ret, err
+	}
+	for _, pasta := range pastas {
+		ret = append(ret, adminPasta(pasta, public))
+	}
+	return ret, nil
+}
+
+// adminGetPasta returns a single pasta or errNoPasta
+func adminGetPasta(bowl *PastaBowl, id string) (AdminPasta, error) {
+	pasta, err := bowl.GetPasta(id)
+	if err != nil {
+		return AdminPasta{}, err
+	}
+	if pasta.Id == "" {
+		return AdminPasta{}, errNoPasta
+	}
+	public, err := publicSet(bowl)
+	return adminPasta(pasta, public), err
+}
+
+// adminStats computes the storage totals of the bowl
+func adminStats(bowl *PastaBowl) (AdminStats, error) {
+	stats := AdminStats{Owners: make(map[string]int, 0)}
+	pastas, err := adminListPastas(bowl)
+	if err != nil {
+		return stats, err
+	}
+	for _, pasta := range pastas {
+		stats.Pastas++
+		stats.Bytes += pasta.Size
+		if pasta.Expired {
+			stats.Expired++
+			stats.ExpiredBytes += pasta.Size
+		}
+		if pasta.Public {
+			stats.Public++
+		}
+		if pasta.Owner != "" {
+			stats.Owners[pasta.Owner]++
+		}
+	}
+	return stats, nil
+}
+
+// adminDeletePasta deletes the given pasta without requiring its token and removes it from the public list
+func adminDeletePasta(bowl *PastaBowl, id string) (Pasta, error) {
+	pasta, err := bowl.GetPasta(id)
+	if err != nil {
+		return pasta, err
+	}
+	if pasta.Id == "" {
+		return pasta, errNoPasta
+	}
+	if _, err := adminUnpublish(bowl, id); err != nil {
+		return pasta, err
+	}
+	return pasta, bowl.DeletePasta(id)
+}
+
+// adminSetExpire sets the expiration date (unix timestamp, 0 = never) of the given pasta
+func adminSetExpire(bowl *PastaBowl, id string, expire int64) (Pasta, error) {
+	pasta, err := bowl.GetPasta(id)
+	if err != nil {
+		return pasta, err
+	}
+	if pasta.Id == "" {
+		return pasta, errNoPasta
+	}
+	pasta.ExpireDate = expire
+	return pasta, bowl.UpdatePasta(pasta)
+}
+
+// adminSetPinned pins or unpins the given pasta. Pinned pastas are never evicted
+func adminSetPinned(bowl *PastaBowl, id string, pinned bool) (Pasta, error) {
+	pasta, err := bowl.GetPasta(id)
+	if err != nil {
+		return pasta, err
+	}
+	if pasta.Id == "" {
+		return pasta, errNoPasta
+	}
+	pasta.Pinned = pinned
+	return pasta, bowl.UpdatePasta(pasta)
+}
+
+// adminUnpublish removes the given pasta from the public list in the bowl. Returns true if the pasta was public.
+// A running pastad overwrites the list with its in-memory copy, so the server also needs to remove it via publicPastas
+func adminUnpublish(bowl *PastaBowl, id string) (bool, error) {
+	ids, err := bowl.GetPublicPastas()
+	if err != nil {
+		return false, err
+	}
+	remaining := make([]string, 0)
+	for _, public := range ids {
+		if public != id {
+			remaining = append(remaining, public)
+		}
+	}
+	if len(remaining) == len(ids) {
+		return false, nil
+	}
+	return true, bowl.WritePublicPastaIDs(remaining)
+}
+
+/* Parse an expire value for the admin interface: seconds from now, 0 for never or an absolute RFC3339 date */
+func parseAdminExpire(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("negative expire")
+		}
+		if seconds == 0 {
+			return 0, nil
+		}
+		return time.Now().Unix() + seconds, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("invalid expire: %s", value)
+}
+
+/* Check the admin key of the request ("Authorization: Bearer ADMINKEY"). If no admin key is configured, the admin API is disabled */
+func adminAuthorized(r *http.Request) bool {
+	return bearerAuthorized(r, cf().AdminKey)
+}
+
+// Check the bearer token of the request against the given key. An empty key never matches
+func bearerAuthorized(r *http.Request, key string) bool {
+	if key == "" {
+		return false
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[7:])), []byte(key)) == 1
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("json error", "error", err)
+		w.WriteHeader(500)
+		w.Write([]byte("Server error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(buf)
+}
+
+/* Admin API handler for /admin/...
+ * GET    /admin/stats                   storage totals
+ * GET    /admin/pastas?offset=&limit=   list pastas
+ * GET    /admin/pastas/ID               pasta metadata
+ * DELETE /admin/pastas/ID               delete pasta
+ * POST   /admin/pastas/ID/expire        set expire (form value "expire": seconds from now, 0 = never or RFC3339 date)
+ * POST   /admin/pastas/ID/unpublish     remove pasta from the public list */
+func handlerAdmin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var id, action string
+	var pasta Pasta
+	var info AdminPasta
+	var stats AdminStats
+	if cf().AdminKey == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "admin interface disabled")
+		return
+	}
+	if !adminAuthorized(r) {
+		slog.Warn("admin request rejected", "client", clientIP(r))
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"pasta admin\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "admin key required")
+		return
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/"), "/")
+	// Reloading the config does not modify pastas and is therefore also possible on replicas
+	if len(path) == 1 && path[0] == "reload" {
+		if r.Method != http.MethodPost {
+			goto BadMethod
+		}
+		restart, err := reloadConfig()
+		logReload(restart, err)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		writeJson(w, AdminReload{Reloaded: true, RestartRequired: restart})
+		return
+	}
+	// Replicas can only be modified via the primary
+	if r.Method != http.MethodGet && replicaReadOnly(w) {
+		return
+	}
+	if len(path) == 1 && path[0] == "stats" && r.Method == http.MethodGet {
+		stats, err = adminStats(&bowl)
+		if err != nil {
+			goto ServerError
+		}
+		writeJson(w, stats)
+		return
+	}
+	if path[0] != "pastas" || len(path) > 3 {
+		goto NotFound
+	}
+	if len(path) == 1 {
+		if r.Method != http.MethodGet {
+			goto BadMethod
+		}
+		adminList(w, r)
+		return
+	}
+	id = path[1]
+	if !containsOnlyAlphaNumeric(id) || id == "" {
+		goto NotFound
+	}
+	if len(path) == 3 {
+		action = path[2]
+	}
+	if action == "" && r.Method == http.MethodGet {
+		info, err = adminGetPasta(&bowl, id)
+		if err == errNoPasta {
+			goto NotFound
+		} else if err != nil {
+			goto ServerError
+		}
+		writeJson(w, info)
+	} else if action == "" && r.Method == http.MethodDelete {
+		pasta, err = adminDeletePasta(&bowl, id)
+		if err == errNoPasta {
+			goto NotFound
+		} else if err != nil {
+			goto ServerError
+		}
+		publicPastas.Remove(id)
+		quotas.Remove(pasta)
+		storageUsage.Remove(pasta)
+		metrics.PastaRemoved(pasta.Size)
+		slog.Info("pasta deleted", "id", id, "client", clientIP(r), "auth", "admin")
+		audit.Write(auditEntry("delete", pasta, clientIP(r), "admin"))
+		changes.Record("delete", id)
+		fmt.Fprintf(w, "OK")
+	} else if action == "expire" && r.Method == http.MethodPost {
+		var expire int64
+		expire, err = parseAdminExpire(r.FormValue("expire"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		pasta, err = adminSetExpire(&bowl, id, expire)
+		if err == errNoPasta {
+			goto NotFound
+		} else if err != nil {
+			goto ServerError
+		}
+		slog.Info("pasta expire changed", "id", id, "expire", expire, "client", clientIP(r), "auth", "admin")
+		audit.Write(auditEntry("update", pasta, clientIP(r), "admin"))
+		changes.Record("update", id)
+		public, _ := publicSet(&bowl)
+		writeJson(w, adminPasta(pasta, public))
+	} else if action == "unpublish" && r.Method == http.MethodPost {
+		if !bowl.Exists(id) {
+			goto NotFound
+		}
+		if _, err = adminUnpublish(&bowl, id); err != nil {
+			goto ServerError
+		}
+		publicPastas.Remove(id)
+		slog.Info("pasta removed from public list", "id", id, "client", clientIP(r), "auth", "admin")
+		audit.Write(AuditEntry{Event: "unpublish", Id: id, Client: clientIP(r), Auth: "admin"})
+		changes.Record("update", id)
+		fmt.Fprintf(w, "OK")
+	} else if (action == "pin" || action == "unpin") && r.Method == http.MethodPost {
+		pasta, err = adminSetPinned(&bowl, id, action == "pin")
+		if err == errNoPasta {
+			goto NotFound
+		} else if err != nil {
+			goto ServerError
+		}
+		slog.Info("pasta pinned", "id", id, "pinned", pasta.Pinned, "client", clientIP(r), "auth", "admin")
+		audit.Write(auditEntry("update", pasta, clientIP(r), "admin"))
+		changes.Record("update", id)
+		public, _ := publicSet(&bowl)
+		writeJson(w, adminPasta(pasta, public))
+	} else if action == "" || action == "expire" || action == "unpublish" || action == "pin" || action == "unpin" {
+		goto BadMethod
+	} else {
+		goto NotFound
+	}
+	return
+NotFound:
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "not found")
+	return
+BadMethod:
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	fmt.Fprintf(w, "method not allowed")
+	return
+ServerError:
+	slog.Error("admin request error", "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, "server error")
+}
+
+// List pastas with paging (offset and limit query parameters)
+func adminList(w http.ResponseWriter, r *http.Request) {
+	type Page struct {
+		Total  int          `json:"total"`
+		Offset int          `json:"offset"`
+		Limit  int          `json:"limit"`
+		Pastas []AdminPasta `json:"pastas"`
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	pastas, err := adminListPastas(&bowl)
+	if err != nil {
+		slog.Error("admin request error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "server error")
+		return
+	}
+	page := Page{Total: len(pastas), Offset: offset, Limit: limit, Pastas: make([]AdminPasta, 0)}
+	if offset < len(pastas) {
+		end := offset + limit
+		if end > len(pastas) {
+			end = len(pastas)
+		}
+		page.Pastas = pastas[offset:end]
+	}
+	writeJson(w, page)
+}
+
+/* pastad admin: run admin operations directly on a data directory. Returns the program exit code */
+func adminMain(args []string) int {
+	parser := argparse.NewParser("pastad admin", "pasta server administration")
+	configFile := parser.String("c", "config", &argparse.Options{Default: "", Help: "Read pasta directory from this config file"})
+	dir := parser.String("d", "dir", &argparse.Options{Help: "Pasta data directory"})
+	asJson := parser.Flag("", "json", &argparse.Options{Help: "Print results as json"})
+	listCmd := parser.NewCommand("list", "List pastas")
+	offset := listCmd.Int("", "offset", &argparse.Options{Default: 0, Help: "Skip the first pastas"})
+	limit := listCmd.Int("", "limit", &argparse.Options{Default: 0, Help: "Print at most this number of pastas (0 = all)"})
+	showCmd := parser.NewCommand("show", "Show the metadata of a pasta")
+	showId := showCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	deleteCmd := parser.NewCommand("delete", "Delete a pasta")
+	deleteId := deleteCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	expireCmd := parser.NewCommand("expire", "Change the expiration of a pasta")
+	expireId := expireCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	expireValue := expireCmd.StringPositional(&argparse.Options{Required: true, Help: "Seconds from now, 0 = never or RFC3339 date"})
+	unpublishCmd := parser.NewCommand("unpublish", "Remove a pasta from the public list. Only while pastad is stopped, use the admin API of a running pastad")
+	unpublishId := unpublishCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	pinCmd := parser.NewCommand("pin", "Pin a pasta, pinned pastas are never evicted")
+	pinId := pinCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	unpinCmd := parser.NewCommand("unpin", "Unpin a pasta")
+	unpinId := unpinCmd.StringPositional(&argparse.Options{Required: true, Help: "Pasta id"})
+	statsCmd := parser.NewCommand("stats", "Show storage totals")
+	// argparse expects the program name as first argument
+	if err := parser.Parse(append([]string{"pastad"}, args[1:]...)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", parser.Usage(err))
+		return 1
+	}
+	if err := readSubcommandConfig(*configFile, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if cf().AuditLog != "" {
+		if err := audit.Open(cf().AuditLog); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot open audit log: %s\n", err)
+			return 1
+		}
+	}
+	admin := PastaBowl{Directory: cf().PastaDir, QuarantineDir: cf().QuarantineDir}
+	if stat, err := os.Stat(admin.Directory); err != nil || !stat.IsDir() {
+		fmt.Fprintf(os.Stderr, "invalid pasta directory: %s\n", admin.Directory)
+		return 1
+	}
+	checkId := func(id string) bool {
+		if id == "" || !containsOnlyAlphaNumeric(id) {
+			fmt.Fprintf(os.Stderr, "invalid pasta id: %s\n", id)
+			return false
+		}
+		return true
+	}
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	printJson := func(v interface{}) {
+		buf, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Println(string(buf))
+	}
+
+	if listCmd.Happened() {
+		pastas, err := adminListPastas(&admin)
+		if err != nil {
+			return fail(err)
+		}
+		if *offset > 0 {
+			if *offset > len(pastas) {
+				*offset = len(pastas)
+			}
+			pastas = pastas[*offset:]
+		}
+		if *limit > 0 && *limit < len(pastas) {
+			pastas = pastas[:*limit]
+		}
+		if *asJson {
+			printJson(pastas)
+			return 0
+		}
+		fmt.Printf("%-12s %10s  %-20s %-6s %-12s %s\n", "Id", "Size", "Expire", "Public", "Owner", "Filename")
+		for _, pasta := range pastas {
+			expire := "never"
+			if pasta.Expire > 0 {
+				expire = time.Unix(pasta.Expire, 0).Format("2006-01-02 15:04:05")
+			}
+			if pasta.Expired {
+				expire += "*"
+			}
+			owner := pasta.Owner
+			if owner == "" {
+				owner = pasta.Client
+			}
+			fmt.Printf("%-12s %10d  %-20s %-6t %-12s %s\n", pasta.Id, pasta.Size, expire, pasta.Public, owner, pasta.Filename)
+		}
+	} else if showCmd.Happened() {
+		if !checkId(*showId) {
+			return 1
+		}
+		pasta, err := adminGetPasta(&admin, *showId)
+		if err != nil {
+			return fail(err)
+		}
+		printJson(pasta)
+	} else if deleteCmd.Happened() {
+		if !checkId(*deleteId) {
+			return 1
+		}
+		pasta, err := adminDeletePasta(&admin, *deleteId)
+		if err != nil {
+			return fail(err)
+		}
+		audit.Write(auditEntry("delete", pasta, "", "cli"))
+		fmt.Printf("Deleted pasta %s\n", *deleteId)
+	} else if expireCmd.Happened() {
+		if !checkId(*expireId) {
+			return 1
+		}
+		expire, err := parseAdminExpire(*expireValue)
+		if err != nil {
+			return fail(err)
+		}
+		pasta, err := adminSetExpire(&admin, *expireId, expire)
+		if err != nil {
+			return fail(err)
+		}
+		audit.Write(auditEntry("update", pasta, "", "cli"))
+		if expire == 0 {
+			fmt.Printf("Pasta %s never expires\n", *expireId)
+		} else {
+			fmt.Printf("Pasta %s expires %s\n", *expireId, time.Unix(expire, 0).Format("2006-01-02 15:04:05"))
+		}
+	} else if unpublishCmd.Happened() {
+		if !checkId(*unpublishId) {
+			return 1
+		}
+		public, err := adminUnpublish(&admin, *unpublishId)
+		if err != nil {
+			return fail(err)
+		}
+		if public {
+			audit.Write(AuditEntry{Event: "unpublish", Id: *unpublishId, Auth: "cli"})
+			fmt.Printf("Removed pasta %s from the public list\n", *unpublishId)
+		} else {
+			fmt.Printf("Pasta %s is not public\n", *unpublishId)
+		}
+	} else if pinCmd.Happened() || unpinCmd.Happened() {
+		id, pinned := *pinId, true
+		if unpinCmd.Happened() {
+			id, pinned = *unpinId, false
+		}
+		if !checkId(id) {
+			return 1
+		}
+		pasta, err := adminSetPinned(&admin, id, pinned)
+		if err != nil {
+			return fail(err)
+		}
+		audit.Write(auditEntry("update", pasta, "", "cli"))
+		if pinned {
+			fmt.Printf("Pinned pasta %s\n", id)
+		} else {
+			fmt.Printf("Unpinned pasta %s\n", id)
+		}
+	} else if statsCmd.Happened() {
+		stats, err := adminStats(&admin)
+		if err != nil {
+			return fail(err)
+		}
+		if *asJson {
+			printJson(stats)
+			return 0
+		}
+		fmt.Printf("Pastas:  %d (%d bytes)\n", stats.Pastas, stats.Bytes)
+		fmt.Printf("Expired: %d (%d bytes)\n", stats.Expired, stats.ExpiredBytes)
+		fmt.Printf("Public:  %d\n", stats.Public)
+		owners := make([]string, 0)
+		for owner := range stats.Owners {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners)
+		for _, owner := range owners {
+			fmt.Printf("Owner %s: %d pastas\n", owner, stats.Owners[owner])
+		}
+	}
+	return 0
+}
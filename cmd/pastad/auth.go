@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+/* APIKey allows the creation of new pastas. The label is recorded as owner of the pastas created with this key */
+type APIKey struct {
+	Label        string   `toml:"label"`
+	Key          string   `toml:"key"`
+	QuotaBytes   ByteSize `toml:"QuotaBytes"`   // Quota for this key, overrides the global setting
+	QuotaPastas  int      `toml:"QuotaPastas"`  // Quota for this key, overrides the global setting
+	QuotaUploads int      `toml:"QuotaUploads"` // Quota for this key, overrides the global setting
+}
+
+/* KeyRing holds the currently active API keys. If no keys are present, uploads are not restricted */
+type KeyRing struct {
+	mutex sync.RWMutex
+	keys  []APIKey
+}
+
+var errInvalidKey = errors.New("invalid api key")
+
+// Set replaces the active keys
+func (ring *KeyRing) Set(keys []APIKey) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.keys = keys
+}
+
+// Enabled returns true if API keys are configured and therefore required for uploading
+func (ring *KeyRing) Enabled() bool {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return len(ring.keys) > 0
+}
+
+// Count returns the number of active keys
+func (ring *KeyRing) Count() int {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return len(ring.keys)
+}
+
+// Lookup searches for the given key. All keys are compared in constant time
+func (ring *KeyRing) Lookup(key string) (APIKey, bool) {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	var ret APIKey
+	found := false
+	for _, apikey := range ring.keys {
+		if subtle.ConstantTimeCompare([]byte(apikey.Key), []byte(key)) == 1 && !found {
+			ret, found = apikey, true
+		}
+	}
+	return ret, found
+}
+
+/* Load API keys from a keys file. The keys file is a simple text file with one key per line:
+ * LABEL = KEY
+ * Empty lines and lines starting with '#' are ignored */
+func loadKeysFile(filename string) ([]APIKey, error) {
+	ret := make([]APIKey, 0)
+	file, err := os.OpenFile(filename, os.O_RDONLY, 0400)
+	if err != nil {
+		return ret, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return ret, fmt.Errorf("%s:%d: expected 'label = key'", filename, lineno)
+		}
+		label, key := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if label == "" || key == "" {
+			return ret, fmt.Errorf("%s:%d: empty label or key", filename, lineno)
+		}
+		ret = append(ret, APIKey{Label: label, Key: key})
+	}
+	return ret, scanner.Err()
+}
+
+// loadAPIKeys returns the API keys from the config and the configured keys file
+func loadAPIKeys(cf *Config) ([]APIKey, error) {
+	keys := make([]APIKey, 0)
+	for _, key := range cf.APIKeys {
+		if key.Key == "" || key.Label == "" {
+			return keys, fmt.Errorf("api key without label or key")
+		}
+		keys = append(keys, key)
+	}
+	if cf.KeysFile != "" {
+		fileKeys, err := loadKeysFile(cf.KeysFile)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	return keys, nil
+}
+
+/* Get the API key of the request from the "Authorization: Bearer" header.
+ * Returns the key and true, if a valid key is given. If an invalid key is given, errInvalidKey is returned */
+func requestKey(r *http.Request) (APIKey, bool, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return APIKey{}, false, nil
+	}
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return APIKey{}, false, errInvalidKey
+	}
+	key, ok := keys.Lookup(strings.TrimSpace(header[7:]))
+	if !ok {
+		return APIKey{}, false, errInvalidKey
+	}
+	return key, true, nil
+}
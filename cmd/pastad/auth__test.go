@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeysFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "keys")
+	content := "# API keys\n\nalice = key1\n  bob=key=with=equals  \n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	keys, err := loadKeysFile(filename)
+	if err != nil {
+		t.Fatalf("Error loading keys file: %s", err)
+	}
+	if len(keys) != 2 || keys[0].Label != "alice" || keys[0].Key != "key1" || keys[1].Label != "bob" || keys[1].Key != "key=with=equals" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+	for _, invalid := range []string{"alice key1\n", "= key1\n", "alice =\n"} {
+		if err := os.WriteFile(filename, []byte(invalid), 0600); err != nil {
+			t.Fatalf("Error writing keys file: %s", err)
+		}
+		if _, err := loadKeysFile(filename); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("Invalid keys file %q accepted: %v", invalid, err)
+		}
+	}
+	if _, err := loadKeysFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("Missing keys file accepted")
+	}
+
+	// Keys from the config and the keys file are combined
+	os.WriteFile(filename, []byte("bob = key2\n"), 0600)
+	config := Config{APIKeys: []APIKey{{Label: "alice", Key: "key1"}}, KeysFile: filename}
+	if keys, err := loadAPIKeys(&config); err != nil || len(keys) != 2 || keys[1].Label != "bob" {
+		t.Fatalf("Unexpected api keys: %v %v", keys, err)
+	}
+	config.APIKeys = []APIKey{{Label: "alice"}}
+	if _, err := loadAPIKeys(&config); err == nil {
+		t.Fatal("API key without key accepted")
+	}
+}
+
+func TestKeyLookup(t *testing.T) {
+	var ring KeyRing
+	if ring.Enabled() {
+		t.Fatal("Empty key ring enabled")
+	}
+	ring.Set([]APIKey{{Label: "alice", Key: "key1"}, {Label: "bob", Key: "key2"}, {Label: "duplicate", Key: "key2"}})
+	if !ring.Enabled() || ring.Count() != 3 {
+		t.Fatalf("Unexpected key count: %d", ring.Count())
+	}
+	if key, ok := ring.Lookup("key1"); !ok || key.Label != "alice" {
+		t.Errorf("Key of alice not found: %v", key)
+	}
+	// All keys are compared, the first matching key wins
+	if key, ok := ring.Lookup("key2"); !ok || key.Label != "bob" {
+		t.Errorf("Key of bob not found: %v", key)
+	}
+	for _, invalid := range []string{"", "key", "key10", "KEY1", "key1 "} {
+		if key, ok := ring.Lookup(invalid); ok {
+			t.Errorf("Invalid key %q matches %s", invalid, key.Label)
+		}
+	}
+}
+
+func TestAuthenticatedUploads(t *testing.T) {
+	defer keys.Set(nil)
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+	})
+	keys.Set([]APIKey{{Label: "alice", Key: "key1"}})
+	upload := func(authorization string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("Hello pasta"))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	w := upload("")
+	if w.Code != http.StatusUnauthorized || w.Body.String() != "api key required" || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Unexpected reply for upload without key: %d %s", w.Code, w.Body.String())
+	}
+	for _, invalid := range []string{"Bearer key2", "Basic key1", "key1"} {
+		if w := upload(invalid); w.Code != http.StatusUnauthorized || w.Body.String() != "invalid api key" {
+			t.Errorf("Unexpected reply for upload with %q: %d %s", invalid, w.Code, w.Body.String())
+		}
+	}
+	if pastas, _ := bowl.ListPastas(); len(pastas) != 0 {
+		t.Fatalf("Unauthenticated uploads stored: %d pastas", len(pastas))
+	}
+	if w := upload("bearer key1"); w.Code != http.StatusOK {
+		t.Fatalf("Upload with valid key rejected: %d %s", w.Code, w.Body.String())
+	}
+	if pastas, _ := bowl.ListPastas(); len(pastas) != 1 || pastas[0].Owner != "alice" {
+		t.Fatalf("Owner not recorded: %v", pastas)
+	}
+}
+
+func TestReloadKeys(t *testing.T) {
+	oldFile, oldFlags := configFile, configFlags
+	defer func() {
+		configFile, configFlags = oldFile, oldFlags
+		keys.Set(nil)
+	}()
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	configFile, configFlags = filepath.Join(dir, "pastad.toml"), nil
+	if err := os.WriteFile(configFile, []byte("KeysFile = \""+keysFile+"\"\n"), 0600); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	if err := os.WriteFile(keysFile, []byte("alice = key1\n"), 0600); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	useTestBowl(t, func(config *Config) {
+		*config, _, _ = loadConfig(configFile, nil)
+	})
+	if _, err := reloadConfig(); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+	if _, ok := keys.Lookup("key1"); !ok {
+		t.Fatal("Keys file not loaded")
+	}
+	os.WriteFile(keysFile, []byte("bob = key2\n"), 0600)
+	if _, err := reloadConfig(); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+	if _, ok := keys.Lookup("key1"); ok {
+		t.Error("Removed key still active")
+	}
+	if key, ok := keys.Lookup("key2"); !ok || key.Label != "bob" {
+		t.Error("New key not active")
+	}
+	// An invalid keys file keeps the current keys
+	os.WriteFile(keysFile, []byte("carol\n"), 0600)
+	if _, err := reloadConfig(); err == nil {
+		t.Error("Invalid keys file accepted")
+	}
+	if _, ok := keys.Lookup("key2"); !ok {
+		t.Error("Keys changed by invalid reload")
+	}
+}
+
+// Anonymous uploads must not be able to claim an owner through the filename metadata
+func TestOwnerInjection(t *testing.T) {
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+	})
+	filename := "a\r\nowner:alice"
+	r := httptest.NewRequest("POST", "/?input=form", strings.NewReader("content=content&filename="+url.QueryEscape(filename)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Filename with owner metadata accepted: %d %s", w.Code, w.Body.String())
+	}
+	pasta := Pasta{ContentFilename: filename, Client: "192.0.2.1"}
+	file, err := bowl.CreatePasta(&pasta)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("content"))
+	if err := file.Commit(7); err != nil {
+		t.Fatalf("Error committing pasta: %s", err)
+	}
+	pastas, _ := bowl.ListPastas()
+	if len(pastas) != 1 || pastas[0].Owner != "" || quotaSubject(pastas[0].Owner, pastas[0].Client) != "ip:192.0.2.1" {
+		t.Fatalf("Owner injected through the filename: %v", pastas)
+	}
+}
@@ -1,34 +1,135 @@
 package main
 
 import (
+	"bytes"
+	"encoding"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/akamensky/argparse"
 )
 
 type Config struct {
-	BaseUrl         string `toml:"BaseURL"`  // Instance base URL
-	PastaDir        string `toml:"PastaDir"` // dir where pasta are stored
-	BindAddr        string `toml:"BindAddress"`
-	MaxPastaSize    int64  `toml:"MaxPastaSize"` // Max bin size in bytes
-	PastaCharacters int    `toml:"PastaCharacters"`
-	MimeTypesFile   string `toml:"MimeTypes"`    // Load mime types from this file
-	DefaultExpire   int64  `toml:"Expire"`       // Default expire time for a new pasta in seconds
-	CleanupInterval int    `toml:"Cleanup"`      // Seconds between cleanup cycles
-	RequestDelay    int64  `toml:"RequestDelay"` // Required delay between requests in milliseconds
-	PublicPastas    int    `toml:"PublicPastas"` // Number of pastas to display on public page or 0 to disable
+	BaseUrl           string       `toml:"BaseURL"`  // Instance base URL. If empty, it is derived from the request
+	PastaDir          string       `toml:"PastaDir"` // dir where pasta are stored
+	BindAddr          string       `toml:"BindAddress"`
+	MaxPastaSize      ByteSize     `toml:"MaxPastaSize"` // Max bin size in bytes
+	PastaCharacters   int          `toml:"PastaCharacters"`
+	MimeTypesFile     string       `toml:"MimeTypes"`          // Load mime types from this file
+	DefaultExpire     Seconds      `toml:"Expire"`             // Default expire time for a new pasta in seconds
+	CleanupInterval   Seconds      `toml:"Cleanup"`            // Seconds between cleanup cycles
+	RequestDelay      Milliseconds `toml:"RequestDelay"`       // Required delay between requests in milliseconds
+	PublicPastas      int          `toml:"PublicPastas"`       // Number of pastas to display on public page or 0 to disable
+	APIKeys           []APIKey     `toml:"APIKey"`             // API keys required for creating new pastas. If none are given, uploads are not restricted
+	KeysFile          string       `toml:"KeysFile"`           // Load additional API keys from this file
+	QuotaBytes        ByteSize     `toml:"QuotaBytes"`         // Maximum stored bytes per API key or client IP, 0 = unlimited
+	QuotaPastas       int          `toml:"QuotaPastas"`        // Maximum live pastas per API key or client IP, 0 = unlimited
+	QuotaUploads      int          `toml:"QuotaUploads"`       // Maximum uploads per hour per API key or client IP, 0 = unlimited
+	RateLimitPost     float64      `toml:"RateLimitPost"`      // Maximum POST requests per minute per API key or client IP, 0 = unlimited
+	RateLimitDelete   float64      `toml:"RateLimitDelete"`    // Maximum DELETE requests per minute per API key or client IP, 0 = unlimited
+	RateLimitGet      float64      `toml:"RateLimitGet"`       // Maximum GET requests per minute per API key or client IP, 0 = unlimited
+	RateLimitBurst    int          `toml:"RateLimitBurst"`     // Number of requests that may exceed the rate limit in a burst
+	TrustedProxies    []string     `toml:"TrustedProxies"`     // CIDRs of reverse proxies, whose forwarding headers (X-Forwarded-For, Forwarded) are trusted
+	AllowCreate       []string     `toml:"AllowCreate"`        // CIDRs allowed to create pastas. Empty = everyone
+	DenyCreate        []string     `toml:"DenyCreate"`         // CIDRs not allowed to create pastas
+	AllowDelete       []string     `toml:"AllowDelete"`        // CIDRs allowed to delete pastas. Empty = everyone
+	DenyDelete        []string     `toml:"DenyDelete"`         // CIDRs not allowed to delete pastas
+	AllowRead         []string     `toml:"AllowRead"`          // CIDRs allowed to read pastas. Empty = everyone
+	DenyRead          []string     `toml:"DenyRead"`           // CIDRs not allowed to read pastas
+	AdminKey          string       `toml:"AdminKey"`           // Key for the admin API. If empty, the admin API is disabled
+	MetricsBindAddr   string       `toml:"MetricsBindAddress"` // Serve /metrics on this address. If empty, /metrics is served on the main address
+	LogLevel          string       `toml:"LogLevel"`           // debug, info, warn or error
+	LogFormat         string       `toml:"LogFormat"`          // json or text
+	AccessLog         string       `toml:"AccessLog"`          // Access log file, "-" for stdout. If empty, no access log is written
+	AccessLogFormat   string       `toml:"AccessLogFormat"`    // combined or common
+	AuditLog          string       `toml:"AuditLog"`           // Audit log file (JSON lines). If empty, no audit log is written
+	QuarantineDir     string       `toml:"QuarantineDir"`      // Directory for corrupt pastas. If empty, "_quarantine" in PastaDir is used
+	ReplicationKey    string       `toml:"ReplicationKey"`     // Key for the replication endpoints. If empty, replication is disabled
+	ReplicaOf         string       `toml:"ReplicaOf"`          // URL of the primary. If set, this instance is a read-only replica
+	MaxStorageBytes   ByteSize     `toml:"MaxStorageBytes"`    // Maximum total size of all pastas, 0 = unlimited
+	EvictionPolicy    string       `toml:"EvictionPolicy"`     // What to do if the storage cap is reached: reject, expire, oldest or lru
+	MimeDefaultAction string       `toml:"MimeDefaultAction"`  // Action for mime types without rule: allow, deny, plain or download
+	MimeRules         []MimeRule   `toml:"MimeRule"`           // Per mime type policy. If none are given, the default rules apply
+	UserContentUrl    string       `toml:"UserContentURL"`     // Serve the content of pastas from this base URL (separate origin). If empty, pastas are served on the main origin
+	TLSBindAddr       string       `toml:"TLSBindAddress"`     // Serve HTTPS on this address. Requires TLSCert and TLSKey
+	TLSCert           string       `toml:"TLSCert"`            // TLS certificate (PEM). Reloaded when changed
+	TLSKey            string       `toml:"TLSKey"`             // TLS private key (PEM). Reloaded when changed
+	UnixSocket        string       `toml:"UnixSocket"`         // Serve HTTP on this unix domain socket, e.g. for a reverse proxy
+	UnixSocketMode    string       `toml:"UnixSocketMode"`     // Permissions of the unix socket (octal)
+	ShutdownTimeout   Seconds      `toml:"ShutdownTimeout"`    // Seconds to wait for in-flight requests when shutting down
+}
+
+/* configOption is a setting, that can also be set by an environment variable and a program argument */
+type configOption struct {
+	Key   string // key in the config file
+	Env   string // environment variable
+	Short string // short program argument, if any
+	Long  string // long program argument
+	Help  string
+}
+
+/* All settings except the tables (APIKey, MimeRule), which can only be set in the config file */
+var configOptions = []configOption{
+	{"BaseURL", "PASTA_BASEURL", "B", "baseurl", "Set base URL for instance"},
+	{"PastaDir", "PASTA_PASTADIR", "d", "dir", "Set pasta data directory"},
+	{"BindAddress", "PASTA_BINDADDR", "b", "bind", "Address to bind server to"},
+	{"MaxPastaSize", "PASTA_MAXSIZE", "s", "size", "Maximum allowed size for a pasta (e.g. 25MiB)"},
+	{"PastaCharacters", "PASTA_CHARACTERS", "n", "chars", "Random characters for new pastas"},
+	{"MimeTypes", "PASTA_MIMEFILE", "m", "mime", "Define mime types file"},
+	{"Expire", "PASTA_EXPIRE", "e", "expire", "Pasta expire in seconds or with unit (e.g. 30d), 0 = never"},
+	{"Cleanup", "PASTA_CLEANUP", "C", "cleanup", "Cleanup interval in seconds or with unit (e.g. 1h), 0 = disabled"},
+	{"RequestDelay", "PASTA_REQUESTDELAY", "", "request-delay", "Minimum delay between POST/DELETE requests of a client in milliseconds or with unit (e.g. 2s)"},
+	{"PublicPastas", "PASTA_PUBLICPASTAS", "p", "public", "Number of public pastas to display, if any"},
+	{"KeysFile", "PASTA_KEYSFILE", "k", "keys", "Load API keys from this file"},
+	{"QuotaBytes", "PASTA_QUOTABYTES", "", "quota-bytes", "Maximum stored bytes per API key or client IP, 0 = unlimited"},
+	{"QuotaPastas", "PASTA_QUOTAPASTAS", "", "quota-pastas", "Maximum live pastas per API key or client IP, 0 = unlimited"},
+	{"QuotaUploads", "PASTA_QUOTAUPLOADS", "", "quota-uploads", "Maximum uploads per hour per API key or client IP, 0 = unlimited"},
+	{"RateLimitPost", "PASTA_RATELIMITPOST", "", "ratelimit-post", "Maximum POST requests per minute per API key or client IP, 0 = unlimited"},
+	{"RateLimitDelete", "PASTA_RATELIMITDELETE", "", "ratelimit-delete", "Maximum DELETE requests per minute per API key or client IP, 0 = unlimited"},
+	{"RateLimitGet", "PASTA_RATELIMITGET", "", "ratelimit-get", "Maximum GET requests per minute per API key or client IP, 0 = unlimited"},
+	{"RateLimitBurst", "PASTA_RATELIMITBURST", "", "ratelimit-burst", "Number of requests that may exceed the rate limit in a burst"},
+	{"TrustedProxies", "PASTA_TRUSTEDPROXIES", "", "trusted-proxies", "Comma separated IPs or CIDRs of trusted reverse proxies"},
+	{"AllowCreate", "PASTA_ALLOWCREATE", "", "allow-create", "Comma separated IPs or CIDRs allowed to create pastas"},
+	{"DenyCreate", "PASTA_DENYCREATE", "", "deny-create", "Comma separated IPs or CIDRs not allowed to create pastas"},
+	{"AllowDelete", "PASTA_ALLOWDELETE", "", "allow-delete", "Comma separated IPs or CIDRs allowed to delete pastas"},
+	{"DenyDelete", "PASTA_DENYDELETE", "", "deny-delete", "Comma separated IPs or CIDRs not allowed to delete pastas"},
+	{"AllowRead", "PASTA_ALLOWREAD", "", "allow-read", "Comma separated IPs or CIDRs allowed to read pastas"},
+	{"DenyRead", "PASTA_DENYREAD", "", "deny-read", "Comma separated IPs or CIDRs not allowed to read pastas"},
+	{"AdminKey", "PASTA_ADMINKEY", "", "admin-key", "Key for the admin API"},
+	{"MetricsBindAddress", "PASTA_METRICSBINDADDR", "", "metrics-bind", "Serve /metrics on this address"},
+	{"LogLevel", "PASTA_LOGLEVEL", "", "log-level", "Log level (debug, info, warn or error)"},
+	{"LogFormat", "PASTA_LOGFORMAT", "", "log-format", "Log format (json or text)"},
+	{"AccessLog", "PASTA_ACCESSLOG", "", "access-log", "Access log file, - for stdout"},
+	{"AccessLogFormat", "PASTA_ACCESSLOGFORMAT", "", "access-log-format", "Access log format (combined or common)"},
+	{"AuditLog", "PASTA_AUDITLOG", "", "audit-log", "Audit log file"},
+	{"QuarantineDir", "PASTA_QUARANTINEDIR", "", "quarantine-dir", "Directory for corrupt pastas"},
+	{"ReplicationKey", "PASTA_REPLICATIONKEY", "", "replication-key", "Key for the replication endpoints"},
+	{"ReplicaOf", "PASTA_REPLICAOF", "", "replica-of", "URL of the primary, run as read-only replica"},
+	{"MaxStorageBytes", "PASTA_MAXSTORAGEBYTES", "", "max-storage", "Maximum total size of all pastas (e.g. 10GiB), 0 = unlimited"},
+	{"EvictionPolicy", "PASTA_EVICTIONPOLICY", "", "eviction-policy", "What to do if the storage cap is reached: reject, expire, oldest or lru"},
+	{"MimeDefaultAction", "PASTA_MIMEDEFAULTACTION", "", "mime-default-action", "Action for mime types without rule: allow, deny, plain or download"},
+	{"UserContentURL", "PASTA_USERCONTENTURL", "", "usercontent-url", "Serve the content of pastas from this base URL"},
+	{"TLSBindAddress", "PASTA_TLSBINDADDR", "", "tls-bind", "Serve HTTPS on this address"},
+	{"TLSCert", "PASTA_TLSCERT", "", "tls-cert", "TLS certificate file (PEM)"},
+	{"TLSKey", "PASTA_TLSKEY", "", "tls-key", "TLS private key file (PEM)"},
+	{"UnixSocket", "PASTA_UNIXSOCKET", "", "unix-socket", "Serve HTTP on this unix domain socket"},
+	{"UnixSocketMode", "PASTA_UNIXSOCKETMODE", "", "unix-socket-mode", "Permissions of the unix socket (octal)"},
+	{"ShutdownTimeout", "PASTA_SHUTDOWNTIMEOUT", "", "shutdown-timeout", "Time to wait for in-flight requests when shutting down, in seconds or with unit"},
 }
 
+/* ParserConfig holds the program arguments for the settings */
 type ParserConfig struct {
-	ConfigFile      *string
-	BaseURL         *string
-	PastaDir        *string
-	BindAddr        *string
-	MaxPastaSize    *int // parser doesn't support int64
-	PastaCharacters *int
-	MimeTypesFile   *string
-	DefaultExpire   *int // parser doesn't support int64
-	CleanupInterval *int
-	PublicPastas    *int
+	ConfigFile *string
+	parser     *argparse.Parser
+	values     map[string]*string // program arguments by setting key
 }
 
 func CreateDefaultConfigfile(filename string) error {
@@ -53,7 +154,7 @@ func CreateDefaultConfigfile(filename string) error {
 
 // SetDefaults sets the default values to a config instance
 func (cf *Config) SetDefaults() {
-	cf.BaseUrl = "http://localhost:8199"
+	cf.BaseUrl = "" // derive from request
 	cf.PastaDir = "pastas/"
 	cf.BindAddr = "127.0.0.1:8199"
 	cf.MaxPastaSize = 1024 * 1024 * 25 // Default max size: 25 MB
@@ -63,48 +164,317 @@ func (cf *Config) SetDefaults() {
 	cf.CleanupInterval = 60 * 60 // Default cleanup is once per hour
 	cf.RequestDelay = 0          // By default not spam protection (Assume we are in safe environment)
 	cf.PublicPastas = 0
+	cf.QuotaBytes = 0
+	cf.QuotaPastas = 0
+	cf.QuotaUploads = 0
+	cf.RateLimitPost = 0
+	cf.RateLimitDelete = 0
+	cf.RateLimitGet = 0
+	cf.RateLimitBurst = 5
+	cf.LogLevel = "info"
+	cf.LogFormat = "json"
+	cf.AccessLogFormat = "combined"
+	cf.MaxStorageBytes = 0
+	cf.EvictionPolicy = EvictReject
+	cf.MimeDefaultAction = MimeAllow
+	cf.UnixSocketMode = "0660"
+	cf.ShutdownTimeout = 30
+}
+
+// ReadEnv reads the environmental variables and sets the config accordingly. Empty variables are ignored. Returns the keys of the settings that were set
+func (cf *Config) ReadEnv() ([]string, error) {
+	keys := make([]string, 0)
+	for _, option := range configOptions {
+		value := os.Getenv(option.Env)
+		if value == "" {
+			continue
+		}
+		if err := cf.Set(option.Key, value); err != nil {
+			return keys, fmt.Errorf("%s: %s", option.Env, err)
+		}
+		keys = append(keys, option.Key)
+	}
+	return keys, nil
+}
+
+/* Set a setting by its key in the config file from a string. Lists are comma separated */
+func (cf *Config) Set(key string, value string) error {
+	v := reflect.ValueOf(cf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if strings.Split(v.Type().Field(i).Tag.Get("toml"), ",")[0] != key {
+			continue
+		}
+		field := v.Field(i)
+		if unmarshaler, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return unmarshaler.UnmarshalText([]byte(value))
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number: %s", value)
+			}
+			field.SetInt(i)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return fmt.Errorf("invalid number: %s", value)
+			}
+			field.SetFloat(f)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s can only be set in the config file", key)
+			}
+			field.Set(reflect.ValueOf(splitList(value)))
+		default:
+			return fmt.Errorf("%s can only be set in the config file", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting: %s", key)
+}
+
+// NewParserConfig adds the program arguments for all settings to the parser
+func NewParserConfig(parser *argparse.Parser) *ParserConfig {
+	pc := &ParserConfig{parser: parser, values: make(map[string]*string, 0)}
+	pc.ConfigFile = parser.String("c", "config", &argparse.Options{Default: "", Help: "Set config file"})
+	for _, option := range configOptions {
+		pc.values[option.Key] = parser.String(option.Short, option.Long, &argparse.Options{Help: option.Help})
+	}
+	return pc
+}
+
+/* Apply the given program arguments to the config. In contrast to the environment variables, also empty values and zeros are applied.
+ * Returns the keys of the settings that were set */
+func (pc *ParserConfig) ApplyTo(cf *Config) ([]string, error) {
+	keys := make([]string, 0)
+	given := make(map[string]bool, 0)
+	for _, arg := range pc.parser.GetArgs() {
+		if arg.GetParsed() {
+			given[arg.GetLname()] = true
+		}
+	}
+	for _, option := range configOptions {
+		if !given[option.Long] {
+			continue
+		}
+		if err := cf.Set(option.Key, *pc.values[option.Key]); err != nil {
+			return keys, fmt.Errorf("--%s: %s", option.Long, err)
+		}
+		keys = append(keys, option.Key)
+	}
+	return keys, nil
+}
+
+// Sources of config values
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFile    = "file"
+	SourceFlag    = "flag"
+)
+
+var currentConfig atomic.Pointer[Config]
+
+// cf returns the active config. It must not be modified, a new config is applied with setConfig
+func cf() *Config {
+	if config := currentConfig.Load(); config != nil {
+		return config
+	}
+	return &Config{}
+}
+
+// setConfig replaces the active config atomically
+func setConfig(config *Config) {
+	currentConfig.Store(config)
+}
+
+// configValues returns the values of all settings by their key in the config file
+func configValues(cf *Config) map[string]interface{} {
+	values := make(map[string]interface{}, 0)
+	v := reflect.ValueOf(cf).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("toml"), ",")[0]
+		values[key] = v.Field(i).Interface()
+	}
+	return values
+}
+
+/* Read the config from the defaults, the given config file, the environment variables and the program arguments, in this order of precedence.
+ * Returns the config and the source of each setting by its key. The config is not validated */
+func readConfig(configFile string, pc *ParserConfig) (Config, map[string]string, error) {
+	var config Config
+	config.SetDefaults()
+	sources := make(map[string]string, 0)
+	for key := range configValues(&config) {
+		sources[key] = SourceDefault
+	}
+	if configFile != "" && FileExists(configFile) {
+		meta, err := toml.DecodeFile(configFile, &config)
+		if err != nil {
+			return config, sources, err
+		}
+		for key := range sources {
+			if meta.IsDefined(key) {
+				sources[key] = SourceFile
+			}
+		}
+	}
+	keys, err := config.ReadEnv()
+	if err != nil {
+		return config, sources, err
+	}
+	for _, key := range keys {
+		sources[key] = SourceEnv
+	}
+	if pc != nil {
+		keys, err := pc.ApplyTo(&config)
+		if err != nil {
+			return config, sources, err
+		}
+		for _, key := range keys {
+			sources[key] = SourceFlag
+		}
+	}
+	return config, sources, nil
 }
 
-// ReadEnv reads the environmental variables and sets the config accordingly
-func (cf *Config) ReadEnv() {
-	cf.BaseUrl = getenv("PASTA_BASEURL", cf.BaseUrl)
-	cf.PastaDir = getenv("PASTA_PASTADIR", cf.PastaDir)
-	cf.BindAddr = getenv("PASTA_BINDADDR", cf.BindAddr)
-	cf.MaxPastaSize = getenv_i64("PASTA_MAXSIZE", cf.MaxPastaSize)
-	cf.PastaCharacters = getenv_i("PASTA_CHARACTERS", cf.PastaCharacters)
-	cf.MimeTypesFile = getenv("PASTA_MIMEFILE", cf.MimeTypesFile)
-	cf.DefaultExpire = getenv_i64("PASTA_EXPIRE", cf.DefaultExpire)
-	cf.CleanupInterval = getenv_i("PASTA_CLEANUP", cf.CleanupInterval)
-	cf.RequestDelay = getenv_i64("PASTA_REQUESTDELAY", cf.RequestDelay)
-	cf.PublicPastas = getenv_i("PASTA_PUBLICPASTAS", cf.PublicPastas)
+/* Load and validate the config. Returns the config and the source of each setting by its key */
+func loadConfig(configFile string, pc *ParserConfig) (Config, map[string]string, error) {
+	config, sources, err := readConfig(configFile, pc)
+	if err != nil {
+		return config, sources, err
+	}
+	if err := config.prepare(); err != nil {
+		return config, sources, err
+	}
+	return config, sources, config.Validate()
 }
 
-func (pc *ParserConfig) ApplyTo(cf *Config) {
-	if pc.BaseURL != nil && *pc.BaseURL != "" {
-		cf.BaseUrl = *pc.BaseURL
+/* Read the config for a subcommand, which only needs the data directory. The config is not validated */
+func readSubcommandConfig(configFile string, dir string) error {
+	if configFile != "" && !FileExists(configFile) {
+		return fmt.Errorf("configuration file not found: %s", configFile)
+	}
+	config, _, err := readConfig(configFile, nil)
+	if err != nil {
+		return fmt.Errorf("error loading configuration: %s", err)
+	}
+	if dir != "" {
+		config.PastaDir = dir
 	}
-	if pc.PastaDir != nil && *pc.PastaDir != "" {
-		cf.PastaDir = *pc.PastaDir
+	setConfig(&config)
+	return nil
+}
+
+// prepare applies the macros and the fallbacks for invalid values
+func (cf *Config) prepare() error {
+	if cf.PastaCharacters <= 0 {
+		slog.Warn("setting pasta characters to default 8 because it was <= 0")
+		cf.PastaCharacters = 8
 	}
-	if pc.BindAddr != nil && *pc.BindAddr != "" {
-		cf.BindAddr = *pc.BindAddr
+	if cf.PastaDir == "" {
+		cf.PastaDir = "."
 	}
-	if pc.MaxPastaSize != nil && *pc.MaxPastaSize > 0 {
-		cf.MaxPastaSize = int64(*pc.MaxPastaSize)
+	baseURL, err := ApplyMacros(cf.BaseUrl)
+	if err != nil {
+		return fmt.Errorf("error applying macros: %s", err)
 	}
-	if pc.PastaCharacters != nil && *pc.PastaCharacters > 0 {
-		cf.PastaCharacters = *pc.PastaCharacters
+	cf.BaseUrl = strings.TrimSuffix(baseURL, "/")
+	userContentURL, err := ApplyMacros(cf.UserContentUrl)
+	if err != nil {
+		return fmt.Errorf("error applying macros: %s", err)
 	}
-	if pc.MimeTypesFile != nil && *pc.MimeTypesFile != "" {
-		cf.MimeTypesFile = *pc.MimeTypesFile
+	cf.UserContentUrl = strings.TrimSuffix(userContentURL, "/")
+	return nil
+}
+
+// Validate checks the config for invalid settings
+func (cf *Config) Validate() error {
+	if _, err := parseLogLevel(cf.LogLevel); err != nil {
+		return fmt.Errorf("invalid log level: %s", cf.LogLevel)
+	}
+	if format := strings.ToLower(cf.LogFormat); format != "" && format != "json" && format != "text" {
+		return fmt.Errorf("invalid log format: %s", cf.LogFormat)
+	}
+	if format := strings.ToLower(cf.AccessLogFormat); format != "" && format != "combined" && format != "common" {
+		return fmt.Errorf("invalid access log format: %s", cf.AccessLogFormat)
+	}
+	if err := checkUserContentURL(cf.UserContentUrl, cf.BaseUrl); err != nil {
+		return fmt.Errorf("invalid user content url: %s", err)
+	}
+	if _, err := parseCIDRs(cf.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %s", err)
+	}
+	var lists AccessLists
+	if err := lists.Load(cf); err != nil {
+		return fmt.Errorf("invalid access list: %s", err)
+	}
+	if err := checkListeners(cf); err != nil {
+		return fmt.Errorf("invalid listener configuration: %s", err)
+	}
+	var policy MimePolicy
+	if err := policy.Load(cf); err != nil {
+		return fmt.Errorf("invalid mime policy: %s", err)
+	}
+	if !validEvictionPolicy(cf.EvictionPolicy) {
+		return fmt.Errorf("invalid eviction policy: %s", cf.EvictionPolicy)
+	}
+	if _, err := loadAPIKeys(cf); err != nil {
+		return fmt.Errorf("invalid api keys: %s", err)
+	}
+	return nil
+}
+
+// Settings that contain secrets and are not printed
+var secretSettings = map[string]bool{"AdminKey": true, "ReplicationKey": true}
+
+/* Print the config with the source of each setting in the config file format. Secrets are masked */
+func printConfig(w io.Writer, cf *Config, sources map[string]string) error {
+	masked := *cf
+	masked.APIKeys = make([]APIKey, len(cf.APIKeys))
+	for i, key := range cf.APIKeys {
+		key.Key = "********"
+		masked.APIKeys[i] = key
 	}
-	if pc.DefaultExpire != nil && *pc.DefaultExpire > 0 {
-		cf.DefaultExpire = int64(*pc.DefaultExpire)
+	values := configValues(&masked)
+	keys := make([]string, 0, len(values))
+	tables := make([]string, 0)
+	for key, value := range values {
+		kind := reflect.TypeOf(value).Kind()
+		if kind == reflect.Slice && reflect.TypeOf(value).Elem().Kind() == reflect.Struct {
+			tables = append(tables, key)
+		} else {
+			keys = append(keys, key)
+		}
 	}
-	if pc.CleanupInterval != nil && *pc.CleanupInterval > 0 {
-		cf.CleanupInterval = *pc.CleanupInterval
+	sort.Strings(keys)
+	sort.Strings(tables)
+	for _, key := range keys {
+		value := values[key]
+		if secretSettings[key] && value != "" {
+			value = "********"
+		}
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{key: value}); err != nil {
+			return err
+		}
+		line := strings.TrimSpace(buf.String())
+		if line == "" {
+			// Empty lists are not encoded
+			line = key + " = []"
+		}
+		fmt.Fprintf(w, "%-40s # %s\n", line, sources[key])
 	}
-	if pc.PublicPastas != nil && *pc.PublicPastas > 0 {
-		cf.PublicPastas = *pc.PublicPastas
+	for _, key := range tables {
+		fmt.Fprintf(w, "\n# %s: %s\n", key, sources[key])
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{key: values[key]}); err != nil {
+			return err
+		}
+		w.Write(buf.Bytes())
 	}
+	return nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+func TestUnits(t *testing.T) {
+	sizes := map[string]int64{"1024": 1024, "25MiB": 25 * 1024 * 1024, "10MB": 10 * 1000 * 1000, "1.5k": 1536, "2 GiB": 2 << 30, "0": 0}
+	for value, expected := range sizes {
+		if size, err := parseByteSize(value); err != nil || size != expected {
+			t.Errorf("Unexpected size for %s: %d %v", value, size, err)
+		}
+	}
+	for _, value := range []string{"", "MiB", "25XB", "1.2.3MB"} {
+		if _, err := parseByteSize(value); err == nil {
+			t.Errorf("Invalid size accepted: %s", value)
+		}
+	}
+	durations := []struct {
+		value    string
+		base     time.Duration
+		expected int64
+	}{
+		{"3600", time.Second, 3600},
+		{"30d", time.Second, 30 * 24 * 3600},
+		{"1h30m", time.Second, 5400},
+		{"2w", time.Second, 14 * 24 * 3600},
+		{"2000", time.Millisecond, 2000},
+		{"2s", time.Millisecond, 2000},
+		{"500ms", time.Millisecond, 500},
+		{"-1", time.Second, -1},
+	}
+	for _, check := range durations {
+		if value, err := parseDuration(check.value, check.base); err != nil || value != check.expected {
+			t.Errorf("Unexpected duration for %s: %d %v", check.value, value, err)
+		}
+	}
+	for _, value := range []string{"", "d", "30x", "500ms"} {
+		if _, err := parseDuration(value, time.Second); err == nil {
+			t.Errorf("Invalid duration accepted: %s", value)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	filename := t.TempDir() + "/pastad.toml"
+	content := "MaxPastaSize = \"10MiB\"\nExpire = \"30d\"\nPublicPastas = 5\nRequestDelay = 1000\nAdminKey = \"secret\"\nBaseURL = \"http://file.example.org\"\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	// The environment overrides the config file, program arguments override both
+	t.Setenv("PASTA_BASEURL", "http://env.example.org/")
+	t.Setenv("PASTA_PUBLICPASTAS", "10")
+	t.Setenv("PASTA_CLEANUP", "2h")
+	t.Setenv("PASTA_TRUSTEDPROXIES", "127.0.0.1, 10.0.0.0/8")
+	parser := argparse.NewParser("pastad", "pasta server")
+	pc := NewParserConfig(parser)
+	if err := parser.Parse([]string{"pastad", "--public", "0", "--request-delay", "2s", "-n", "12", "--metrics-bind", ""}); err != nil {
+		t.Fatalf("Error parsing arguments: %s", err)
+	}
+	config, sources, err := loadConfig(filename, pc)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	if config.MaxPastaSize != 10*1024*1024 || config.DefaultExpire != 30*24*3600 {
+		t.Errorf("Units in config file not applied: %d %d", config.MaxPastaSize, config.DefaultExpire)
+	}
+	if config.BaseUrl != "http://env.example.org" || config.CleanupInterval != 7200 || len(config.TrustedProxies) != 2 {
+		t.Errorf("Environment variables not applied: %s %d %v", config.BaseUrl, config.CleanupInterval, config.TrustedProxies)
+	}
+	if config.PublicPastas != 0 || config.RequestDelay != 2000 || config.PastaCharacters != 12 {
+		t.Errorf("Program arguments not applied: %d %d %d", config.PublicPastas, config.RequestDelay, config.PastaCharacters)
+	}
+	expected := map[string]string{"MaxPastaSize": SourceFile, "BaseURL": SourceEnv, "PublicPastas": SourceFlag, "MetricsBindAddress": SourceFlag, "BindAddress": SourceDefault}
+	for key, source := range expected {
+		if sources[key] != source {
+			t.Errorf("Unexpected source of %s: %s", key, sources[key])
+		}
+	}
+	var buf bytes.Buffer
+	if err := printConfig(&buf, &config, sources); err != nil {
+		t.Fatalf("Error printing config: %s", err)
+	}
+	if !strings.Contains(buf.String(), "MaxPastaSize = 10485760") || strings.Contains(buf.String(), "secret") {
+		t.Errorf("Unexpected printed config: %s", buf.String())
+	}
+
+	// Invalid values are rejected instead of being ignored
+	t.Setenv("PASTA_MAXSIZE", "lots")
+	if _, _, err := loadConfig(filename, nil); err == nil {
+		t.Error("Invalid environment variable accepted")
+	}
+	t.Setenv("PASTA_MAXSIZE", "")
+	os.WriteFile(filename, []byte("EvictionPolicy = \"random\"\n"), 0600)
+	if _, _, err := loadConfig(filename, nil); err == nil {
+		t.Error("Invalid config accepted")
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	// Every setting except the tables can be set by an environment variable and a program argument
+	var config Config
+	options := make(map[string]bool, 0)
+	for _, option := range configOptions {
+		if options[option.Key] {
+			t.Errorf("Duplicate option: %s", option.Key)
+		}
+		options[option.Key] = true
+		if _, ok := configValues(&config)[option.Key]; !ok {
+			t.Errorf("Option for unknown setting: %s", option.Key)
+		}
+	}
+	for key := range configValues(&config) {
+		if key != "APIKey" && key != "MimeRule" && !options[key] {
+			t.Errorf("Setting without environment variable and program argument: %s", key)
+		}
+	}
+	if err := config.Set("APIKey", "secret"); err == nil {
+		t.Error("Table set from a string")
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Storage cap (MaxStorageBytes) and eviction policies */
+
+const (
+	EvictReject = "reject" // reject uploads that exceed the storage cap
+	EvictExpire = "expire" // evict the pastas that expire soonest first
+	EvictOldest = "oldest" // evict the oldest pastas first
+	EvictLRU    = "lru"    // evict the least recently read pastas first
+)
+
+/* StorageUsage keeps track of the stored bytes and the last read time of the pastas */
+type StorageUsage struct {
+	mutex    sync.Mutex
+	evict    sync.Mutex // serializes evictions
+	used     int64
+	lastRead map[string]int64 // unix timestamp of the last read per pasta id
+	pending  map[string]bool  // committed pastas, that are not accounted by reserveStorage yet
+}
+
+var storageUsage StorageUsage
+
+func validEvictionPolicy(policy string) bool {
+	return policy == EvictReject || policy == EvictExpire || policy == EvictOldest || policy == EvictLRU
+}
+
+/* Recompute the stored bytes from the bowl. Pending pastas are skipped, they are accounted by reserveStorage.
+ * While serving, it must be called under the eviction lock, so that no pasta is accounted in the meantime */
+func (usage *StorageUsage) Recompute(bowl *PastaBowl) error {
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return err
+	}
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	var used int64
+	existing := make(map[string]bool, len(pastas))
+	for _, pasta := range pastas {
+		if !usage.pending[pasta.Id] {
+			used += pasta.Size
+		}
+		existing[pasta.Id] = true
+	}
+	usage.used = used
+	for id := range usage.lastRead {
+		if !existing[id] {
+			delete(usage.lastRead, id)
+		}
+	}
+	return nil
+}
+
+// Used returns the stored bytes
+func (usage *StorageUsage) Used() int64 {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	return usage.used
+}
+
+// Pending marks a pasta, that is about to be committed and then accounted by reserveStorage
+func (usage *StorageUsage) Pending(id string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	if usage.pending == nil {
+		usage.pending = make(map[string]bool, 0)
+	}
+	usage.pending[id] = true
+}
+
+// Release removes the pending mark of a pasta, that has not been accounted (e.g. because it was rejected)
+func (usage *StorageUsage) Release(id string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	delete(usage.pending, id)
+}
+
+// Add accounts a new pasta
+func (usage *StorageUsage) Add(pasta Pasta) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	usage.used += pasta.Size
+	delete(usage.pending, pasta.Id)
+}
+
+// Remove accounts a removed pasta
+func (usage *StorageUsage) Remove(pasta Pasta) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	usage.used -= pasta.Size
+	if usage.used < 0 {
+		usage.used = 0
+	}
+	delete(usage.lastRead, pasta.Id)
+}
+
+// Read records a read of the given pasta
+func (usage *StorageUsage) Read(id string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	if usage.lastRead == nil {
+		usage.lastRead = make(map[string]int64, 0)
+	}
+	usage.lastRead[id] = time.Now().Unix()
+}
+
+// LastRead returns the time of the last read of the pasta since the start of pastad or its modification time
+func (usage *StorageUsage) LastRead(pasta Pasta) int64 {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+	if t, ok := usage.lastRead[pasta.Id]; ok {
+		return t
+	}
+	return pasta.ModTime
+}
+
+/* Order the pastas, that can be evicted, by the given policy. Pinned pastas and the excluded id are never evicted */
+func evictionCandidates(pastas []Pasta, policy string, exclude string) []Pasta {
+	ret := make([]Pasta, 0, len(pastas))
+	for _, pasta := range pastas {
+		if !pasta.Pinned && pasta.Id != exclude {
+			ret = append(ret, pasta)
+		}
+	}
+	lastRead := make(map[string]int64, len(ret))
+	if policy == EvictLRU {
+		for _, pasta := range ret {
+			lastRead[pasta.Id] = storageUsage.LastRead(pasta)
+		}
+	}
+	key := func(pasta Pasta) int64 {
+		switch policy {
+		case EvictExpire:
+			if pasta.ExpireDate == 0 {
+				// Pastas that never expire come last
+				return 1<<63 - 1
+			}
+			return pasta.ExpireDate
+		case EvictLRU:
+			return lastRead[pasta.Id]
+		}
+		return pasta.ModTime
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		ki, kj := key(ret[i]), key(ret[j])
+		if ki == kj {
+			return ret[i].ModTime < ret[j].ModTime
+		}
+		return ki < kj
+	})
+	return ret
+}
+
+/* Evict pastas by the configured policy until at least the given number of bytes are freed.
+ * Nothing is evicted and an error is returned, if not enough pastas can be evicted */
+func evict(needed int64, exclude string) ([]Pasta, error) {
+	evicted := make([]Pasta, 0)
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return evicted, err
+	}
+	candidates := evictionCandidates(pastas, cf().EvictionPolicy, exclude)
+	var available int64
+	for _, pasta := range candidates {
+		available += pasta.Size
+	}
+	if available < needed {
+		return evicted, fmt.Errorf("only %d of %d bytes can be evicted", available, needed)
+	}
+	var freed int64
+	for _, pasta := range candidates {
+		if freed >= needed {
+			break
+		}
+		if err := bowl.DeletePasta(pasta.Id); err != nil {
+			return evicted, err
+		}
+		freed += pasta.Size
+		evicted = append(evicted, pasta)
+		publicPastas.Remove(pasta.Id)
+		quotas.Remove(pasta)
+		storageUsage.Remove(pasta)
+		metrics.PastaRemoved(pasta.Size)
+		metrics.Add("pasta_evicted_total", 1, "policy", cf().EvictionPolicy)
+		slog.Info("pasta evicted", "id", pasta.Id, "size", pasta.Size, "policy", cf().EvictionPolicy)
+		entry := auditEntry("evict", pasta, "", "")
+		entry.Reason = cf().EvictionPolicy
+		audit.Write(entry)
+		changes.Record("delete", pasta.Id)
+	}
+	return evicted, nil
+}
+
+// storageCapEnabled returns true, if the storage cap is enforced. Replicas follow the primary and never evict
+func storageCapEnabled() bool {
+	return cf().MaxStorageBytes > 0 && cf().ReplicaOf == ""
+}
+
+/* Check if an upload of the given size (0 if unknown) can be stored at all.
+ * Returns the http status code and a message if not, 0 otherwise */
+func checkStorageCap(size int64) (int, string) {
+	if !storageCapEnabled() || size <= 0 {
+		return 0, ""
+	}
+	if size > int64(cf().MaxStorageBytes) || (cf().EvictionPolicy == EvictReject && storageUsage.Used()+size > int64(cf().MaxStorageBytes)) {
+		return http.StatusInsufficientStorage, "insufficient storage"
+	}
+	return 0, ""
+}
+
+/* Account a received pasta against the storage cap, evicting other pastas by the policy if necessary.
+ * Returns the http status code and a message if the pasta cannot be stored, 0 otherwise */
+func reserveStorage(pasta Pasta) (int, string) {
+	storageUsage.evict.Lock()
+	defer storageUsage.evict.Unlock()
+	if !storageCapEnabled() {
+		storageUsage.Add(pasta)
+		return 0, ""
+	}
+	excess := storageUsage.Used() + pasta.Size - int64(cf().MaxStorageBytes)
+	if excess > 0 {
+		if cf().EvictionPolicy == EvictReject {
+			return http.StatusInsufficientStorage, "insufficient storage"
+		}
+		if _, err := evict(excess, pasta.Id); err != nil {
+			slog.Warn("cannot make room for pasta", "id", pasta.Id, "size", pasta.Size, "error", err)
+			return http.StatusInsufficientStorage, "insufficient storage"
+		}
+	}
+	storageUsage.Add(pasta)
+	return 0, ""
+}
+
+/* Recompute the storage usage from the bowl and evict pastas, until the stored bytes are below the storage cap. Called by the cleanup.
+ * Both happen under the eviction lock, so that pastas accepted by reserveStorage in the meantime are not missed */
+func enforceStorageCap(bowl *PastaBowl) {
+	storageUsage.evict.Lock()
+	defer storageUsage.evict.Unlock()
+	if err := storageUsage.Recompute(bowl); err != nil {
+		slog.Error("error computing storage usage", "error", err)
+		return
+	}
+	if !storageCapEnabled() {
+		return
+	}
+	excess := storageUsage.Used() - int64(cf().MaxStorageBytes)
+	if excess <= 0 {
+		return
+	}
+	if cf().EvictionPolicy == EvictReject {
+		slog.Warn("storage cap exceeded", "used", storageUsage.Used(), "max", int64(cf().MaxStorageBytes))
+		return
+	}
+	if _, err := evict(excess, ""); err != nil {
+		slog.Error("cannot enforce storage cap", "used", storageUsage.Used(), "max", int64(cf().MaxStorageBytes), "error", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictionCandidates(t *testing.T) {
+	now := time.Now().Unix()
+	pastas := []Pasta{
+		{Id: "old", ModTime: now - 300, ExpireDate: 0},
+		{Id: "pinned", ModTime: now - 400, Pinned: true},
+		{Id: "soon", ModTime: now - 100, ExpireDate: now + 60},
+		{Id: "later", ModTime: now - 200, ExpireDate: now + 3600},
+		{Id: "new", ModTime: now - 10},
+	}
+	ids := func(pastas []Pasta) string {
+		ret := ""
+		for _, pasta := range pastas {
+			ret += pasta.Id + " "
+		}
+		return ret
+	}
+	if order := ids(evictionCandidates(pastas, EvictExpire, "new")); order != "soon later old " {
+		t.Fatalf("Wrong expire order: %s", order)
+	}
+	if order := ids(evictionCandidates(pastas, EvictOldest, "")); order != "old later soon new " {
+		t.Fatalf("Wrong oldest order: %s", order)
+	}
+	storageUsage.Read("old")
+	defer storageUsage.Remove(Pasta{Id: "old"})
+	if order := ids(evictionCandidates(pastas, EvictLRU, "")); order != "later soon new old " {
+		t.Fatalf("Wrong lru order: %s", order)
+	}
+}
+
+func TestReserveStorage(t *testing.T) {
+	// Cleanups run in reverse order, the usage is recomputed after the bowl has been restored
+	t.Cleanup(func() { storageUsage.Recompute(&bowl) })
+	useTestBowl(t, func(config *Config) {
+		config.MaxStorageBytes = 20
+		config.EvictionPolicy = EvictReject
+		config.ReplicaOf = ""
+	})
+	create := func(content string, pinned bool) Pasta {
+		pasta := Pasta{Pinned: pinned}
+		file, err := bowl.CreatePasta(&pasta)
+		if err != nil {
+			t.Fatalf("Error creating pasta: %s", err)
+		}
+		file.Write([]byte(content))
+		if err := file.Commit(int64(len(content))); err != nil {
+			t.Fatalf("Error committing pasta: %s", err)
+		}
+		pasta.Size = int64(len(content))
+		return pasta
+	}
+	pinned := create("0123456789", true)
+	old := create("01234", false)
+	if err := storageUsage.Recompute(&bowl); err != nil {
+		t.Fatalf("Error computing storage usage: %s", err)
+	}
+	if status, _ := checkStorageCap(10); status != http.StatusInsufficientStorage {
+		t.Fatal("Upload exceeding the storage cap accepted")
+	}
+	pasta := create("0123456789", false)
+	if status, _ := reserveStorage(pasta); status != http.StatusInsufficientStorage {
+		t.Fatal("Pasta exceeding the storage cap accepted")
+	}
+	// Evict the unpinned pasta to make room
+	config := *cf()
+	config.EvictionPolicy = EvictOldest
+	setConfig(&config)
+	if status, _ := checkStorageCap(10); status != 0 {
+		t.Fatal("Upload rejected despite eviction policy")
+	}
+	if status, message := reserveStorage(pasta); status != 0 {
+		t.Fatalf("Pasta rejected despite eviction policy: %s", message)
+	}
+	if bowl.Exists(old.Id) || !bowl.Exists(pinned.Id) || !bowl.Exists(pasta.Id) {
+		t.Fatal("Wrong pasta evicted")
+	}
+	if used := storageUsage.Used(); used != 20 {
+		t.Fatalf("Unexpected storage usage: %d", used)
+	}
+	// Pinned pastas are never evicted
+	another := create("012345678901234", false)
+	if status, _ := reserveStorage(another); status == 0 {
+		t.Fatal("Pinned pasta evicted")
+	}
+	// The cleanup recomputes the usage, including the rejected pasta, and enforces a lowered cap
+	config = *cf()
+	config.MaxStorageBytes = 10
+	setConfig(&config)
+	enforceStorageCap(&bowl)
+	if bowl.Exists(pasta.Id) || bowl.Exists(another.Id) || !bowl.Exists(pinned.Id) {
+		t.Fatal("Storage cap not enforced")
+	}
+	if used := storageUsage.Used(); used != 10 {
+		t.Fatalf("Unexpected storage usage after cleanup: %d", used)
+	}
+}
+
+/* A pasta committed while the cleanup recomputes the storage usage is accounted only once */
+func TestPendingStorage(t *testing.T) {
+	useTestBowl(t, nil)
+	pasta := Pasta{}
+	file, err := bowl.CreatePasta(&pasta)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("0123456789"))
+	pasta.Size = 10
+	storageUsage.Pending(pasta.Id)
+	if err := file.Commit(pasta.Size); err != nil {
+		t.Fatalf("Error committing pasta: %s", err)
+	}
+	enforceStorageCap(&bowl)
+	if used := storageUsage.Used(); used != 0 {
+		t.Fatalf("Pending pasta counted by the recompute: %d", used)
+	}
+	if status, message := reserveStorage(pasta); status != 0 {
+		t.Fatalf("Pasta rejected: %s", message)
+	}
+	enforceStorageCap(&bowl)
+	if used := storageUsage.Used(); used != 10 {
+		t.Fatalf("Unexpected storage usage: %d", used)
+	}
+	// Rejected pastas are released
+	storageUsage.Pending("rejected")
+	storageUsage.Release("rejected")
+	if len(storageUsage.pending) != 0 {
+		t.Fatalf("Pending pastas not released: %v", storageUsage.pending)
+	}
+}
+
+/* Metadata injected through the filename must not pin a pasta, which would exclude it from the eviction */
+func TestFilenameInjection(t *testing.T) {
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+	})
+	filename := "a\npinned:true\n---\nsize:1"
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "file.txt")
+	part.Write([]byte("content"))
+	form.WriteField("filename", filename)
+	form.Close()
+	multipartRequest := httptest.NewRequest("POST", "/", &body)
+	multipartRequest.Header.Set("Content-Type", form.FormDataContentType())
+	formRequest := httptest.NewRequest("POST", "/?input=form", strings.NewReader("content=content&filename="+url.QueryEscape(filename)))
+	formRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, r := range []*http.Request{multipartRequest, formRequest} {
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Filename with line breaks accepted: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if pastas, _ := bowl.ListPastas(); len(pastas) != 0 {
+		t.Fatalf("Pasta with invalid filename stored: %v", pastas)
+	}
+
+	// Control characters are also removed when writing the metadata
+	pasta := Pasta{ContentFilename: filename}
+	file, err := bowl.CreatePasta(&pasta)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("content"))
+	if err := file.Commit(7); err != nil {
+		t.Fatalf("Error committing pasta: %s", err)
+	}
+	stored, err := bowl.GetPasta(pasta.Id)
+	if err != nil {
+		t.Fatalf("Error reading pasta: %s", err)
+	}
+	if stored.Pinned || stored.RecordedSize != 7 || stored.ContentFilename != "a_pinned:true_---_size:1" {
+		t.Fatalf("Metadata injected through the filename: %+v", stored)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/klauspost/compress/zstd"
+)
+
+/* Export archive format (version 1)
+ *
+ * An uncompressed, gzip or zstd compressed tar archive. The first entry is the manifest "pasta-export.json".
+ * Every pasta is stored as two entries: its metadata "pastas/<id>.json" followed by its content "pastas/<id>" */
+
+const exportFormat = "pasta-export"
+const exportVersion = 1
+const exportManifest = "pasta-export.json"
+
+/* ExportManifest is the first entry of an export archive */
+type ExportManifest struct {
+	Format  string `json:"format"`  // always "pasta-export"
+	Version int    `json:"version"` // archive format version
+	Created string `json:"created"` // RFC3339 date of the export
+}
+
+/* ExportPasta is the metadata of a pasta in an export archive */
+type ExportPasta struct {
+	Id       string `json:"id"`
+	Token    string `json:"token"`
+	Expire   int64  `json:"expire,omitempty"` // unix timestamp, 0 = never
+	Mime     string `json:"mime,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+	Client   string `json:"client,omitempty"`
+	Size     int64  `json:"size"`
+	Public   bool   `json:"public,omitempty"`
+	Pinned   bool   `json:"pinned,omitempty"`
+}
+
+/* ImportOptions control how pastas are restored */
+type ImportOptions struct {
+	NewIds      bool // Generate new ids instead of keeping the exported ones
+	NewTokens   bool // Generate new modification tokens
+	SkipExpired bool // Don't import pastas that have expired since the export
+}
+
+/* ImportReport is the result of an import */
+type ImportReport struct {
+	Imported  int               `json:"imported"`
+	Expired   int               `json:"expired"`       // skipped expired pastas
+	Conflicts []string          `json:"conflicts"`     // skipped pastas, whose id already exists
+	Ids       map[string]string `json:"ids,omitempty"` // exported id to new id, if ids are regenerated
+}
+
+// Compression by file extension: zstd for .zst, gzip for .gz and .tgz, otherwise none
+func compressionByFilename(filename string) string {
+	switch path.Ext(filename) {
+	case ".zst", ".zstd":
+		return "zstd"
+	case ".gz", ".tgz":
+		return "gzip"
+	}
+	return "none"
+}
+
+func compressedWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "none", "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("invalid compression: %s", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+/* Get a reader for a possibly compressed archive. The compression is detected by the magic bytes */
+func decompressedReader(r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+	magic, _ := reader.Peek(4)
+	if bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	if bytes.HasPrefix(magic, []byte{0x1f, 0x8b}) {
+		return gzip.NewReader(reader)
+	}
+	return io.NopCloser(reader), nil
+}
+
+func writeTarFile(archive *tar.Writer, name string, size int64, modtime time.Time, content io.Reader) error {
+	header := &tar.Header{Name: name, Mode: 0640, Size: size, ModTime: modtime, Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(archive, content)
+	return err
+}
+
+/* Export all live pastas of the bowl as tar archive. Returns the number of exported pastas */
+func exportPastas(bowl *PastaBowl, w io.Writer) (int, error) {
+	now := time.Now()
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return 0, err
+	}
+	publicIds, err := bowl.GetPublicPastas()
+	if err != nil {
+		return 0, err
+	}
+	public := make(map[string]bool, len(publicIds))
+	for _, id := range publicIds {
+		public[id] = true
+	}
+	archive := tar.NewWriter(w)
+	manifest, _ := json.Marshal(ExportManifest{Format: exportFormat, Version: exportVersion, Created: now.UTC().Format(time.RFC3339)})
+	if err := writeTarFile(archive, exportManifest, int64(len(manifest)), now, bytes.NewReader(manifest)); err != nil {
+		return 0, err
+	}
+	exported := 0
+	for _, pasta := range pastas {
+		if pasta.Expired() {
+			continue
+		}
+		metadata, _ := json.Marshal(ExportPasta{Id: pasta.Id, Token: pasta.Token, Expire: pasta.ExpireDate, Mime: pasta.Mime, Filename: pasta.ContentFilename, Owner: pasta.Owner, Client: pasta.Client, Size: pasta.Size, Public: public[pasta.Id], Pinned: pasta.Pinned})
+		if err := writeTarFile(archive, fmt.Sprintf("pastas/%s.json", pasta.Id), int64(len(metadata)), now, bytes.NewReader(metadata)); err != nil {
+			return exported, err
+		}
+		reader, err := bowl.GetPastaReader(pasta.Id)
+		if err != nil {
+			return exported, err
+		}
+		// The content keeps the modification time of the pasta, which orders the public pastas on import
+		err = writeTarFile(archive, fmt.Sprintf("pastas/%s", pasta.Id), pasta.Size, time.Unix(pasta.ModTime, 0), reader)
+		reader.Close()
+		if err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	return exported, archive.Close()
+}
+
+/* Import the pastas of an export archive into the bowl */
+func importPastas(bowl *PastaBowl, r io.Reader, options ImportOptions) (ImportReport, error) {
+	report := ImportReport{Conflicts: make([]string, 0)}
+	if options.NewIds {
+		report.Ids = make(map[string]string, 0)
+	}
+	reader, err := decompressedReader(r)
+	if err != nil {
+		return report, err
+	}
+	defer reader.Close()
+	archive := tar.NewReader(reader)
+
+	// The manifest must come first
+	header, err := archive.Next()
+	if err != nil {
+		return report, fmt.Errorf("invalid export archive: %s", err)
+	}
+	var manifest ExportManifest
+	if header.Name != exportManifest {
+		return report, fmt.Errorf("invalid export archive: missing manifest")
+	}
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		return report, fmt.Errorf("invalid manifest: %s", err)
+	}
+	if manifest.Format != exportFormat || manifest.Version != exportVersion {
+		return report, fmt.Errorf("unsupported export format %s version %d", manifest.Format, manifest.Version)
+	}
+
+	newPublic := make([]Pasta, 0)
+	var metadata *ExportPasta // metadata of the following content entry
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return report, err
+		}
+		name := strings.TrimPrefix(header.Name, "pastas/")
+		if name == header.Name {
+			return report, fmt.Errorf("unexpected archive entry: %s", header.Name)
+		}
+		if strings.HasSuffix(name, ".json") {
+			metadata = &ExportPasta{}
+			if err := json.NewDecoder(archive).Decode(metadata); err != nil {
+				return report, fmt.Errorf("invalid metadata %s: %s", header.Name, err)
+			}
+			if metadata.Id == "" || metadata.Id != strings.TrimSuffix(name, ".json") || !containsOnlyAlphaNumeric(metadata.Id) {
+				return report, fmt.Errorf("invalid pasta id in %s", header.Name)
+			}
+			continue
+		}
+		if metadata == nil || metadata.Id != name {
+			return report, fmt.Errorf("missing metadata for %s", header.Name)
+		}
+		exported := *metadata
+		metadata = nil
+		pasta := Pasta{Id: exported.Id, Token: exported.Token, ExpireDate: exported.Expire, Mime: exported.Mime, ContentFilename: exported.Filename, Owner: exported.Owner, Client: exported.Client, Pinned: exported.Pinned}
+		if options.SkipExpired && pasta.Expired() {
+			report.Expired++
+			continue
+		}
+		if options.NewIds {
+			pasta.Id = removeNonAlphaNumeric(bowl.GenerateRandomBinId(cf().PastaCharacters))
+		} else if bowl.Exists(pasta.Id) {
+			report.Conflicts = append(report.Conflicts, pasta.Id)
+			continue
+		}
+		if options.NewTokens {
+			pasta.Token = ""
+		}
+		file, err := bowl.CreatePasta(&pasta)
+		if err != nil {
+			return report, err
+		}
+		size, err := io.Copy(file, archive)
+		if err != nil {
+			file.Abort()
+			return report, err
+		}
+		if size != exported.Size {
+			file.Abort()
+			return report, fmt.Errorf("size mismatch for pasta %s: %d bytes, expected %d", exported.Id, size, exported.Size)
+		}
+		if err := file.Commit(size); err != nil {
+			return report, err
+		}
+		if err := os.Chtimes(pasta.DiskFilename, header.ModTime, header.ModTime); err != nil {
+			return report, err
+		}
+		pasta.ModTime = header.ModTime.Unix()
+		if options.NewIds {
+			report.Ids[exported.Id] = pasta.Id
+		}
+		if exported.Public {
+			newPublic = append(newPublic, pasta)
+		}
+		report.Imported++
+	}
+	if metadata != nil {
+		return report, fmt.Errorf("missing content for pasta %s", metadata.Id)
+	}
+	if len(newPublic) > 0 {
+		public, err := bowl.GetPublicPastas()
+		if err != nil {
+			return report, err
+		}
+		if err := bowl.WritePublicPastaIDs(mergePublicPastas(bowl, public, newPublic)); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+/* Insert the imported public pastas into the public pastas, which are ordered newest first, by their modification time.
+ * The order of the existing public pastas is kept */
+func mergePublicPastas(bowl *PastaBowl, public []string, imported []Pasta) []string {
+	sort.SliceStable(imported, func(i, j int) bool { return imported[i].ModTime > imported[j].ModTime })
+	ret := make([]string, 0, len(public)+len(imported))
+	for _, id := range public {
+		existing, err := bowl.GetPasta(id)
+		for err == nil && len(imported) > 0 && imported[0].ModTime > existing.ModTime {
+			ret = append(ret, imported[0].Id)
+			imported = imported[1:]
+		}
+		ret = append(ret, id)
+	}
+	for _, pasta := range imported {
+		ret = append(ret, pasta.Id)
+	}
+	return ret
+}
+
+// Apply the config file and the data directory of an export or import command
+func loadExportConfig(configFile string, dir string) error {
+	if err := readSubcommandConfig(configFile, dir); err != nil {
+		return err
+	}
+	if stat, err := os.Stat(cf().PastaDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("invalid pasta directory: %s", cf().PastaDir)
+	}
+	return nil
+}
+
+/* pastad export: write all live pastas to an archive. Returns the program exit code */
+func exportMain(args []string) int {
+	parser := argparse.NewParser("pastad export", "export all pastas into an archive")
+	configFile := parser.String("c", "config", &argparse.Options{Default: "", Help: "Read pasta directory from this config file"})
+	dir := parser.String("d", "dir", &argparse.Options{Help: "Pasta data directory"})
+	out := parser.String("o", "out", &argparse.Options{Required: true, Help: "Archive filename, '-' for stdout"})
+	compression := parser.String("", "compression", &argparse.Options{Default: "", Help: "Compression (none, gzip, zstd). Default by the file extension"})
+	if err := parser.Parse(append([]string{"pastad"}, args[1:]...)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", parser.Usage(err))
+		return 1
+	}
+	if err := loadExportConfig(*configFile, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	if *compression == "" {
+		*compression = compressionByFilename(*out)
+	}
+	var file *os.File
+	if *out == "-" {
+		file = os.Stdout
+	} else {
+		var err error
+		if file, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+	}
+	writer, err := compressedWriter(file, *compression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	exported, err := exportPastas(&PastaBowl{Directory: cf().PastaDir}, writer)
+	if err == nil {
+		err = writer.Close()
+	}
+	if file != os.Stdout {
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %s\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d pastas\n", exported)
+	return 0
+}
+
+/* pastad import: restore pastas from an archive. Returns the program exit code */
+func importMain(args []string) int {
+	parser := argparse.NewParser("pastad import", "import pastas from an export archive")
+	configFile := parser.String("c", "config", &argparse.Options{Default: "", Help: "Read pasta directory from this config file"})
+	dir := parser.String("d", "dir", &argparse.Options{Help: "Pasta data directory"})
+	in := parser.String("i", "in", &argparse.Options{Required: true, Help: "Archive filename, '-' for stdin"})
+	newIds := parser.Flag("", "new-ids", &argparse.Options{Help: "Generate new pasta ids instead of keeping the exported ones"})
+	newTokens := parser.Flag("", "new-tokens", &argparse.Options{Help: "Generate new modification tokens"})
+	skipExpired := parser.Flag("", "skip-expired", &argparse.Options{Help: "Skip pastas that have expired since the export"})
+	if err := parser.Parse(append([]string{"pastad"}, args[1:]...)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", parser.Usage(err))
+		return 1
+	}
+	if err := loadExportConfig(*configFile, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	file := os.Stdin
+	if *in != "-" {
+		var err error
+		if file, err = os.Open(*in); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		defer file.Close()
+	}
+	options := ImportOptions{NewIds: *newIds, NewTokens: *newTokens, SkipExpired: *skipExpired}
+	report, err := importPastas(&PastaBowl{Directory: cf().PastaDir}, file, options)
+	buf, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(buf))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
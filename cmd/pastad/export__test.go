@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src := PastaBowl{Directory: t.TempDir()}
+	insert := func(pasta *Pasta, content string) {
+		file, err := src.CreatePasta(pasta)
+		if err != nil {
+			t.Fatalf("Error creating pasta: %s", err)
+		}
+		file.Write([]byte(content))
+		if err := file.Commit(int64(len(content))); err != nil {
+			t.Fatalf("Error committing pasta: %s", err)
+		}
+	}
+	public := Pasta{Mime: "text/plain", ContentFilename: "public.txt", Owner: "alice"}
+	insert(&public, "public pasta")
+	private := Pasta{ExpireDate: time.Now().Unix() + 3600}
+	insert(&private, "private pasta")
+	expired := Pasta{ExpireDate: time.Now().Unix() - 10}
+	insert(&expired, "expired pasta")
+	src.WritePublicPastaIDs([]string{public.Id})
+	created := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	os.Chtimes(public.DiskFilename, created, created)
+	oldCf := cf()
+	defer setConfig(oldCf)
+	config := *oldCf
+	config.PastaCharacters = 12
+	setConfig(&config)
+
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		var buf bytes.Buffer
+		writer, err := compressedWriter(&buf, compression)
+		if err != nil {
+			t.Fatalf("Error creating %s writer: %s", compression, err)
+		}
+		exported, err := exportPastas(&src, writer)
+		if err != nil {
+			t.Fatalf("Error exporting pastas (%s): %s", compression, err)
+		}
+		writer.Close()
+		if exported != 2 {
+			t.Fatalf("Expected 2 exported pastas, got %d", exported)
+		}
+
+		dst := PastaBowl{Directory: t.TempDir()}
+		archive := buf.Bytes()
+		report, err := importPastas(&dst, bytes.NewReader(archive), ImportOptions{})
+		if err != nil {
+			t.Fatalf("Error importing pastas (%s): %s", compression, err)
+		}
+		if report.Imported != 2 || len(report.Conflicts) != 0 {
+			t.Fatalf("Unexpected import report: %+v", report)
+		}
+		pasta, err := dst.GetPasta(public.Id)
+		if err != nil || pasta.Token != public.Token || pasta.ContentFilename != public.ContentFilename || pasta.Owner != public.Owner || pasta.RecordedSize != pasta.Size {
+			t.Fatalf("Imported pasta mismatch: %+v", pasta)
+		}
+		reader, err := dst.GetPastaReader(private.Id)
+		if err != nil {
+			t.Fatalf("Error reading imported pasta: %s", err)
+		}
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(content) != "private pasta" {
+			t.Fatalf("Imported content mismatch: %s", string(content))
+		}
+		if ids, _ := dst.GetPublicPastas(); len(ids) != 1 || ids[0] != public.Id {
+			t.Fatalf("Public pastas not imported: %v", ids)
+		}
+
+		// Existing ids are not overwritten, unless new ids are generated
+		report, err = importPastas(&dst, bytes.NewReader(archive), ImportOptions{})
+		if err != nil || report.Imported != 0 || len(report.Conflicts) != 2 {
+			t.Fatalf("Conflicting import: %+v, %v", report, err)
+		}
+		report, err = importPastas(&dst, bytes.NewReader(archive), ImportOptions{NewIds: true, NewTokens: true})
+		if err != nil || report.Imported != 2 || report.Ids[public.Id] == public.Id {
+			t.Fatalf("Import with new ids: %+v, %v", report, err)
+		}
+		if pasta, _ := dst.GetPasta(report.Ids[public.Id]); pasta.Token == public.Token {
+			t.Fatal("Token not regenerated")
+		}
+		// New ids have the configured length and public pastas are inserted by their modification time
+		if len(report.Ids[public.Id]) != 12 {
+			t.Errorf("Unexpected length of new id: %s", report.Ids[public.Id])
+		}
+		if pasta, _ := dst.GetPasta(public.Id); pasta.ModTime != created.Unix() {
+			t.Errorf("Modification time not restored: %d", pasta.ModTime)
+		}
+		newer, older := Pasta{}, Pasta{}
+		for _, pasta := range []*Pasta{&newer, &older} {
+			file, _ := dst.CreatePasta(pasta)
+			file.Commit(0)
+		}
+		os.Chtimes(older.DiskFilename, created.Add(-time.Hour), created.Add(-time.Hour))
+		dst.WritePublicPastaIDs([]string{newer.Id, older.Id})
+		report, err = importPastas(&dst, bytes.NewReader(archive), ImportOptions{NewIds: true})
+		if err != nil || report.Imported != 2 {
+			t.Fatalf("Import with new ids: %+v, %v", report, err)
+		}
+		if ids, _ := dst.GetPublicPastas(); len(ids) != 3 || ids[0] != newer.Id || ids[1] != report.Ids[public.Id] || ids[2] != older.Id {
+			t.Errorf("Unexpected order of public pastas: %v", ids)
+		}
+	}
+}
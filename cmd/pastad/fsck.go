@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// orphanAge is the minimum age of a temporary file to be considered orphaned, younger files might belong to a running upload
+const orphanAge = time.Hour
+
+/* FsckProblem is a single problem found by fsck */
+type FsckProblem struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"` // corrupt, metadata, size, missing-size, public, orphan
+	Detail  string `json:"detail"`
+	Action  string `json:"action,omitempty"` // Action taken in repair mode
+	Error   string `json:"error,omitempty"`  // Error while repairing
+}
+
+/* FsckReport is the result of a fsck run */
+type FsckReport struct {
+	Directory string        `json:"directory"`
+	Checked   int           `json:"checked"` // Number of checked pastas
+	Repair    bool          `json:"repair"`
+	Problems  []FsckProblem `json:"problems"`
+}
+
+// Unresolved returns the number of problems that have not been repaired
+func (report *FsckReport) Unresolved() int {
+	ret := 0
+	for _, problem := range report.Problems {
+		if problem.Action == "" || problem.Error != "" {
+			ret++
+		}
+	}
+	return ret
+}
+
+/* Check the metadata lines of a pasta file. Returns a description of the first unparsable line or an empty string */
+func checkMetadata(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		if line == "---" {
+			return "", nil
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Sprintf("line %d: expected 'name:value'", lineno), nil
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if name == "token" && value == "" {
+			return fmt.Sprintf("line %d: empty token", lineno), nil
+		}
+		if (name == "expire" || (name == "size" && value != "")) && !isNumber(value) {
+			return fmt.Sprintf("line %d: invalid %s '%s'", lineno, name, value), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.ParseInt(value, 10, 64)
+	return err == nil
+}
+
+/* Check the pasta directory and repair the found problems, if repair is set */
+func fsck(bowl *PastaBowl, repair bool) (FsckReport, error) {
+	report := FsckReport{Directory: bowl.Directory, Repair: repair, Problems: make([]FsckProblem, 0)}
+	files, err := ioutil.ReadDir(bowl.Directory)
+	if err != nil {
+		return report, err
+	}
+	// Apply the given repair function and record the result in the problem
+	fix := func(problem FsckProblem, action string, repairFunc func() error) {
+		if repair {
+			problem.Action = action
+			if err := repairFunc(); err != nil {
+				problem.Error = err.Error()
+			}
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	quarantine := func(id string) func() error {
+		return func() error {
+			_, err := bowl.Quarantine(id)
+			return err
+		}
+	}
+	existing := make(map[string]bool, 0)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || name == "_public" {
+			continue
+		}
+		if strings.HasPrefix(name, ".tmp-") {
+			if time.Since(file.ModTime()) > orphanAge {
+				problem := FsckProblem{File: name, Problem: "orphan", Detail: "temporary file of an interrupted upload or update"}
+				fix(problem, "deleted", func() error { return os.Remove(bowl.filename(name)) })
+			}
+			continue
+		}
+		if internalFile(name) {
+			continue
+		}
+		if !containsOnlyAlphaNumeric(name) {
+			report.Problems = append(report.Problems, FsckProblem{File: name, Problem: "unknown", Detail: "not a pasta file"})
+			continue
+		}
+		report.Checked++
+		pasta, err := bowl.GetPasta(name)
+		if errors.Is(err, errCorruptPasta) {
+			fix(FsckProblem{File: name, Problem: "corrupt", Detail: err.Error()}, "quarantined", quarantine(name))
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		if detail, err := checkMetadata(bowl.filename(name)); err != nil {
+			return report, err
+		} else if detail != "" {
+			fix(FsckProblem{File: name, Problem: "metadata", Detail: detail}, "quarantined", quarantine(name))
+			continue
+		}
+		if pasta.RecordedSize == 0 {
+			if pasta.Size == 0 {
+				// Upload interrupted in older versions, the content has never been written
+				fix(FsckProblem{File: name, Problem: "size", Detail: "empty pasta"}, "quarantined", quarantine(name))
+				continue
+			}
+			// Pastas from older versions, that did not record the size
+			detail := fmt.Sprintf("size not recorded, content has %d bytes", pasta.Size)
+			fix(FsckProblem{File: name, Problem: "missing-size", Detail: detail}, "recorded", func() error {
+				pasta.RecordedSize = pasta.Size
+				return bowl.UpdatePasta(pasta)
+			})
+		} else if pasta.RecordedSize != pasta.Size {
+			detail := fmt.Sprintf("recorded size %d, content has %d bytes", pasta.RecordedSize, pasta.Size)
+			fix(FsckProblem{File: name, Problem: "size", Detail: detail}, "quarantined", quarantine(name))
+			continue
+		}
+		existing[name] = true
+	}
+	// Check for stale entries in the public pastas
+	public, err := bowl.GetPublicPastas()
+	if err != nil {
+		return report, err
+	}
+	valid := make([]string, 0)
+	stale := make([]string, 0)
+	for _, id := range public {
+		if existing[id] {
+			valid = append(valid, id)
+		} else {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		for _, id := range stale {
+			report.Problems = append(report.Problems, FsckProblem{File: "_public", Problem: "public", Detail: fmt.Sprintf("stale entry %s", id)})
+		}
+		if repair {
+			err := bowl.WritePublicPastaIDs(valid)
+			for i := range report.Problems {
+				if report.Problems[i].Problem == "public" {
+					report.Problems[i].Action = "removed"
+					if err != nil {
+						report.Problems[i].Error = err.Error()
+					}
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+/* pastad fsck: check and repair the pasta directory. Returns the program exit code:
+ * 0 if no problems remain, 1 on errors and 2 if unresolved problems are found */
+func fsckMain(args []string) int {
+	parser := argparse.NewParser("pastad fsck", "check and repair the pasta directory")
+	configFile := parser.String("c", "config", &argparse.Options{Default: "", Help: "Read pasta directory from this config file"})
+	dir := parser.String("d", "dir", &argparse.Options{Help: "Pasta data directory"})
+	repair := parser.Flag("", "repair", &argparse.Options{Help: "Repair the found problems: quarantine corrupt pastas, record missing sizes, remove stale public entries and orphaned temporary files"})
+	if err := parser.Parse(append([]string{"pastad"}, args[1:]...)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", parser.Usage(err))
+		return 1
+	}
+	if err := readSubcommandConfig(*configFile, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	check := PastaBowl{Directory: cf().PastaDir, QuarantineDir: cf().QuarantineDir}
+	report, err := fsck(&check, *repair)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %s\n", err)
+		return 1
+	}
+	buf, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(buf))
+	if report.Unresolved() > 0 {
+		return 2
+	}
+	return 0
+}
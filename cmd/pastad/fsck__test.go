@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestFsck(t *testing.T) {
+	bowl := PastaBowl{Directory: t.TempDir()}
+	var good Pasta
+	file, err := bowl.CreatePasta(&good)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("hello"))
+	if err := file.Commit(5); err != nil {
+		t.Fatalf("Error committing pasta: %s", err)
+	}
+	ioutil.WriteFile(bowl.filename("corrupt"), []byte("token:abc\n"), 0640)
+	bowl.WritePublicPastaIDs([]string{good.Id, "missing"})
+
+	report, err := fsck(&bowl, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %s", err)
+	}
+	if report.Checked != 2 || len(report.Problems) != 2 || report.Unresolved() != 2 {
+		t.Fatalf("Unexpected fsck report: %+v", report)
+	}
+	report, err = fsck(&bowl, true)
+	if err != nil {
+		t.Fatalf("fsck repair failed: %s", err)
+	}
+	if report.Unresolved() != 0 {
+		t.Fatalf("Unresolved problems after repair: %+v", report)
+	}
+	report, err = fsck(&bowl, false)
+	if err != nil || len(report.Problems) != 0 || report.Checked != 1 {
+		t.Fatalf("Problems remaining after repair: %+v", report)
+	}
+	public, _ := bowl.GetPublicPastas()
+	if len(public) != 1 || public[0] != good.Id {
+		t.Fatalf("Public pastas not repaired: %v", public)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/* Security headers and the separate origin for user content (UserContentURL) */
+
+// Content-Security-Policy for pastas: no scripts, no plugins, no requests to other resources
+const pastaContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+/* Set the security headers for serving untrusted content */
+func setPastaSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", pastaContentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+}
+
+// Characters that can be used unencoded in a RFC 5987 value (attr-char)
+func isAttrChar(c byte) bool {
+	if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+/* Build the Content-Disposition header value for the given disposition (inline or attachment) and filename.
+ * The filename is given as quoted ASCII fallback and as RFC 5987 encoded UTF-8 value */
+func contentDisposition(disposition string, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	var fallback, encoded strings.Builder
+	for _, c := range filename {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' || c == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+	for _, c := range []byte(filename) {
+		if isAttrChar(c) {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	if fallback.String() == encoded.String() {
+		return fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), encoded.String())
+}
+
+// checkUserContentURL checks if the UserContentURL is an absolute URL on a host different from the base URL
+func checkUserContentURL(userContentURL string, baseURL string) error {
+	if userContentURL == "" {
+		return nil
+	}
+	u, err := url.Parse(userContentURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("absolute http or https url required")
+	}
+	if u.Path != "" {
+		return fmt.Errorf("url must not contain a path")
+	}
+	if base, err := url.Parse(baseURL); err == nil && strings.EqualFold(base.Host, u.Host) {
+		return fmt.Errorf("user content must be served from another host than the base url")
+	}
+	return nil
+}
+
+// userContentHost returns the host of the UserContentURL or an empty string, if no separate origin is configured
+func userContentHost() string {
+	if cf().UserContentUrl == "" {
+		return ""
+	}
+	u, err := url.Parse(cf().UserContentUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// isUserContentRequest returns true, if the request was made to the UserContentURL
+func isUserContentRequest(r *http.Request) bool {
+	host := userContentHost()
+	return host != "" && strings.ToLower(requestHost(r)) == host
+}
+
+/* Redirect requests for the raw content of a pasta to the UserContentURL, if configured.
+ * Returns true if the request has been redirected */
+func redirectUserContent(w http.ResponseWriter, r *http.Request, id string) bool {
+	if cf().UserContentUrl == "" || isUserContentRequest(r) {
+		return false
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s/%s", cf().UserContentUrl, id), http.StatusFound)
+	return true
+}
+
+/* On the UserContentURL only pastas are served, all other requests are rejected.
+ * This prevents the main site (uploads, admin API, ...) from being reachable on the origin of the user content */
+func userContentFilter(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if isUserContentRequest(r) {
+			path := r.URL.Path
+			_, pattern := mux.Handler(r)
+			isPasta := pattern == "/" && len(path) > 1 && strings.LastIndex(path, "/") == 0
+			if !(isPasta || path == "/robots.txt") || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, "not found")
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	checks := []struct {
+		disposition string
+		filename    string
+		expected    string
+	}{
+		{"inline", "", "inline"},
+		{"inline", "notes.txt", `inline; filename="notes.txt"`},
+		{"attachment", "my notes.txt", `attachment; filename="my notes.txt"; filename*=UTF-8''my%20notes.txt`},
+		{"inline", "bücher.txt", `inline; filename="b_cher.txt"; filename*=UTF-8''b%C3%BCcher.txt`},
+		{"inline", "a\"b\\c\r\n.txt", `inline; filename="a_b_c__.txt"; filename*=UTF-8''a%22b%5Cc%0D%0A.txt`},
+	}
+	for _, check := range checks {
+		if value := contentDisposition(check.disposition, check.filename); value != check.expected {
+			t.Errorf("Unexpected Content-Disposition for %q: %s", check.filename, value)
+		}
+	}
+}
+
+func TestUserContent(t *testing.T) {
+	if err := checkUserContentURL("https://usercontent.example.org", "https://pasta.example.org"); err != nil {
+		t.Errorf("Valid user content url rejected: %s", err)
+	}
+	for _, invalid := range []string{"usercontent.example.org", "https://usercontent.example.org/raw", "https://pasta.example.org"} {
+		if err := checkUserContentURL(invalid, "https://pasta.example.org"); err == nil {
+			t.Errorf("Invalid user content url accepted: %s", invalid)
+		}
+	}
+
+	useTestBowl(t, func(config *Config) {
+		config.UserContentUrl = "http://usercontent.example.org"
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		id, _ := ExtractPastaId(r.URL.Path)
+		if !redirectUserContent(w, r, id) {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	mux.HandleFunc("/public", func(w http.ResponseWriter, r *http.Request) {})
+	server := userContentFilter(mux)
+	request := func(method string, host string, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w
+	}
+	// Pastas on the main origin are redirected to the user content origin
+	w := request(http.MethodGet, "pasta.example.org", "/abcd")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://usercontent.example.org/abcd" {
+		t.Errorf("Pasta not redirected: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := request(http.MethodGet, "usercontent.example.org", "/abcd"); w.Code != http.StatusOK {
+		t.Errorf("Pasta not served on user content origin: %d", w.Code)
+	}
+	// Only pastas are served on the user content origin
+	for _, path := range []string{"/", "/admin/pastas", "/public"} {
+		if w := request(http.MethodGet, "usercontent.example.org", path); w.Code != http.StatusNotFound {
+			t.Errorf("%s served on user content origin: %d", path, w.Code)
+		}
+	}
+	if w := request(http.MethodPost, "usercontent.example.org", "/abcd"); w.Code != http.StatusNotFound {
+		t.Errorf("Upload accepted on user content origin: %d", w.Code)
+	}
+}
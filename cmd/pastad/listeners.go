@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Listeners for plain HTTP, HTTPS and unix domain sockets */
+
+/* CertReloader provides the TLS certificate and reloads it, when the certificate or key file changes */
+type CertReloader struct {
+	mutex     sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time // latest modification time of the certificate and key file
+	lastCheck time.Time
+	interval  time.Duration // minimum time between checks for changes
+}
+
+/* Listener is a listening socket with its server */
+type Listener struct {
+	Name     string // http, https or unix
+	Address  string
+	listener net.Listener
+	server   *http.Server
+}
+
+type unixSocketKey struct{}
+
+// NewCertReloader loads the given certificate and key
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile, interval: time.Second}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// latest modification time of the certificate and key file
+func (reloader *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, filename := range []string{reloader.certFile, reloader.keyFile} {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return latest, err
+		}
+		if stat.ModTime().After(latest) {
+			latest = stat.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload the certificate and key. On error the current certificate stays active
+func (reloader *CertReloader) Reload() error {
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	reloader.cert = &cert
+	reloader.modTime = modTime
+	return nil
+}
+
+// Check if the certificate or key file has changed and reload them
+func (reloader *CertReloader) checkReload() {
+	reloader.mutex.Lock()
+	if time.Since(reloader.lastCheck) < reloader.interval {
+		reloader.mutex.Unlock()
+		return
+	}
+	reloader.lastCheck = time.Now()
+	current := reloader.modTime
+	reloader.mutex.Unlock()
+
+	modTime, err := reloader.filesModTime()
+	if err != nil || modTime.Equal(current) {
+		return
+	}
+	if err := reloader.Reload(); err != nil {
+		// The files might be in the middle of being replaced, try again on the next check
+		slog.Warn("cannot reload tls certificate", "cert", reloader.certFile, "error", err)
+		return
+	}
+	slog.Info("reloaded tls certificate", "cert", reloader.certFile)
+}
+
+// GetCertificate is the callback for tls.Config
+func (reloader *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.checkReload()
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.cert, nil
+}
+
+// parseSocketMode parses the octal permissions of the unix socket
+func parseSocketMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid socket mode: %s", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+/* Listen on the given unix domain socket. A stale socket of a previous instance is removed */
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if stat, err := os.Stat(path); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// isUnixSocketRequest returns true, if the request was received on the unix domain socket
+func isUnixSocketRequest(r *http.Request) bool {
+	value, ok := r.Context().Value(unixSocketKey{}).(bool)
+	return ok && value
+}
+
+// checkListeners checks the listener configuration
+func checkListeners(cf *Config) error {
+	if cf.BindAddr == "" && cf.TLSBindAddr == "" && cf.UnixSocket == "" {
+		return errors.New("no listener configured (BindAddress, TLSBindAddress or UnixSocket)")
+	}
+	if cf.TLSBindAddr != "" && (cf.TLSCert == "" || cf.TLSKey == "") {
+		return errors.New("TLSBindAddress requires TLSCert and TLSKey")
+	}
+	if cf.UnixSocket != "" {
+		if _, err := parseSocketMode(cf.UnixSocketMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tlsConfig loads the configured certificate for a HTTPS listener
+func tlsConfig(cf *Config) (*tls.Config, error) {
+	if cf.TLSCert == "" || cf.TLSKey == "" {
+		return nil, errors.New("TLSCert and TLSKey required")
+	}
+	reloader, err := NewCertReloader(cf.TLSCert, cf.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load tls certificate: %s", err)
+	}
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}, nil
+}
+
+// newListener creates the server for a listening socket. If config is not nil, HTTPS is served
+func newListener(name string, listener net.Listener, handler http.Handler, config *tls.Config) *Listener {
+	server := &http.Server{Handler: handler, TLSConfig: config}
+	if listener.Addr().Network() == "unix" {
+		// Connections on the unix socket come from a local reverse proxy
+		server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, unixSocketKey{}, true)
+		}
+	}
+	return &Listener{Name: name, Address: listener.Addr().String(), listener: listener, server: server}
+}
+
+/* Open all configured listeners. If pastad is socket activated, the sockets passed by systemd are used instead.
+ * On error, the already opened listeners are closed */
+func openListeners(cf *Config, handler http.Handler) ([]*Listener, error) {
+	listeners := make([]*Listener, 0)
+	fail := func(err error) ([]*Listener, error) {
+		for _, listener := range listeners {
+			listener.listener.Close()
+		}
+		return nil, err
+	}
+	activated, err := activationListeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(activated) > 0 {
+		// Sockets named "https" (FileDescriptorName) serve HTTPS, all others plain HTTP
+		for i, socket := range activated {
+			var config *tls.Config
+			if socket.Name == "https" {
+				if config, err = tlsConfig(cf); err != nil {
+					for _, remaining := range activated[i:] {
+						remaining.listener.Close()
+					}
+					return fail(err)
+				}
+			}
+			listeners = append(listeners, newListener(socket.Name, socket.listener, handler, config))
+		}
+		return listeners, nil
+	}
+
+	if cf.BindAddr != "" {
+		listener, err := net.Listen("tcp", cf.BindAddr)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, newListener("http", listener, handler, nil))
+	}
+	if cf.TLSBindAddr != "" {
+		config, err := tlsConfig(cf)
+		if err != nil {
+			return fail(err)
+		}
+		listener, err := net.Listen("tcp", cf.TLSBindAddr)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, newListener("https", listener, handler, config))
+	}
+	if cf.UnixSocket != "" {
+		mode, err := parseSocketMode(cf.UnixSocketMode)
+		if err != nil {
+			return fail(err)
+		}
+		listener, err := listenUnix(cf.UnixSocket, mode)
+		if err != nil {
+			return fail(err)
+		}
+		listeners = append(listeners, newListener("unix", listener, handler, nil))
+	}
+	return listeners, nil
+}
+
+// Serve requests on the listener until the server is closed
+func (listener *Listener) Serve() error {
+	slog.Info("serving", "listener", listener.Name, "address", listener.Address)
+	var err error
+	if listener.server.TLSConfig != nil {
+		// The certificate is provided by the TLSConfig
+		err = listener.server.ServeTLS(listener.listener, "", "")
+	} else {
+		err = listener.server.Serve(listener.listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
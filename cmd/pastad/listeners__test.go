@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate for localhost with the given common name
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %s", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing certificate: %s", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Error writing key: %s", err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	writeTestCertificate(t, certFile, keyFile, "first")
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error loading certificate: %s", err)
+	}
+	reloader.interval = 0
+	commonName := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("Error getting certificate: %s", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Error parsing certificate: %s", err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Fatalf("Unexpected certificate: %s", name)
+	}
+	// A changed certificate is picked up on the next handshake
+	writeTestCertificate(t, certFile, keyFile, "second")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if name := commonName(); name != "second" {
+		t.Fatalf("Certificate not reloaded: %s", name)
+	}
+	// An invalid certificate keeps the current one
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if name := commonName(); name != "second" {
+		t.Fatalf("Invalid certificate replaced the current one: %s", name)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	dir := t.TempDir()
+	var config Config
+	config.SetDefaults()
+	if err := checkListeners(&Config{}); err == nil {
+		t.Error("Configuration without listener accepted")
+	}
+	config.TLSBindAddr = "127.0.0.1:0"
+	if err := checkListeners(&config); err == nil {
+		t.Error("TLS listener without certificate accepted")
+	}
+	config.BindAddr = ""
+	config.TLSCert, config.TLSKey = dir+"/cert.pem", dir+"/key.pem"
+	writeTestCertificate(t, config.TLSCert, config.TLSKey, "pasta")
+	config.UnixSocket = dir + "/pasta.sock"
+	config.UnixSocketMode = "0600"
+	if err := checkListeners(&config); err != nil {
+		t.Fatalf("Valid listener configuration rejected: %s", err)
+	}
+	// A stale socket of a previous instance is removed
+	stale, err := net.Listen("unix", config.UnixSocket)
+	if err != nil {
+		t.Fatalf("Error creating socket: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isUnixSocketRequest(r) {
+			io.WriteString(w, "unix")
+		} else if r.TLS != nil {
+			io.WriteString(w, "https")
+		}
+	})
+	listeners, err := openListeners(&config, handler)
+	if err != nil {
+		t.Fatalf("Error opening listeners: %s", err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Unexpected number of listeners: %d", len(listeners))
+	}
+	for _, listener := range listeners {
+		go listener.Serve()
+		defer listener.server.Close()
+	}
+	if stat, err := os.Stat(config.UnixSocket); err != nil || stat.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket permissions: %v %v", stat, err)
+	}
+	get := func(client *http.Client, url string) string {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %s", url, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	unixClient := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("unix", config.UnixSocket)
+	}}}
+	if body := get(unixClient, "http://localhost/"); body != "unix" {
+		t.Errorf("Unexpected response on unix socket: %s", body)
+	}
+	tlsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if body := get(tlsClient, "https://"+listeners[0].listener.Addr().String()+"/"); body != "https" {
+		t.Errorf("Unexpected response on tls listener: %s", body)
+	}
+	// A socket in use is not removed
+	if _, err := listenUnix(config.UnixSocket, 0600); err == nil {
+		t.Error("Socket in use replaced")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* AuditEntry is a single line in the audit log */
+type AuditEntry struct {
+	Time   string `json:"time"`
+	Event  string `json:"event"`            // create, delete, expire, evict, update or unpublish
+	Id     string `json:"id"`               // pasta id
+	Client string `json:"client,omitempty"` // client ip
+	Owner  string `json:"owner,omitempty"`  // API key label of the pasta
+	Auth   string `json:"auth,omitempty"`   // how a deletion or update was authorized (token, admin, cli)
+	Size   int64  `json:"size,omitempty"`
+	Expire int64  `json:"expire,omitempty"` // expiration date (unix timestamp)
+	Reason string `json:"reason,omitempty"` // eviction policy of evicted pastas
+}
+
+/* AuditLog is an append-only JSON lines log of creations, deletions and expiries */
+type AuditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+/* AccessLog writes requests in the common or combined log format */
+type AccessLog struct {
+	mutex    sync.Mutex
+	writer   io.Writer
+	combined bool
+}
+
+var audit AuditLog
+var accessLog AccessLog
+var logLevel slog.LevelVar // can be changed by a config reload
+
+/* Parse a log level name (debug, info, warn, error) */
+func parseLogLevel(level string) (slog.Level, error) {
+	var ret slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := ret.UnmarshalText([]byte(level))
+	return ret, err
+}
+
+/* Open a log file for appending. "-" is stdout */
+func openLogFile(filename string) (*os.File, error) {
+	if filename == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+}
+
+/* Setup the default logger, the access log and the audit log from the config */
+func setupLogging(cf *Config) error {
+	level, err := parseLogLevel(cf.LogLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	options := &slog.HandlerOptions{Level: &logLevel}
+	switch strings.ToLower(cf.LogFormat) {
+	case "", "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("invalid log format: %s", cf.LogFormat)
+	}
+	if cf.AccessLog != "" {
+		combined := true
+		switch strings.ToLower(cf.AccessLogFormat) {
+		case "", "combined":
+		case "common":
+			combined = false
+		default:
+			return fmt.Errorf("invalid access log format: %s", cf.AccessLogFormat)
+		}
+		file, err := openLogFile(cf.AccessLog)
+		if err != nil {
+			return err
+		}
+		accessLog.Set(file, combined)
+	}
+	if cf.AuditLog != "" {
+		if err := audit.Open(cf.AuditLog); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fatal logs an error and terminates the program
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Set the output of the access log. A nil writer disables the access log
+func (access *AccessLog) Set(writer io.Writer, combined bool) {
+	access.mutex.Lock()
+	defer access.mutex.Unlock()
+	access.writer = writer
+	access.combined = combined
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+/* Get the request URI without modification tokens */
+func redactedURI(r *http.Request) string {
+	query := r.URL.Query()
+	if !query.Has("token") {
+		return r.URL.RequestURI()
+	}
+	query.Set("token", "REDACTED")
+	u := *r.URL
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// Log writes a single request to the access log, if enabled
+func (access *AccessLog) Log(r *http.Request, status int, bytes int64, now time.Time) {
+	access.mutex.Lock()
+	defer access.mutex.Unlock()
+	if access.writer == nil {
+		return
+	}
+	user := "-"
+	if key, ok, _ := requestKey(r); ok {
+		user = key.Label
+	}
+	request := fmt.Sprintf("%s %s %s", r.Method, redactedURI(r), r.Proto)
+	line := fmt.Sprintf("%s - %s [%s] %q %d %d", clientIP(r), user, now.Format("02/Jan/2006:15:04:05 -0700"), request, status, bytes)
+	if access.combined {
+		line += fmt.Sprintf(" %q %q", dashIfEmpty(r.Referer()), dashIfEmpty(r.UserAgent()))
+	}
+	fmt.Fprintln(access.writer, line)
+}
+
+// Open the audit log file. Entries are only appended
+func (auditLog *AuditLog) Open(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	auditLog.file = file
+	return nil
+}
+
+// Write an entry to the audit log, if enabled. Errors are logged, but don't stop the operation
+func (auditLog *AuditLog) Write(entry AuditEntry) {
+	auditLog.mutex.Lock()
+	defer auditLog.mutex.Unlock()
+	if auditLog.file == nil {
+		return
+	}
+	if entry.Time == "" {
+		entry.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("cannot encode audit log entry", "error", err)
+		return
+	}
+	if _, err := auditLog.file.Write(append(buf, '\n')); err != nil {
+		slog.Error("cannot write audit log", "error", err)
+	}
+}
+
+// auditEntry creates an audit log entry of the given event for a pasta
+func auditEntry(event string, pasta Pasta, client string, auth string) AuditEntry {
+	return AuditEntry{Event: event, Id: pasta.Id, Client: client, Owner: pasta.Owner, Auth: auth, Size: pasta.Size, Expire: pasta.ExpireDate}
+}
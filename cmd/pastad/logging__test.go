@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	var access AccessLog
+	access.Set(&buf, true)
+	r := httptest.NewRequest("DELETE", "/abc?token=secret", nil)
+	r.RemoteAddr = "192.0.2.1:4711"
+	r.Header.Set("User-Agent", "pasta")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	access.Log(r, 200, 42, now)
+	expected := "192.0.2.1 - - [02/Jan/2020:03:04:05 +0000] \"DELETE /abc?token=REDACTED HTTP/1.1\" 200 42 \"-\" \"pasta\"\n"
+	if buf.String() != expected {
+		t.Fatalf("Unexpected access log line: %s", buf.String())
+	}
+	// Common log format omits referer and user agent
+	buf.Reset()
+	access.Set(&buf, false)
+	access.Log(r, 404, 0, now)
+	if strings.Contains(buf.String(), "pasta") || !strings.HasSuffix(buf.String(), "\" 404 0\n") {
+		t.Fatalf("Unexpected common log line: %s", buf.String())
+	}
+}
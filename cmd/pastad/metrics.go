@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Metrics in the Prometheus text exposition format. Only counters, gauges and histograms, as far as pastad needs them */
+
+// durationBuckets are the histogram buckets for latencies in seconds
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+/* Counter or gauge with an optional set of labels */
+type metricValues struct {
+	values map[string]float64 // value per label set (formatted as `name="value",...`)
+}
+
+type histogram struct {
+	counts []uint64 // per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+/* Histogram with an optional set of labels */
+type metricHistogram struct {
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+/* Metrics holds all metrics of pastad */
+type Metrics struct {
+	mutex      sync.Mutex
+	counters   map[string]*metricValues
+	gauges     map[string]*metricValues
+	histograms map[string]*metricHistogram
+	help       map[string]string
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	m := &Metrics{counters: make(map[string]*metricValues), gauges: make(map[string]*metricValues), histograms: make(map[string]*metricHistogram), help: make(map[string]string)}
+	m.help["pasta_uploads_total"] = "Number of received pastas"
+	m.help["pasta_upload_bytes_total"] = "Bytes of received pastas"
+	m.help["pasta_downloads_total"] = "Number of sent pastas"
+	m.help["pasta_download_bytes_total"] = "Bytes of sent pastas"
+	m.help["pasta_http_requests_total"] = "Number of http requests per route, method and status code"
+	m.help["pasta_http_request_duration_seconds"] = "Latency of http requests per route"
+	m.help["pasta_pastas"] = "Number of stored pastas"
+	m.help["pasta_stored_bytes"] = "Total size of the stored pastas"
+	m.help["pasta_cleanup_removed_pastas"] = "Number of expired pastas removed in the last cleanup cycle"
+	m.help["pasta_cleanup_removed_pastas_total"] = "Number of expired pastas removed by the cleanup"
+	m.help["pasta_cleanup_duration_seconds"] = "Duration of removing expired pastas"
+	m.help["pasta_ratelimit_rejections_total"] = "Number of requests rejected by the rate limiter per budget"
+	m.help["pasta_quarantined_total"] = "Number of corrupt pastas moved into quarantine"
+	m.help["pasta_cleanup_errors_total"] = "Number of cleanup cycles with errors"
+	m.help["pasta_evicted_total"] = "Number of pastas evicted to stay below the storage cap per policy"
+	m.help["pasta_replication_seq"] = "Last change of the primary applied by the replica"
+	m.help["pasta_replication_changes_total"] = "Number of changes applied by the replica per event"
+	m.help["pasta_replication_errors_total"] = "Number of replication errors of the replica"
+	// Always report the basic metrics, even if nothing happened yet
+	for _, name := range []string{"pasta_uploads_total", "pasta_upload_bytes_total", "pasta_downloads_total", "pasta_download_bytes_total", "pasta_cleanup_removed_pastas_total"} {
+		m.Add(name, 0)
+	}
+	for _, name := range []string{"pasta_pastas", "pasta_stored_bytes", "pasta_cleanup_removed_pastas"} {
+		m.Set(name, 0)
+	}
+	return m
+}
+
+/* Format label pairs ("name", "value", ...) */
+func labels(pairs ...string) string {
+	ret := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(pairs[i+1])
+		ret = append(ret, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+	return strings.Join(ret, ",")
+}
+
+func getValues(m map[string]*metricValues, name string) *metricValues {
+	values, ok := m[name]
+	if !ok {
+		values = &metricValues{values: make(map[string]float64)}
+		m[name] = values
+	}
+	return values
+}
+
+// Add increases a counter
+func (m *Metrics) Add(name string, value float64, labelPairs ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	getValues(m.counters, name).values[labels(labelPairs...)] += value
+}
+
+// Set sets a gauge
+func (m *Metrics) Set(name string, value float64, labelPairs ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	getValues(m.gauges, name).values[labels(labelPairs...)] = value
+}
+
+// AddGauge changes a gauge by the given value
+func (m *Metrics) AddGauge(name string, value float64, labelPairs ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	getValues(m.gauges, name).values[labels(labelPairs...)] += value
+}
+
+// Observe adds a value to a histogram with the default duration buckets
+func (m *Metrics) Observe(name string, value float64, labelPairs ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	hist, ok := m.histograms[name]
+	if !ok {
+		hist = &metricHistogram{buckets: durationBuckets, histograms: make(map[string]*histogram)}
+		m.histograms[name] = hist
+	}
+	key := labels(labelPairs...)
+	h, ok := hist.histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hist.buckets))}
+		hist.histograms[key] = h
+	}
+	for i, bound := range hist.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func metricName(name string, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return fmt.Sprintf("%s{%s}", name, labels)
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// Write writes all metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	writeValues := func(metricType string, values map[string]*metricValues) {
+		for _, name := range sortedKeys(values) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help[name], name, metricType)
+			for _, key := range sortedKeys(values[name].values) {
+				fmt.Fprintf(w, "%s %s\n", metricName(name, key), formatValue(values[name].values[key]))
+			}
+		}
+	}
+	writeValues("counter", m.counters)
+	writeValues("gauge", m.gauges)
+	for _, name := range sortedKeys(m.histograms) {
+		hist := m.histograms[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, m.help[name], name)
+		for _, key := range sortedKeys(hist.histograms) {
+			h := hist.histograms[key]
+			var cumulative uint64
+			for i, bound := range hist.buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s %d\n", metricName(name+"_bucket", joinLabels(key, labels("le", formatValue(bound)))), cumulative)
+			}
+			fmt.Fprintf(w, "%s %d\n", metricName(name+"_bucket", joinLabels(key, labels("le", "+Inf"))), h.count)
+			fmt.Fprintf(w, "%s %s\n", metricName(name+"_sum", key), formatValue(h.sum))
+			fmt.Fprintf(w, "%s %d\n", metricName(name+"_count", key), h.count)
+		}
+	}
+}
+
+// Update the pasta count and stored bytes from the bowl
+func (m *Metrics) UpdateStorage(bowl *PastaBowl) error {
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, pasta := range pastas {
+		size += pasta.Size
+	}
+	m.Set("pasta_pastas", float64(len(pastas)))
+	m.Set("pasta_stored_bytes", float64(size))
+	return nil
+}
+
+// PastaAdded accounts a new pasta of the given size
+func (m *Metrics) PastaAdded(size int64) {
+	m.Add("pasta_uploads_total", 1)
+	m.Add("pasta_upload_bytes_total", float64(size))
+	m.AddGauge("pasta_pastas", 1)
+	m.AddGauge("pasta_stored_bytes", float64(size))
+}
+
+// PastaRemoved accounts a deleted pasta of the given size
+func (m *Metrics) PastaRemoved(size int64) {
+	m.AddGauge("pasta_pastas", -1)
+	m.AddGauge("pasta_stored_bytes", -float64(size))
+}
+
+/* statusRecorder records the status code of a response */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64 // bytes written
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(buf []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(buf)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+/* Wrap the given handler to record the request count per status code and the latency for the given route and to write the access log */
+func instrument(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handler(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// Limit the label values to known methods, the method is chosen by the client
+		method := r.Method
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			method = "other"
+		}
+		metrics.Add("pasta_http_requests_total", 1, "route", route, "method", method, "code", strconv.Itoa(rec.status))
+		metrics.Observe("pasta_http_request_duration_seconds", time.Since(start).Seconds(), "route", route)
+		accessLog.Log(r, rec.status, rec.bytes, start)
+	}
+}
+
+func handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w)
+}
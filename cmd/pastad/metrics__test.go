@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.PastaAdded(100)
+	m.PastaAdded(50)
+	m.PastaRemoved(100)
+	m.Add("pasta_http_requests_total", 1, "route", "/", "method", "GET", "code", "200")
+	m.Observe("pasta_http_request_duration_seconds", 0.003, "route", "/")
+	m.Observe("pasta_http_request_duration_seconds", 42, "route", "/")
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	output := buf.String()
+	expected := []string{
+		"pasta_uploads_total 2\n",
+		"pasta_upload_bytes_total 150\n",
+		"pasta_pastas 1\n",
+		"pasta_stored_bytes 50\n",
+		"# TYPE pasta_http_requests_total counter\n",
+		"pasta_http_requests_total{route=\"/\",method=\"GET\",code=\"200\"} 1\n",
+		"# TYPE pasta_http_request_duration_seconds histogram\n",
+		"pasta_http_request_duration_seconds_bucket{route=\"/\",le=\"0.001\"} 0\n",
+		"pasta_http_request_duration_seconds_bucket{route=\"/\",le=\"0.005\"} 1\n",
+		"pasta_http_request_duration_seconds_bucket{route=\"/\",le=\"10\"} 1\n",
+		"pasta_http_request_duration_seconds_bucket{route=\"/\",le=\"+Inf\"} 2\n",
+		"pasta_http_request_duration_seconds_count{route=\"/\"} 2\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(output, line) {
+			t.Errorf("Missing metric: %s", line)
+		}
+	}
+}
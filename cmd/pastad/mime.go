@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	MimeAllow    = "allow"    // accept and serve with the type
+	MimeDeny     = "deny"     // reject uploads
+	MimePlain    = "plain"    // accept, but serve as text/plain
+	MimeDownload = "download" // accept, but serve as attachment
+)
+
+/* MimeRule is the upload and serving policy for a mime type */
+type MimeRule struct {
+	Type    string   `toml:"Type"`    // mime type, e.g. "text/html", "image/*" or "*"
+	Action  string   `toml:"Action"`  // allow, deny, plain or download
+	MaxSize ByteSize `toml:"MaxSize"` // maximum pasta size for this type, 0 = MaxPastaSize
+}
+
+/* MimePolicy holds the active mime rules */
+type MimePolicy struct {
+	mutex         sync.RWMutex
+	rules         map[string]MimeRule
+	defaultAction string // action for types without rule
+	defaultSize   int64  // size limit for rules without MaxSize
+}
+
+/* MimeDecision is the policy for a single pasta */
+type MimeDecision struct {
+	Action  string
+	MaxSize int64 // maximum size, 0 = MaxPastaSize
+}
+
+var mimePolicy MimePolicy
+
+// Mime types by file extension from the MimeTypesFile
+var mimeExtensions map[string]string
+var mimeExtensionsMutex sync.RWMutex
+
+// Rules, if none are configured. Types that run scripts in the browser are served as text
+var defaultMimeRules = []MimeRule{
+	{Type: "text/html", Action: MimePlain},
+	{Type: "application/xhtml+xml", Action: MimePlain},
+	{Type: "image/svg+xml", Action: MimePlain},
+}
+
+var errMimeDenied = errors.New("mime type not allowed")
+
+// Restrictiveness of the actions, the most restrictive action of all matching types applies
+var mimeActionOrder = map[string]int{MimeAllow: 0, MimePlain: 1, MimeDownload: 2, MimeDeny: 3}
+
+func validMimeAction(action string) bool {
+	_, ok := mimeActionOrder[action]
+	return ok
+}
+
+// Load the rules from the config. Invalid rules don't change the active policy
+func (policy *MimePolicy) Load(cf *Config) error {
+	loaded, err := newMimePolicy(cf)
+	if err != nil {
+		return err
+	}
+	policy.Set(loaded)
+	return nil
+}
+
+// Set replaces the rules by the rules of the given policy, which is not in use yet
+func (policy *MimePolicy) Set(loaded *MimePolicy) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	policy.rules = loaded.rules
+	policy.defaultAction = loaded.defaultAction
+	policy.defaultSize = loaded.defaultSize
+}
+
+// Create a new policy with the rules from the config
+func newMimePolicy(cf *Config) (*MimePolicy, error) {
+	defaultAction := strings.ToLower(cf.MimeDefaultAction)
+	if defaultAction == "" {
+		defaultAction = MimeAllow
+	}
+	if !validMimeAction(defaultAction) {
+		return nil, fmt.Errorf("invalid mime default action: %s", cf.MimeDefaultAction)
+	}
+	configured := cf.MimeRules
+	if len(configured) == 0 {
+		configured = defaultMimeRules
+	}
+	rules := make(map[string]MimeRule, len(configured))
+	for _, rule := range configured {
+		rule.Type = strings.ToLower(strings.TrimSpace(rule.Type))
+		rule.Action = strings.ToLower(rule.Action)
+		if rule.Action == "" {
+			rule.Action = MimeAllow
+		}
+		if rule.Type == "" {
+			return nil, fmt.Errorf("mime rule without type")
+		}
+		if !validMimeAction(rule.Action) {
+			return nil, fmt.Errorf("invalid action for mime type %s: %s", rule.Type, rule.Action)
+		}
+		if rule.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid maximum size for mime type %s", rule.Type)
+		}
+		rules[rule.Type] = rule
+	}
+	return &MimePolicy{rules: rules, defaultAction: defaultAction, defaultSize: int64(cf.MaxPastaSize)}, nil
+}
+
+// Get the rule for a mime type. Exact types have precedence over "major/*", which has precedence over "*"
+func (policy *MimePolicy) rule(mimeType string) MimeRule {
+	mimeType = baseMimeType(mimeType)
+	if rule, ok := policy.rules[mimeType]; ok {
+		return rule
+	}
+	if i := strings.Index(mimeType, "/"); i > 0 {
+		if rule, ok := policy.rules[mimeType[:i]+"/*"]; ok {
+			return rule
+		}
+	}
+	if rule, ok := policy.rules["*"]; ok {
+		return rule
+	}
+	action := policy.defaultAction
+	if action == "" {
+		action = MimeAllow
+	}
+	return MimeRule{Type: mimeType, Action: action}
+}
+
+/* Get the policy for a pasta with the given types (e.g. sniffed and by extension). Empty types are ignored.
+ * The most restrictive action and the smallest size limit apply */
+func (policy *MimePolicy) Decide(types ...string) MimeDecision {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	decision := MimeDecision{Action: MimeAllow}
+	for _, mimeType := range types {
+		if mimeType == "" {
+			continue
+		}
+		rule := policy.rule(mimeType)
+		if mimeActionOrder[rule.Action] > mimeActionOrder[decision.Action] {
+			decision.Action = rule.Action
+		}
+		limit := int64(rule.MaxSize)
+		if limit == 0 {
+			limit = policy.defaultSize
+		}
+		if limit > 0 && (decision.MaxSize == 0 || limit < decision.MaxSize) {
+			decision.MaxSize = limit
+		}
+	}
+	return decision
+}
+
+/* Restrictive returns the type with the most restrictive action of the given types. Empty types are ignored, on a tie the first type is returned.
+ * Pastas are stored with this type, so that content that is sniffed as html but uploaded with a harmless extension is not served as-is */
+func (policy *MimePolicy) Restrictive(types ...string) string {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	ret, order := "", -1
+	for _, mimeType := range types {
+		if mimeType == "" {
+			continue
+		}
+		if action := mimeActionOrder[policy.rule(mimeType).Action]; action > order {
+			ret, order = mimeType, action
+		}
+	}
+	return ret
+}
+
+// MaxSize returns the largest size limit of all rules and the global limit, for rejecting uploads before their type is known
+func (policy *MimePolicy) MaxSize(global int64) int64 {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	ret := global
+	for _, rule := range policy.rules {
+		if int64(rule.MaxSize) > ret {
+			ret = int64(rule.MaxSize)
+		}
+	}
+	return ret
+}
+
+// setMimeExtensions replaces the mime types by file extension
+func setMimeExtensions(extensions map[string]string) {
+	mimeExtensionsMutex.Lock()
+	defer mimeExtensionsMutex.Unlock()
+	mimeExtensions = extensions
+}
+
+// Strip the parameters from a mime type ("text/plain; charset=utf-8" -> "text/plain")
+func baseMimeType(mimeType string) string {
+	if base, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return strings.ToLower(base)
+	}
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+/* Determine the mime type of the content by its first bytes. Besides the types of http.DetectContentType, executables are recognized */
+func sniffMime(head []byte) string {
+	if bytes.HasPrefix(head, []byte("\x7fELF")) {
+		return "application/x-executable"
+	}
+	if bytes.HasPrefix(head, []byte("MZ")) {
+		return "application/x-msdownload"
+	}
+	return http.DetectContentType(head)
+}
+
+/* Set the Content-Type and Content-Disposition headers for serving a pasta of the given type by the mime policy */
+func setContentHeaders(w http.ResponseWriter, mimeType string, filename string) {
+	action := mimePolicy.Decide(mimeType).Action
+	disposition := "inline"
+	if action == MimePlain {
+		mimeType = "text/plain; charset=utf-8"
+	} else if action == MimeDownload || action == MimeDeny {
+		// Pastas of denied types, that have been uploaded before the type was denied, are only served as download
+		disposition = "attachment"
+	}
+	if mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	setPastaSecurityHeaders(w)
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+}
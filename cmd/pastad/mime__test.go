@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMimePolicy(t *testing.T) {
+	var policy MimePolicy
+	var config Config
+	config.SetDefaults()
+	config.MaxPastaSize = 1000
+	config.MimeRules = []MimeRule{
+		{Type: "text/html", Action: "plain"},
+		{Type: "text/*", MaxSize: 5000},
+		{Type: "image/svg+xml", Action: "download"},
+		{Type: "application/x-executable", Action: "deny"},
+		{Type: "image/*", MaxSize: 100},
+	}
+	if err := policy.Load(&config); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	checks := []struct {
+		types   []string
+		action  string
+		maxSize int64
+	}{
+		{[]string{"text/plain; charset=utf-8"}, MimeAllow, 5000},
+		{[]string{"text/html; charset=utf-8"}, MimePlain, 1000}, // exact types have precedence over "text/*"
+		{[]string{"application/json"}, MimeAllow, 1000},
+		{[]string{"image/png", "image/svg+xml"}, MimeDownload, 100},
+		{[]string{"text/plain", "application/x-executable"}, MimeDeny, 1000},
+		{[]string{"", "image/gif"}, MimeAllow, 100},
+	}
+	for _, check := range checks {
+		decision := policy.Decide(check.types...)
+		if decision.Action != check.action || decision.MaxSize != check.maxSize {
+			t.Errorf("Unexpected decision for %v: %+v", check.types, decision)
+		}
+	}
+	if mimeType := policy.Restrictive("application/xml", "text/html; charset=utf-8"); mimeType != "text/html; charset=utf-8" {
+		t.Errorf("Unexpected restrictive type: %s", mimeType)
+	}
+	if mimeType := policy.Restrictive("application/json", "text/plain; charset=utf-8"); mimeType != "application/json" {
+		t.Errorf("Type by extension not preferred: %s", mimeType)
+	}
+	if mimeType := policy.Restrictive("", "image/png"); mimeType != "image/png" {
+		t.Errorf("Unexpected restrictive type: %s", mimeType)
+	}
+	if size := policy.MaxSize(int64(config.MaxPastaSize)); size != 5000 {
+		t.Errorf("Unexpected maximum size: %d", size)
+	}
+
+	// Catch-all rule and default action
+	config.MimeDefaultAction = "download"
+	config.MimeRules = []MimeRule{{Type: "image/*"}}
+	if err := policy.Load(&config); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	if decision := policy.Decide("image/png"); decision.Action != MimeAllow {
+		t.Errorf("Unexpected action for image/png: %s", decision.Action)
+	}
+	if decision := policy.Decide("text/plain"); decision.Action != MimeDownload {
+		t.Errorf("Default action not applied: %s", decision.Action)
+	}
+	config.MimeRules = append(config.MimeRules, MimeRule{Type: "*", Action: "deny"})
+	if err := policy.Load(&config); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	if decision := policy.Decide("text/plain"); decision.Action != MimeDeny {
+		t.Errorf("Catch-all rule not applied: %s", decision.Action)
+	}
+
+	// Without rules, html is served as text
+	config.MimeDefaultAction = ""
+	config.MimeRules = nil
+	if err := policy.Load(&config); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	if decision := policy.Decide("text/html"); decision.Action != MimePlain {
+		t.Errorf("Default rules not applied: %s", decision.Action)
+	}
+
+	// Invalid rules are rejected and don't replace the active policy
+	config.MimeRules = []MimeRule{{Type: "text/html", Action: "block"}}
+	if err := policy.Load(&config); err == nil {
+		t.Error("Invalid action accepted")
+	}
+	config.MimeRules = []MimeRule{{Action: "deny"}}
+	if err := policy.Load(&config); err == nil {
+		t.Error("Rule without type accepted")
+	}
+	config.MimeRules = nil
+	config.MimeDefaultAction = "reject"
+	if err := policy.Load(&config); err == nil {
+		t.Error("Invalid default action accepted")
+	}
+	if decision := policy.Decide("text/html"); decision.Action != MimePlain {
+		t.Errorf("Invalid rules replaced the policy: %s", decision.Action)
+	}
+}
+
+func TestSniffMime(t *testing.T) {
+	checks := map[string]string{
+		"\x7fELF\x02\x01\x01":       "application/x-executable",
+		"MZ\x90\x00":                "application/x-msdownload",
+		"<!DOCTYPE html><html>":     "text/html; charset=utf-8",
+		"Hello world\n":             "text/plain; charset=utf-8",
+		"\x89PNG\r\n\x1a\n\x00\x00": "image/png",
+	}
+	for content, expected := range checks {
+		if mimeType := sniffMime([]byte(content)); mimeType != expected {
+			t.Errorf("Unexpected mime type for %q: %s", content, mimeType)
+		}
+	}
+}
+
+func TestContentHeaders(t *testing.T) {
+	defer func() {
+		mimePolicy.rules, mimePolicy.defaultAction, mimePolicy.defaultSize = nil, "", 0
+	}()
+	var config Config
+	config.SetDefaults()
+	config.MimeRules = []MimeRule{{Type: "text/html", Action: "plain"}, {Type: "image/svg+xml", Action: "download"}}
+	if err := mimePolicy.Load(&config); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	w := httptest.NewRecorder()
+	setContentHeaders(w, "text/html", "")
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Header().Get("Content-Disposition") != "inline" {
+		t.Errorf("html not served as text: %v", w.Header())
+	}
+	w = httptest.NewRecorder()
+	setContentHeaders(w, "image/svg+xml", "image.svg")
+	if w.Header().Get("Content-Type") != "image/svg+xml" || w.Header().Get("Content-Disposition") != "attachment; filename=\"image.svg\"" {
+		t.Errorf("svg not served as download: %v", w.Header())
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("nosniff header missing")
+	}
+}
+
+/* Html content, that is uploaded with a harmless extension, must not be served as html */
+func TestUploadedMimeType(t *testing.T) {
+	defer func() {
+		setMimeExtensions(make(map[string]string, 0))
+		mimePolicy.rules, mimePolicy.defaultAction, mimePolicy.defaultSize = nil, "", 0
+	}()
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+	})
+	if err := mimePolicy.Load(cf()); err != nil {
+		t.Fatalf("Error loading mime policy: %s", err)
+	}
+	setMimeExtensions(map[string]string{"xml": "application/xml", "png": "image/png", "json": "application/json"})
+
+	checks := map[string]string{
+		"page.xml":  "text/plain; charset=utf-8",
+		"image.png": "text/plain; charset=utf-8",
+		"data.json": "application/json",
+	}
+	for filename, expected := range checks {
+		content := "<!DOCTYPE html><html><script>alert(1)</script></html>"
+		if filename == "data.json" {
+			content = `{"key": "value"}`
+		}
+		r := httptest.NewRequest("POST", "/?ret=json", strings.NewReader(content))
+		r.Header.Set("Filename", filename)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		var id string
+		if _, err := fmt.Sscanf(w.Body.String(), `{"url":"http://example.com/%s`, &id); err != nil || w.Code != 200 {
+			t.Fatalf("Upload of %s failed: %d %s", filename, w.Code, w.Body.String())
+		}
+		id = strings.SplitN(id, `"`, 2)[0]
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/"+id, nil))
+		if w.Code != 200 || w.Header().Get("Content-Type") != expected {
+			t.Errorf("%s served as %q: %d", filename, w.Header().Get("Content-Type"), w.Code)
+		}
+	}
+}
@@ -5,61 +5,98 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/akamensky/argparse"
 )
 
 const VERSION = "0.7"
 
-var cf Config
 var bowl PastaBowl
-var publicPastas []Pasta
-var mimeExtensions map[string]string
-var delays map[string]int64
-var delayMutex sync.Mutex
 
+var errContentSize = errors.New("content size exceeded")
+var errInvalidFilename = errors.New("invalid filename")
+
+var keys KeyRing
+
+/* Handle a storage error while processing a request: Corrupt pastas are quarantined and a "500 Internal Server Error" is sent */
+func storageError(w http.ResponseWriter, id string, err error) {
+	slog.Error("storage error", "id", id, "error", err)
+	if errors.Is(err, errCorruptPasta) {
+		quarantine(id)
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, "storage error")
+}
+
+/* Move a corrupt pasta into quarantine and remove it from the public pastas */
+func quarantine(id string) {
+	filename, err := bowl.Quarantine(id)
+	if err != nil {
+		slog.Error("cannot quarantine pasta", "id", id, "error", err)
+		return
+	}
+	publicPastas.Remove(id)
+	changes.Record("delete", id)
+	metrics.Add("pasta_quarantined_total", 1)
+	slog.Warn("quarantined corrupt pasta", "id", id, "file", filename)
+}
+
+/* Send the given pasta. Storage errors before sending any content are handled by storageError */
 func SendPasta(pasta Pasta, w http.ResponseWriter) error {
 	file, err := bowl.GetPastaReader(pasta.Id)
 	if err != nil {
-		return err
+		storageError(w, pasta.Id, err)
+		return nil
 	}
 	defer file.Close()
-	w.Header().Set("Content-Disposition", "inline")
-	w.Header().Set("Content-Length", strconv.FormatInt(pasta.Size, 10))
-	if pasta.Mime != "" {
-		w.Header().Set("Content-Type", pasta.Mime)
-	}
-	if pasta.ContentFilename != "" {
-		w.Header().Set("Filename", pasta.ContentFilename)
-
+	mimeType := pasta.Mime
+	if mimeType == "" {
+		// Pastas of older versions have no type, determine it from the content
+		mimeType, err = sniffFile(file)
+		if err != nil {
+			storageError(w, pasta.Id, err)
+			return nil
+		}
 	}
-	_, err = io.Copy(w, file)
+	setContentHeaders(w, mimeType, pasta.ContentFilename)
+	w.Header().Set("Content-Length", strconv.FormatInt(pasta.Size, 10))
+	storageUsage.Read(pasta.Id)
+	n, err := io.Copy(w, file)
+	metrics.Add("pasta_downloads_total", 1)
+	metrics.Add("pasta_download_bytes_total", float64(n))
 	return err
 }
 
-func removePublicPasta(id string) {
-	copy := make([]Pasta, 0)
-	for _, pasta := range publicPastas {
-		if pasta.Id != id {
-			copy = append(copy, pasta)
-		}
+/* Determine the mime type of the content of a pasta file. The file is left at the current position */
+func sniffFile(file *os.File) (string, error) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
 	}
-	publicPastas = copy
+	_, err = file.Seek(offset, io.SeekStart)
+	return sniffMime(head[:n]), err
 }
 
-func deletePasta(id string, token string, w http.ResponseWriter) {
+func deletePasta(id string, token string, w http.ResponseWriter, r *http.Request) {
 	var pasta Pasta
 	var err error
 	if id == "" || token == "" {
@@ -67,8 +104,8 @@ func deletePasta(id string, token string, w http.ResponseWriter) {
 	}
 	pasta, err = bowl.GetPasta(id)
 	if err != nil {
-		log.Fatalf("Error getting pasta %s: %s", pasta.Id, err)
-		goto ServerError
+		storageError(w, id, err)
+		return
 	}
 	if pasta.Id == "" {
 		goto NotFound
@@ -76,14 +113,20 @@ func deletePasta(id string, token string, w http.ResponseWriter) {
 	if pasta.Token == token {
 		err = bowl.DeletePasta(pasta.Id)
 		if err != nil {
-			log.Fatalf("Error deleting pasta %s: %s", pasta.Id, err)
-			goto ServerError
+			storageError(w, id, err)
+			return
 		}
 		// Also remove from public pastas, if present
-		removePublicPasta(pasta.Id)
+		publicPastas.Remove(pasta.Id)
+		quotas.Remove(pasta)
+		storageUsage.Remove(pasta)
+		metrics.PastaRemoved(pasta.Size)
 
 		w.WriteHeader(200)
-		fmt.Fprintf(w, "<html><head><meta http-equiv=\"refresh\" content=\"2; url='%s'\" /></head>\n", cf.BaseUrl)
+		slog.Info("pasta deleted", "id", pasta.Id, "client", clientIP(r), "auth", "token")
+		audit.Write(auditEntry("delete", pasta, clientIP(r), "token"))
+		changes.Record("delete", pasta.Id)
+		fmt.Fprintf(w, "<html><head><meta http-equiv=\"refresh\" content=\"2; url='%s'\" /></head>\n", baseURL(r))
 		fmt.Fprintf(w, "<body>\n")
 		fmt.Fprintf(w, "<p>OK - Redirecting to <a href=\"/\">main page</a> ... </p>")
 		fmt.Fprintf(w, "\n</body>\n</html>")
@@ -98,26 +141,16 @@ NotFound:
 Invalid:
 	w.WriteHeader(403)
 	fmt.Fprintf(w, "Invalid request")
-	return
-ServerError:
-	w.WriteHeader(500)
-	fmt.Fprintf(w, "server error")
 }
 
-func receive(reader io.Reader, pasta *Pasta) error {
+/* Receive the pasta content into the given file, until the given maximum size is reached */
+func receive(reader io.Reader, file io.Writer, pasta *Pasta, maxSize int64) error {
 	buf := make([]byte, 4096)
-	file, err := os.OpenFile(pasta.DiskFilename, os.O_RDWR|os.O_APPEND, 0640)
-	if err != nil {
-		file.Close()
-		return err
-	}
-	defer file.Close()
 	pasta.Size = 0
-	for pasta.Size < cf.MaxPastaSize {
+	for pasta.Size < maxSize {
 		n, err := reader.Read(buf)
 		if (err == nil || err == io.EOF) && n > 0 {
 			if _, err = file.Write(buf[:n]); err != nil {
-				log.Fatalf("Write error while receiving bin: %s", err)
 				return err
 			}
 			pasta.Size += int64(n)
@@ -126,7 +159,6 @@ func receive(reader io.Reader, pasta *Pasta) error {
 			if err == io.EOF {
 				return nil
 			}
-			log.Fatalf("Receive error while receiving bin: %s", err)
 			return err
 		}
 	}
@@ -146,14 +178,14 @@ func receiveMultibody(r *http.Request, pasta *Pasta) (io.ReadCloser, bool, error
 	size := r.Header.Get("Content-Length")
 	if size != "" {
 		size, err := strconv.ParseInt(size, 10, 64)
-		if err == nil && size > 0 && size > cf.MaxPastaSize {
-			log.Println("Max size exceeded (Content-Length)")
-			return nil, public, errors.New("content size exceeded")
+		if err == nil && size > 0 && size > mimePolicy.MaxSize(int64(cf().MaxPastaSize)) {
+			slog.Info("max size exceeded (Content-Length)", "size", size)
+			return nil, public, errContentSize
 		}
 	}
 
 	// Receive multipart form
-	err := r.ParseMultipartForm(cf.MaxPastaSize)
+	err := r.ParseMultipartForm(mimePolicy.MaxSize(int64(cf().MaxPastaSize)))
 	if err != nil {
 		return nil, public, err
 	}
@@ -177,13 +209,6 @@ func receiveMultibody(r *http.Request, pasta *Pasta) (io.ReadCloser, bool, error
 		}
 	}
 
-	// Determine MIME type based on file extension, if present
-	if filename != "" {
-		pasta.Mime = mimeByFilename(filename)
-	} else {
-		pasta.Mime = "application/octet-stream"
-	}
-
 	return file, public, err
 }
 
@@ -208,31 +233,26 @@ func isMultipart(r *http.Request) bool {
 	return contentType == "multipart/form-data" || strings.HasPrefix(contentType, "multipart/form-data;")
 }
 
-func ReceivePasta(r *http.Request) (Pasta, bool, error) {
+func ReceivePasta(r *http.Request, owner string, client string) (Pasta, bool, error) {
 	var err error
 	var reader io.ReadCloser
-	pasta := Pasta{Id: ""}
+	pasta := Pasta{Id: "", Owner: owner, Client: client}
 	public := false
 
 	// Parse expire if given
-	if cf.DefaultExpire > 0 {
-		pasta.ExpireDate = time.Now().Unix() + cf.DefaultExpire
+	if cf().DefaultExpire > 0 {
+		pasta.ExpireDate = time.Now().Unix() + int64(cf().DefaultExpire)
 	}
 	if expire := parseExpire(r.Header["Expire"]); expire > 0 {
 		pasta.ExpireDate = expire
 		// TODO: Add maximum expiration parameter
 	}
 
-	pasta.Id = removeNonAlphaNumeric(bowl.GenerateRandomBinId(cf.PastaCharacters))
+	pasta.Id = removeNonAlphaNumeric(bowl.GenerateRandomBinId(cf().PastaCharacters))
 	formRead := true // Read values from the form
 	if isMultipart(r) {
-		// InsertPasta to obtain a filename
-		if err = bowl.InsertPasta(&pasta); err != nil {
-			return pasta, public, err
-		}
 		reader, public, err = receiveMultibody(r, &pasta)
 		if err != nil {
-			bowl.DeletePasta(pasta.Id)
 			pasta.Id = ""
 			return pasta, public, err
 		}
@@ -260,9 +280,9 @@ func ReceivePasta(r *http.Request) (Pasta, bool, error) {
 	size := header.Get("Content-Length")
 	if size != "" {
 		size, err := strconv.ParseInt(size, 10, 64)
-		if err == nil && size > 0 && size > cf.MaxPastaSize {
-			log.Println("Max size exceeded (Content-Length)")
-			return pasta, public, errors.New("content size exceeded")
+		if err == nil && size > 0 && size > mimePolicy.MaxSize(int64(cf().MaxPastaSize)) {
+			slog.Info("max size exceeded (Content-Length)", "size", size)
+			return pasta, public, errContentSize
 		}
 	}
 	// Get property. URL parameter has precedence over header
@@ -296,78 +316,89 @@ func ReceivePasta(r *http.Request) (Pasta, bool, error) {
 			pasta.ContentFilename = filename
 		}
 	}
+	// Filenames are stored in the metadata, line breaks would inject further metadata
+	if containsControl(pasta.ContentFilename) {
+		slog.Info("invalid filename", "filename", pasta.ContentFilename)
+		return pasta, public, errInvalidFilename
+	}
 
-	// InsertPasta sets filename
-	if err = bowl.InsertPasta(&pasta); err != nil {
+	// Apply the mime policy to the sniffed type and the type by the file extension
+	buffered := bufio.NewReader(reader)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
 		return pasta, public, err
 	}
-	if err := receive(reader, &pasta); err != nil {
+	sniffed := sniffMime(head)
+	byExtension := mimeByFilename(pasta.ContentFilename)
+	decision := mimePolicy.Decide(sniffed, byExtension)
+	if decision.Action == MimeDeny {
+		slog.Info("mime type denied", "mime", sniffed, "filename", pasta.ContentFilename)
+		return pasta, public, errMimeDenied
+	}
+	// The type by extension is preferred, unless the content is of a type with a more restrictive policy
+	pasta.Mime = mimePolicy.Restrictive(byExtension, sniffed)
+	maxSize := decision.MaxSize
+	if maxSize <= 0 {
+		maxSize = int64(cf().MaxPastaSize)
+	}
+
+	// The pasta is written to a temporary file and only moved into place once it has been received completely
+	file, err := bowl.CreatePasta(&pasta)
+	if err != nil {
+		return pasta, public, err
+	}
+	defer file.Abort()
+	if err := receive(buffered, file, &pasta, maxSize); err != nil {
 		return pasta, public, err
 	}
-	if pasta.Size >= cf.MaxPastaSize {
-		log.Println("Max size exceeded while receiving bin")
-		return pasta, public, errors.New("content size exceeded")
+	if pasta.Size >= maxSize {
+		slog.Info("max size exceeded while receiving pasta", "id", pasta.Id, "mime", pasta.Mime)
+		return pasta, public, errContentSize
 	}
-	pasta.Mime = "text/plain"
 	if pasta.Size == 0 {
-		bowl.DeletePasta(pasta.Id)
 		pasta.Id = ""
 		pasta.DiskFilename = ""
 		pasta.Token = ""
 		pasta.ExpireDate = 0
 		return pasta, public, nil
 	}
+	// The committed pasta is not counted by a concurrent recompute of the storage usage, until it is accounted by reserveStorage
+	storageUsage.Pending(pasta.Id)
+	if err := file.Commit(pasta.Size); err != nil {
+		return pasta, public, err
+	}
 
 	return pasta, public, nil
 }
 
-/* Delay a request for the given remote if required by spam protection */
-func delayIfRequired(remote string) {
-	if cf.RequestDelay == 0 {
-		return
-	}
-	address := extractRemoteIP(remote)
-	now := time.Now().UnixNano() / 1000000 // Timestamp now in milliseconds. This should be fine until 2262
-	delayMutex.Lock()
-	delay, ok := delays[address]
-	delayMutex.Unlock()
-	if ok {
-		delta := cf.RequestDelay - (now - delay)
-		if delta > 0 {
-			time.Sleep(time.Duration(delta) * time.Millisecond)
-		}
-	}
-	delays[address] = time.Now().UnixNano() / 1000000 // Fresh timestamp
-}
-
 func handlerHead(w http.ResponseWriter, r *http.Request) {
 	var pasta Pasta
 	id, err := ExtractPastaId(r.URL.Path)
 	if err != nil {
 		goto BadRequest
 	}
-	if pasta, err := bowl.GetPasta(id); err != nil {
-		log.Fatalf("Error getting pasta %s: %s", pasta.Id, err)
-		goto ServerError
+	if redirectUserContent(w, r, id) {
+		return
 	}
-	if pasta.Id == "" {
+	pasta, err = bowl.GetPasta(id)
+	if err != nil {
+		storageError(w, id, err)
+		return
+	}
+	if pasta.Id == "" || pasta.Expired() {
 		goto NotFound
 	}
 
 	w.Header().Set("Content-Length", strconv.FormatInt(pasta.Size, 10))
 	if pasta.Mime != "" {
-		w.Header().Set("Content-Type", pasta.Mime)
+		setContentHeaders(w, pasta.Mime, pasta.ContentFilename)
 	}
 	if pasta.ExpireDate > 0 {
-		w.Header().Set("Expires", time.Unix(pasta.ExpireDate, 0).Format("2006-01-02-15:04:05"))
+		w.Header().Set("Expires", time.Unix(pasta.ExpireDate, 0).UTC().Format(http.TimeFormat))
 	}
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "OK")
 	return
-ServerError:
-	w.WriteHeader(500)
-	fmt.Fprintf(w, "server error")
-	return
 NotFound:
 	w.WriteHeader(404)
 	fmt.Fprintf(w, "pasta not found")
@@ -383,12 +414,89 @@ BadRequest:
 }
 
 func handlerPost(w http.ResponseWriter, r *http.Request) {
-	delayIfRequired(r.RemoteAddr)
-	pasta, public, err := ReceivePasta(r)
-	if err != nil {
+	if !checkAccess(w, r, &acls.Create, "upload") {
+		return
+	}
+	if !rateLimit(w, r, http.MethodPost) {
+		return
+	}
+	// If API keys are configured, only requests with a valid key may create new pastas
+	owner := ""
+	var apikey *APIKey
+	if keys.Enabled() {
+		key, ok, err := requestKey(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer realm=\"pasta\"")
+			w.WriteHeader(http.StatusUnauthorized)
+			if err != nil {
+				fmt.Fprintf(w, "invalid api key")
+				slog.Warn("upload with invalid api key rejected", "client", clientIP(r))
+			} else {
+				fmt.Fprintf(w, "api key required")
+			}
+			return
+		}
+		owner = key.Label
+		apikey = &key
+	}
+	// Check the quota of the API key or the client IP. The client is always recorded for anonymous pastas, so that they count once quotas are enabled
+	client := ""
+	limits := quotaLimits(apikey)
+	if owner == "" {
+		client = clientIP(r)
+	}
+	subject := quotaSubject(owner, client)
+	size, _ := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+	if status, message := quotas.BeginUpload(subject, limits, size); status != 0 {
+		slog.Warn("upload rejected", "client", clientIP(r), "reason", message)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s", message)
+		return
+	}
+	if status, message := checkStorageCap(size); status != 0 {
+		slog.Warn("upload rejected", "client", clientIP(r), "reason", message)
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%s", message)
+		return
+	}
+	pasta, public, err := ReceivePasta(r, owner, client)
+	defer storageUsage.Release(pasta.Id)
+	if err == nil && pasta.Id != "" {
+		status, message := quotas.Add(subject, limits, pasta.Size)
+		if status == 0 {
+			if status, message = reserveStorage(pasta); status != 0 {
+				quotas.Remove(pasta)
+			}
+		}
+		if status != 0 {
+			if err := bowl.DeletePasta(pasta.Id); err != nil {
+				slog.Error("error deleting pasta", "id", pasta.Id, "error", err)
+			}
+			slog.Warn("upload rejected", "client", clientIP(r), "reason", message)
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "%s", message)
+			return
+		}
+	}
+	if err == errMimeDenied {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		fmt.Fprintf(w, "%s", err)
+		slog.Warn("upload rejected", "client", clientIP(r), "reason", err)
+		return
+	} else if err == errContentSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "%s", err)
+		slog.Warn("upload rejected", "client", clientIP(r), "reason", err)
+		return
+	} else if err == errInvalidFilename {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%s", err)
+		slog.Warn("upload rejected", "client", clientIP(r), "reason", err)
+		return
+	} else if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "server error")
-		log.Printf("Receive error: %s", err)
+		slog.Error("receive error", "client", clientIP(r), "error", err)
 		return
 	} else {
 		if pasta.Id == "" {
@@ -397,23 +505,19 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 		} else {
 			// Save into public pastas, if this is public
 			if public {
-				// Store at the beginning
-				pastas := make([]Pasta, 1)
-				pastas[0] = pasta
-				pastas = append(pastas, publicPastas...)
-				publicPastas = pastas
-				// Crop to maximum allowed number
-				if len(publicPastas) > cf.PublicPastas {
-					publicPastas = publicPastas[len(publicPastas)-cf.PublicPastas:]
-				}
-				if err := bowl.WritePublicPastas(publicPastas); err != nil {
-					log.Printf("Error writing public pastas: %s", err)
+				publicPastas.Add(pasta, cf().PublicPastas)
+				if err := publicPastas.Persist(&bowl); err != nil {
+					slog.Error("error writing public pastas", "error", err)
 				}
 			}
 
-			log.Printf("Received pasta %s (%d bytes) from %s", pasta.Id, pasta.Size, r.RemoteAddr)
+			metrics.PastaAdded(pasta.Size)
+			slog.Info("pasta received", "id", pasta.Id, "size", pasta.Size, "client", clientIP(r), "owner", pasta.Owner)
+			audit.Write(auditEntry("create", pasta, clientIP(r), ""))
+			changes.Record("create", pasta.Id)
 			w.WriteHeader(http.StatusOK)
-			url := fmt.Sprintf("%s/%s", cf.BaseUrl, pasta.Id)
+			base := baseURL(r)
+			url := fmt.Sprintf("%s/%s", base, pasta.Id)
 			// Return format. URL has precedence over http heder
 			retFormat := r.Header.Get("Return-Format")
 			retFormats := r.URL.Query()["ret"]
@@ -425,7 +529,7 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprintf(w, "<!doctype html><html><head><title>pasta</title></head>\n")
 				fmt.Fprintf(w, "<body>\n")
 				fmt.Fprintf(w, "<h1>pasta</h1>\n")
-				deleteLink := fmt.Sprintf("%s/delete?id=%s&token=%s", cf.BaseUrl, pasta.Id, pasta.Token)
+				deleteLink := fmt.Sprintf("%s/delete?id=%s&token=%s", base, pasta.Id, pasta.Token)
 				fmt.Fprintf(w, "<p>Pasta: <a href=\"%s\">%s</a> | <a href=\"%s\">🗑️ Delete</a><br/>", url, url, deleteLink)
 				fmt.Fprintf(w, "<pre>")
 				if pasta.ContentFilename != "" {
@@ -444,7 +548,7 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 					fmt.Fprintf(w, "Public:             yes\n")
 				}
 				fmt.Fprintf(w, "Modification token: %s\n</pre>\n", pasta.Token)
-				fmt.Fprintf(w, "<p>That was fun! Fancy <a href=\"%s\">another one?</a>.</p>\n", cf.BaseUrl)
+				fmt.Fprintf(w, "<p>That was fun! Fancy <a href=\"%s\">another one?</a>.</p>\n", base)
 				fmt.Fprintf(w, "</body></html>")
 			} else if retFormat == "json" {
 				// Dont use json package, the reply is simple enough to build it on-the-fly
@@ -460,6 +564,9 @@ func handlerPost(w http.ResponseWriter, r *http.Request) {
 func handler(w http.ResponseWriter, r *http.Request) {
 	var err error
 	if r.Method == http.MethodGet {
+		if !rateLimit(w, r, http.MethodGet) {
+			return
+		}
 		// Check if bin ID is given
 		id, err := ExtractPastaId(r.URL.Path)
 		if err != nil {
@@ -468,11 +575,15 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		if id == "" {
 			handlerIndex(w, r)
 		} else {
+			if !checkAccess(w, r, &acls.Read, "read") {
+				return
+			}
+			if redirectUserContent(w, r, id) {
+				return
+			}
 			pasta, err := bowl.GetPasta(id)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				fmt.Fprintf(w, "Storage error")
-				log.Fatalf("Storage error: %s", err)
+				storageError(w, id, err)
 				return
 			}
 			if pasta.Id == "" {
@@ -481,27 +592,51 @@ func handler(w http.ResponseWriter, r *http.Request) {
 				// Delete expired pasta if present
 				if pasta.Expired() {
 					if err = bowl.DeletePasta(pasta.Id); err != nil {
-						log.Fatalf("Cannot deleted expired pasta %s: %s", pasta.Id, err)
+						// Don't deliver the expired pasta, the cleanup will try again
+						slog.Error("cannot delete expired pasta", "id", pasta.Id, "error", err)
+					} else {
+						audit.Write(auditEntry("expire", pasta, "", ""))
+						changes.Record("delete", pasta.Id)
+						quotas.Remove(pasta)
+						storageUsage.Remove(pasta)
+						metrics.PastaRemoved(pasta.Size)
 					}
 					goto NoSuchPasta
 				}
 
 				if err = SendPasta(pasta, w); err != nil {
-					log.Printf("Error sending pasta %s: %s", pasta.Id, err)
+					slog.Warn("error sending pasta", "id", pasta.Id, "error", err)
 				}
 			}
 		}
 	} else if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if replicaReadOnly(w) {
+			return
+		}
 		handlerPost(w, r)
 	} else if r.Method == http.MethodDelete {
-		delayIfRequired(r.RemoteAddr)
+		if replicaReadOnly(w) {
+			return
+		}
+		if !checkAccess(w, r, &acls.Delete, "delete") {
+			return
+		}
+		if !rateLimit(w, r, http.MethodDelete) {
+			return
+		}
 		id, err := ExtractPastaId(r.URL.Path)
 		if err != nil {
 			goto BadRequest
 		}
 		token := takeFirst(r.URL.Query()["token"])
-		deletePasta(id, token, w)
+		deletePasta(id, token, w, r)
 	} else if r.Method == http.MethodHead {
+		if !checkAccess(w, r, &acls.Read, "read") {
+			return
+		}
+		if !rateLimit(w, r, http.MethodGet) {
+			return
+		}
 		handlerHead(w, r)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
@@ -529,7 +664,7 @@ func handlerHealthJson(w http.ResponseWriter, r *http.Request) {
 }
 
 func handlerPublic(w http.ResponseWriter, r *http.Request) {
-	if cf.PublicPastas == 0 {
+	if cf().PublicPastas == 0 {
 		w.WriteHeader(400)
 		fmt.Fprintf(w, "public pasta listing is disabled")
 		return
@@ -539,7 +674,7 @@ func handlerPublic(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("<h2>public pastas</h2>\n"))
 	w.Write([]byte("<table>\n"))
 	w.Write([]byte("<tr><td>Filename</td><td>Size</td></tr>\n"))
-	for _, pasta := range publicPastas {
+	for _, pasta := range publicPastas.List() {
 		filename := pasta.ContentFilename
 		if filename == "" {
 			filename = pasta.Id
@@ -547,12 +682,12 @@ func handlerPublic(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("<tr><td><a href=\"%s\">%s</a></td><td>%d B</td></tr>\n", pasta.Id, filename, pasta.Size)))
 	}
 	w.Write([]byte("</table>\n"))
-	fmt.Fprintf(w, "<p>The server presents at most %d public pastas.<p>\n", cf.PublicPastas)
+	fmt.Fprintf(w, "<p>The server presents at most %d public pastas.<p>\n", cf().PublicPastas)
 	w.Write([]byte("</body>\n"))
 }
 
 func handlerPublicJson(w http.ResponseWriter, r *http.Request) {
-	if cf.PublicPastas == 0 {
+	if cf().PublicPastas == 0 {
 		w.WriteHeader(400)
 		fmt.Fprintf(w, "public pasta listing is disabled")
 		return
@@ -563,16 +698,16 @@ func handlerPublicJson(w http.ResponseWriter, r *http.Request) {
 		URL      string `json:"url"`
 	}
 	pastas := make([]PublicPasta, 0)
-	for _, pasta := range publicPastas {
+	for _, pasta := range publicPastas.List() {
 		filename := pasta.ContentFilename
 		if filename == "" {
 			filename = pasta.Id
 		}
-		pastas = append(pastas, PublicPasta{Filename: filename, URL: fmt.Sprintf("%s/%s", cf.BaseUrl, pasta.Id), Size: pasta.Size})
+		pastas = append(pastas, PublicPasta{Filename: filename, URL: fmt.Sprintf("%s/%s", baseURL(r), pasta.Id), Size: pasta.Size})
 	}
 	buf, err := json.Marshal(pastas)
 	if err != nil {
-		log.Printf("json error (public pastas): %s\n", err)
+		slog.Error("json error", "error", err)
 		goto ServerError
 	}
 	w.WriteHeader(200)
@@ -588,12 +723,50 @@ func handlerRobots(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "User-agent: *\nDisallow: /\n")
 }
 
+/* Load the public pastas from the bowl */
+func loadPublicPastas() {
+	if cf().PublicPastas <= 0 {
+		publicPastas.Unload()
+		return
+	}
+	ids, err := bowl.GetPublicPastas()
+	if err != nil {
+		slog.Error("error loading public pastas", "error", err)
+		return
+	}
+	// Crop if necessary, the newest pastas are first
+	if len(ids) > cf().PublicPastas {
+		ids = ids[:cf().PublicPastas]
+		bowl.WritePublicPastaIDs(ids)
+	}
+	pastas := make([]Pasta, 0)
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		pasta, err := bowl.GetPasta(id)
+		if err == nil && pasta.Id != "" {
+			pastas = append(pastas, pasta)
+		}
+	}
+	publicPastas.Set(pastas)
+	slog.Info("loaded public pastas", "count", len(pastas))
+}
+
 // Delete pasta
 func handlerDelete(w http.ResponseWriter, r *http.Request) {
-	delayIfRequired(r.RemoteAddr)
+	if replicaReadOnly(w) {
+		return
+	}
+	if !checkAccess(w, r, &acls.Delete, "delete") {
+		return
+	}
+	if !rateLimit(w, r, http.MethodDelete) {
+		return
+	}
 	id := takeFirst(r.URL.Query()["id"])
 	token := takeFirst(r.URL.Query()["token"])
-	deletePasta(id, token, w)
+	deletePasta(id, token, w, r)
 }
 
 func handlerIndex(w http.ResponseWriter, r *http.Request) {
@@ -602,11 +775,12 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<h1>pasta</h1>\n")
 	fmt.Fprintf(w, "<p>pasta is a stupid simple pastebin service for easy usage and deployment.</p>\n")
 	// List public pastas, if enabled and available
-	if cf.PublicPastas > 0 && len(publicPastas) > 0 {
+	public := publicPastas.List()
+	if cf().PublicPastas > 0 && len(public) > 0 {
 		fmt.Fprintf(w, "<h2>Public pastas</h2>\n")
 		fmt.Fprintf(w, "<table>\n")
 		fmt.Fprintf(w, "<tr><td>Filename</td><td>Size</td></tr>\n")
-		for _, pasta := range publicPastas {
+		for _, pasta := range public {
 			filename := pasta.ContentFilename
 			if filename == "" {
 				filename = pasta.Id
@@ -614,20 +788,32 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "<tr><td><a href=\"%s\">%s</a></td><td>%d B</td></tr>\n", pasta.Id, filename, pasta.Size)
 		}
 		fmt.Fprintf(w, "</table>\n")
-		if len(publicPastas) == cf.PublicPastas {
-			fmt.Fprintf(w, "<p>The server presents at most %d public pastas.<p>\n", cf.PublicPastas)
+		if len(public) == cf().PublicPastas {
+			fmt.Fprintf(w, "<p>The server presents at most %d public pastas.<p>\n", cf().PublicPastas)
 		}
 	}
 	fmt.Fprintf(w, "<h2>Post a new pasta</h2>\n")
-	fmt.Fprintf(w, "<p><code>curl -X POST '%s' --data-binary @FILE</code></p>\n", cf.BaseUrl)
-	if cf.DefaultExpire > 0 {
-		fmt.Fprintf(w, "<p>pastas expire by default after %s - Enjoy them while they are fresh!</p>\n", timeHumanReadable(cf.DefaultExpire))
+	if keys.Enabled() {
+		// Browser forms cannot send the api key, so only show the curl command
+		fmt.Fprintf(w, "<p>Creating new pastas requires an API key:</p>\n")
+		fmt.Fprintf(w, "<p><code>curl -X POST '%s' -H 'Authorization: Bearer KEY' --data-binary @FILE</code></p>\n", baseURL(r))
+		if cf().DefaultExpire > 0 {
+			fmt.Fprintf(w, "<p>pastas expire by default after %s - Enjoy them while they are fresh!</p>\n", timeHumanReadable(int64(cf().DefaultExpire)))
+		}
+		fmt.Fprintf(w, "\n<hr/>\n")
+		fmt.Fprintf(w, "<p>project page: <a href=\"https://codeberg.org/grisu48/pasta\" target=\"_BLANK\">codeberg.org/grisu48/pasta</a></p>\n")
+		fmt.Fprintf(w, "</body></html>")
+		return
+	}
+	fmt.Fprintf(w, "<p><code>curl -X POST '%s' --data-binary @FILE</code></p>\n", baseURL(r))
+	if cf().DefaultExpire > 0 {
+		fmt.Fprintf(w, "<p>pastas expire by default after %s - Enjoy them while they are fresh!</p>\n", timeHumanReadable(int64(cf().DefaultExpire)))
 	}
 	fmt.Fprintf(w, "<h3>File upload</h3>")
 	fmt.Fprintf(w, "<p>Upload your file and make a fresh pasta out of it:</p>")
 	fmt.Fprintf(w, "<form enctype=\"multipart/form-data\" method=\"post\" action=\"/?ret=html\">\n")
 	fmt.Fprintf(w, "<input type=\"file\" name=\"file\">\n")
-	if cf.PublicPastas > 0 {
+	if cf().PublicPastas > 0 {
 		fmt.Fprintf(w, "<input type=\"checkbox\" id=\"public\" name=\"public\" value=\"true\"> Public\n")
 	}
 	fmt.Fprintf(w, "<input type=\"submit\" value=\"Upload\">\n")
@@ -636,12 +822,12 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<p>Just paste your contents in the textfield and hit the <tt>pasta</tt> button below</p>\n")
 	fmt.Fprintf(w, "<form method=\"post\" action=\"/?input=form&ret=html\">\n")
 	fmt.Fprintf(w, "Filename (optional): <input type=\"text\" name=\"filename\" value=\"\" max=\"255\"><br/>\n")
-	if cf.MaxPastaSize > 0 {
-		fmt.Fprintf(w, "<textarea name=\"content\" rows=\"10\" cols=\"80\" maxlength=\"%d\"></textarea><br/>\n", cf.MaxPastaSize)
+	if cf().MaxPastaSize > 0 {
+		fmt.Fprintf(w, "<textarea name=\"content\" rows=\"10\" cols=\"80\" maxlength=\"%d\"></textarea><br/>\n", cf().MaxPastaSize)
 	} else {
 		fmt.Fprintf(w, "<textarea name=\"content\" rows=\"10\" cols=\"80\"></textarea><br/>\n")
 	}
-	if cf.PublicPastas > 0 {
+	if cf().PublicPastas > 0 {
 		fmt.Fprintf(w, "<input type=\"checkbox\" id=\"public\" name=\"public\" value=\"true\"> Public pasta\n")
 	}
 	fmt.Fprintf(w, "<input type=\"submit\" value=\"Pasta!\">\n")
@@ -653,142 +839,245 @@ func handlerIndex(w http.ResponseWriter, r *http.Request) {
 
 func cleanupThread() {
 	// Double check this, because I know that I will screw this up at some point in the main routine :-)
-	if cf.CleanupInterval == 0 {
+	if cf().CleanupInterval == 0 {
 		return
 	}
 	for {
+		// A cleanup cycle is completed before shutting down, but none is started while shutting down
+		if !shutdown.BeginTask() {
+			return
+		}
 		duration := time.Now().Unix()
-		if err := bowl.RemoveExpired(); err != nil {
-			log.Fatalf("Error while removing expired pastas: %s", err)
+		start := time.Now()
+		removed, quarantined, err := bowl.RemoveExpired()
+		if err != nil {
+			// Keep going, the failing pastas are retried in the next cycle
+			slog.Error("error while removing expired pastas", "error", err)
+			metrics.Add("pasta_cleanup_errors_total", 1)
 		}
-		if cf.RequestDelay > 0 { // Cleanup of the spam protection addresses only if enabled
-			delayMutex.Lock()
-			delays = make(map[string]int64)
-			delayMutex.Unlock()
+		metrics.Observe("pasta_cleanup_duration_seconds", time.Since(start).Seconds())
+		metrics.Set("pasta_cleanup_removed_pastas", float64(len(removed)))
+		metrics.Add("pasta_cleanup_removed_pastas_total", float64(len(removed)))
+		for _, pasta := range removed {
+			audit.Write(auditEntry("expire", pasta, "", ""))
+			changes.Record("delete", pasta.Id)
 		}
-		duration = time.Now().Unix() - duration + int64(cf.CleanupInterval)
-		if duration > 0 {
-			time.Sleep(time.Duration(cf.CleanupInterval) * time.Second)
-		} else {
+		for _, id := range quarantined {
+			publicPastas.Remove(id)
+			changes.Record("delete", id)
+			metrics.Add("pasta_quarantined_total", 1)
+			slog.Warn("quarantined corrupt pasta", "id", id)
+		}
+		if err := quotas.Recompute(&bowl); err != nil {
+			slog.Error("error recomputing quotas", "error", err)
+		}
+		enforceStorageCap(&bowl)
+		if err := metrics.UpdateStorage(&bowl); err != nil {
+			slog.Error("error updating storage metrics", "error", err)
+		}
+
+		shutdown.EndTask()
+
+		duration = time.Now().Unix() - duration + int64(cf().CleanupInterval)
+		sleep := cf().CleanupInterval.Duration()
+		if duration <= 0 {
 			// Don't spam the system, give it at least some time
-			time.Sleep(time.Second)
+			sleep = time.Second
+		}
+		select {
+		case <-shutdown.Stopping():
+			return
+		case <-time.After(sleep):
 		}
 	}
 }
 
 func main() {
-	cf.SetDefaults()
-	cf.ReadEnv()
-	delays = make(map[string]int64)
-	publicPastas = make([]Pasta, 0)
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(adminMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsckMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(exportMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importMain(os.Args[1:]))
+	}
+
 	// Parse program arguments for config
-	parseCf := ParserConfig{}
 	parser := argparse.NewParser("pastad", "pasta server")
-	parseCf.ConfigFile = parser.String("c", "config", &argparse.Options{Default: "", Help: "Set config file"})
-	parseCf.BaseURL = parser.String("B", "baseurl", &argparse.Options{Help: "Set base URL for instance"})
-	parseCf.PastaDir = parser.String("d", "dir", &argparse.Options{Help: "Set pasta data directory"})
-	parseCf.BindAddr = parser.String("b", "bind", &argparse.Options{Help: "Address to bind server to"})
-	parseCf.MaxPastaSize = parser.Int("s", "size", &argparse.Options{Help: "Maximum allowed size for a pasta"})
-	parseCf.PastaCharacters = parser.Int("n", "chars", &argparse.Options{Help: "Random characters for new pastas"})
-	parseCf.MimeTypesFile = parser.String("m", "mime", &argparse.Options{Help: "Define mime types file"})
-	parseCf.DefaultExpire = parser.Int("e", "expire", &argparse.Options{Help: "Pasta expire in seconds"})
-	parseCf.CleanupInterval = parser.Int("C", "cleanup", &argparse.Options{Help: "Cleanup interval in seconds"})
-	parseCf.PublicPastas = parser.Int("p", "public", &argparse.Options{Help: "Number of public pastas to display, if any"})
+	parseCf := NewParserConfig(parser)
+	checkConfig := parser.Flag("", "check-config", &argparse.Options{Help: "Validate the configuration and print the effective settings"})
 	if err := parser.Parse(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", parser.Usage(err))
 		os.Exit(1)
 	}
-	log.Printf("Starting pasta server v%s ... \n", VERSION)
-	configFile := *parseCf.ConfigFile
-	if configFile != "" {
-		if FileExists(configFile) {
-			if _, err := toml.DecodeFile(configFile, &cf); err != nil {
-				fmt.Printf("Error loading configuration file: %s\n", err)
-				os.Exit(1)
-			}
+	configFile = *parseCf.ConfigFile
+	configFlags = parseCf
+	if *checkConfig {
+		os.Exit(checkConfigMain(configFile, configFlags))
+	}
+	if configFile != "" && !FileExists(configFile) {
+		if err := CreateDefaultConfigfile(configFile); err == nil {
+			fmt.Fprintf(os.Stderr, "Created default config file '%s'\n", configFile)
 		} else {
-			if err := CreateDefaultConfigfile(configFile); err == nil {
-				fmt.Fprintf(os.Stderr, "Created default config file '%s'\n", configFile)
-			} else {
-				fmt.Fprintf(os.Stderr, "Warning: Cannot create default config file '%s': %s\n", configFile, err)
-			}
+			fmt.Fprintf(os.Stderr, "Warning: Cannot create default config file '%s': %s\n", configFile, err)
 		}
 	}
-	// Program arguments overwrite config file
-	parseCf.ApplyTo(&cf)
-
-	// Sanity check
-	if cf.PastaCharacters <= 0 {
-		log.Println("Setting pasta characters to default 8 because it was <= 0")
-		cf.PastaCharacters = 8
+	config, _, err := loadConfig(configFile, configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+		os.Exit(1)
 	}
-	if cf.PastaCharacters < 8 {
-		log.Println("Warning: Using less than 8 pasta characters might not be side-effects free")
+	setConfig(&config)
+	if err := setupLogging(cf()); err != nil {
+		fmt.Fprintf(os.Stderr, "error setting up logging: %s\n", err)
+		os.Exit(1)
 	}
-	if cf.PastaDir == "" {
-		cf.PastaDir = "."
+	slog.Info("starting pasta server", "version", VERSION)
+	if cf().PastaCharacters < 8 {
+		slog.Warn("using less than 8 pasta characters might not be side-effects free")
 	}
-
-	// Preparation steps
-	baseURL, err := ApplyMacros(cf.BaseUrl)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error applying macros: %s", err)
+	if nets, err := parseCIDRs(cf().TrustedProxies); err == nil {
+		trustedProxies.Set(nets)
+	}
+	if err := acls.Load(cf()); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid access list: %s\n", err)
+		os.Exit(1)
+	}
+	if err := mimePolicy.Load(cf()); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid mime policy: %s\n", err)
 		os.Exit(1)
 	}
-	cf.BaseUrl = baseURL
-	bowl.Directory = cf.PastaDir
+	bowl.Directory = cf().PastaDir
+	bowl.QuarantineDir = cf().QuarantineDir
 	os.Mkdir(bowl.Directory, os.ModePerm)
+	if err := changes.Open(bowl.filename("_changes")); err != nil {
+		fmt.Fprintf(os.Stderr, "error opening change journal: %s\n", err)
+		os.Exit(1)
+	}
 
 	// Load MIME types file
-	if cf.MimeTypesFile == "" {
-		mimeExtensions = make(map[string]string, 0)
+	if cf().MimeTypesFile == "" {
+		setMimeExtensions(make(map[string]string, 0))
 	} else {
-		var err error
-		mimeExtensions, err = loadMimeTypes(cf.MimeTypesFile)
+		extensions, err := loadMimeTypes(cf().MimeTypesFile)
 		if err != nil {
-			log.Printf("Warning: Cannot load mime types file '%s': %s", cf.MimeTypesFile, err)
+			slog.Warn("cannot load mime types file", "file", cf().MimeTypesFile, "error", err)
+			extensions = make(map[string]string, 0)
 		} else {
-			log.Printf("Loaded %d mime types", len(mimeExtensions))
+			slog.Info("loaded mime types", "count", len(extensions))
 		}
+		setMimeExtensions(extensions)
 	}
 
-	// Load public pastas
-	if cf.PublicPastas > 0 {
-		pastas, err := bowl.GetPublicPastas()
-		if err != nil {
-			log.Printf("Error loading public pastas: %s", err)
-		} else {
-			// Crop if necessary
-			if len(pastas) > cf.PublicPastas {
-				pastas = pastas[len(pastas)-cf.PublicPastas:]
-				bowl.WritePublicPastaIDs(pastas)
-			}
-			for _, id := range pastas {
-				if id == "" {
-					continue
-				}
-				pasta, err := bowl.GetPasta(id)
-				if err == nil && pasta.Id != "" {
-					publicPastas = append(publicPastas, pasta)
-				}
-			}
-			log.Printf("Loaded %d public pastas", len(publicPastas))
+	// Load API keys
+	if apikeys, err := loadAPIKeys(cf()); err != nil {
+		fmt.Fprintf(os.Stderr, "error loading api keys: %s\n", err)
+		os.Exit(1)
+	} else {
+		keys.Set(apikeys)
+		if len(apikeys) > 0 {
+			slog.Info("loaded api keys, uploads require an api key", "count", len(apikeys))
 		}
 	}
+	// Reload the config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logReload(reloadConfig())
+		}
+	}()
+
+	// Load public pastas
+	loadPublicPastas()
+	if cf().ReplicaOf == "" {
+		shutdown.OnShutdown("public pastas", persistPublicPastas)
+	}
+
+	limiter.SetLimits(rateLimitsFromConfig(cf()))
+
+	// Compute quota usage of existing pastas
+	if err := quotas.Recompute(&bowl); err != nil {
+		slog.Error("error computing quotas", "error", err)
+	}
+	if err := storageUsage.Recompute(&bowl); err != nil {
+		slog.Error("error computing storage usage", "error", err)
+	}
+
+	if err := metrics.UpdateStorage(&bowl); err != nil {
+		slog.Error("error computing storage metrics", "error", err)
+	}
+
+	// Follow the primary, if this is a replica
+	if cf().ReplicaOf != "" {
+		replica := NewReplica(cf().ReplicaOf, cf().ReplicationKey, &bowl)
+		replica.OnPublic = loadPublicPastas
+		slog.Info("running as read-only replica", "primary", cf().ReplicaOf)
+		go replica.Run()
+	}
 
 	// Start cleanup thread
-	if cf.CleanupInterval > 0 {
+	if cf().CleanupInterval > 0 {
 		go cleanupThread()
 	}
 
 	// Setup webserver
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/health", handlerHealth)
-	http.HandleFunc("/health.json", handlerHealthJson)
-	http.HandleFunc("/public", handlerPublic)
-	http.HandleFunc("/public.json", handlerPublicJson)
-	http.HandleFunc("/delete", handlerDelete)
-	http.HandleFunc("/robots.txt", handlerRobots)
-	log.Printf("Serving http://%s", cf.BindAddr)
-	log.Fatal(http.ListenAndServe(cf.BindAddr, nil))
+	http.HandleFunc("/", instrument("/", handler))
+	http.HandleFunc("/health", instrument("/health", handlerHealth))
+	http.HandleFunc("/health.json", instrument("/health.json", handlerHealthJson))
+	http.HandleFunc("/public", instrument("/public", handlerPublic))
+	http.HandleFunc("/public.json", instrument("/public.json", handlerPublicJson))
+	http.HandleFunc("/quota.json", instrument("/quota.json", handlerQuotaJson))
+	http.HandleFunc("/delete", instrument("/delete", handlerDelete))
+	http.HandleFunc("/robots.txt", instrument("/robots.txt", handlerRobots))
+	http.HandleFunc("/admin/", instrument("/admin/", handlerAdmin))
+	http.HandleFunc("/replication/", instrument("/replication/", handlerReplication))
+	listeners, err := openListeners(cf(), userContentFilter(http.DefaultServeMux))
+	if err != nil {
+		fatal("cannot listen", "error", err)
+	}
+	// Metrics are served on a separate address, if configured
+	if cf().MetricsBindAddr == "" {
+		http.HandleFunc("/metrics", handlerMetrics)
+	} else {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", handlerMetrics)
+		listener, err := net.Listen("tcp", cf().MetricsBindAddr)
+		if err != nil {
+			fatal("cannot listen", "listener", "metrics", "error", err)
+		}
+		listeners = append(listeners, newListener("metrics", listener, mux, nil))
+	}
+	for _, listener := range listeners {
+		go func(listener *Listener) {
+			if err := listener.Serve(); err != nil {
+				fatal("server failed", "listener", listener.Name, "error", err)
+			}
+		}(listener)
+	}
+	if _, err := sdNotify("READY=1"); err != nil {
+		slog.Warn("cannot notify service manager", "error", err)
+	}
+	go runWatchdog(watchdogInterval())
+
+	// Graceful shutdown on SIGTERM and SIGINT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("shutting down", "signal", sig.String(), "timeout", cf().ShutdownTimeout)
+	go func() {
+		// A second signal terminates immediately
+		<-stop
+		fatal("shutdown aborted")
+	}()
+	shutdown.Run(listeners, cf().ShutdownTimeout.Duration())
+}
+
+// Persist the list of public pastas, which is only kept in memory while running
+func persistPublicPastas() error {
+	return publicPastas.Persist(&bowl)
 }
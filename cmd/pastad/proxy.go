@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+/* NetList is a list of networks, e.g. trusted proxies */
+type NetList struct {
+	mutex sync.RWMutex
+	nets  []*net.IPNet
+}
+
+var trustedProxies NetList
+
+/* Parse a list of CIDRs. Plain IP addresses are accepted as single host networks */
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0)
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return ret, fmt.Errorf("invalid ip address: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+// Set replaces the networks in the list
+func (list *NetList) Set(nets []*net.IPNet) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.nets = nets
+}
+
+// Empty returns true if the list contains no networks
+func (list *NetList) Empty() bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return len(list.nets) == 0
+}
+
+// Contains checks if the given IP address is in one of the networks of the list
+func (list *NetList) Contains(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	for _, network := range list.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* Strip the port and brackets from a node in X-Forwarded-For or Forwarded headers */
+func stripNode(node string) string {
+	node = strings.Trim(strings.TrimSpace(node), "\"")
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+	}
+	// IPv4 with port
+	if strings.Count(node, ":") == 1 {
+		return node[:strings.Index(node, ":")]
+	}
+	return node
+}
+
+/* Parse the Forwarded header (RFC 7239) and return the values of the given parameter, in order of the proxy chain */
+func forwardedValues(r *http.Request, param string) []string {
+	ret := make([]string, 0)
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				i := strings.Index(pair, "=")
+				if i < 0 {
+					continue
+				}
+				if strings.EqualFold(strings.TrimSpace(pair[:i]), param) {
+					ret = append(ret, strings.Trim(strings.TrimSpace(pair[i+1:]), "\""))
+				}
+			}
+		}
+	}
+	return ret
+}
+
+/* Get the chain of client addresses from the X-Forwarded-For or Forwarded header. The Forwarded header has precedence */
+func forwardedFor(r *http.Request) []string {
+	chain := make([]string, 0)
+	if values := forwardedValues(r, "for"); len(values) > 0 {
+		for _, value := range values {
+			chain = append(chain, stripNode(value))
+		}
+		return chain
+	}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, value := range strings.Split(header, ",") {
+			if value = stripNode(value); value != "" {
+				chain = append(chain, value)
+			}
+		}
+	}
+	return chain
+}
+
+// isTrustedProxy returns true if the peer of the request is a trusted proxy. Peers on the unix socket are always trusted
+func isTrustedProxy(r *http.Request) bool {
+	if isUnixSocketRequest(r) {
+		return true
+	}
+	return !trustedProxies.Empty() && trustedProxies.Contains(extractRemoteIP(r.RemoteAddr))
+}
+
+/* clientIP returns the IP address of the client of the given request.
+ * If the request comes from a trusted proxy, the client is taken from the forwarding headers. The chain is walked from the end and the first address that is not a trusted proxy is the client */
+func clientIP(r *http.Request) string {
+	peer := extractRemoteIP(r.RemoteAddr)
+	if !isTrustedProxy(r) {
+		return peer
+	}
+	chain := forwardedFor(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			// Obfuscated or unknown identifier. Don't trust anything beyond
+			return peer
+		}
+		if !trustedProxies.Contains(chain[i]) {
+			return chain[i]
+		}
+	}
+	if len(chain) > 0 {
+		return chain[0]
+	}
+	return peer
+}
+
+/* Get the first value of a possibly comma separated forwarding header */
+func firstHeaderValue(r *http.Request, name string) string {
+	value := r.Header.Get(name)
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// requestScheme returns the scheme (http or https) the client used for the request
+func requestScheme(r *http.Request) string {
+	if isTrustedProxy(r) {
+		if values := forwardedValues(r, "proto"); len(values) > 0 {
+			return strings.ToLower(values[0])
+		}
+		if proto := firstHeaderValue(r, "X-Forwarded-Proto"); proto != "" {
+			return strings.ToLower(proto)
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client used for the request
+func requestHost(r *http.Request) string {
+	if isTrustedProxy(r) {
+		if values := forwardedValues(r, "host"); len(values) > 0 {
+			return values[0]
+		}
+		if host := firstHeaderValue(r, "X-Forwarded-Host"); host != "" {
+			return host
+		}
+	}
+	return r.Host
+}
+
+/* baseURL returns the base URL for building links. If no BaseURL is configured, it is derived from the request */
+func baseURL(r *http.Request) string {
+	if cf().BaseUrl != "" {
+		return cf().BaseUrl
+	}
+	return fmt.Sprintf("%s://%s", requestScheme(r), requestHost(r))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	nets, err := parseCIDRs([]string{"127.0.0.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("parseCIDRs failed: %s", err)
+	}
+	trustedProxies.Set(nets)
+	defer trustedProxies.Set(nil)
+
+	request := func(remote string, headers map[string]string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		for key, value := range headers {
+			r.Header.Set(key, value)
+		}
+		return clientIP(r)
+	}
+	// Untrusted peers cannot spoof their address
+	if ip := request("1.2.3.4:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}); ip != "1.2.3.4" {
+		t.Fatalf("Forwarding header of untrusted peer accepted: %s", ip)
+	}
+	// The rightmost untrusted address is the client, addresses added by the client are ignored
+	if ip := request("127.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 10.1.1.1"}); ip != "5.6.7.8" {
+		t.Fatalf("Wrong client from X-Forwarded-For: %s", ip)
+	}
+	if ip := request("127.0.0.1:1234", map[string]string{"Forwarded": "for=\"[2001:db8::1]:4711\";proto=https"}); ip != "2001:db8::1" {
+		t.Fatalf("Wrong client from Forwarded: %s", ip)
+	}
+	if ip := request("127.0.0.1:1234", nil); ip != "127.0.0.1" {
+		t.Fatalf("Wrong client without forwarding header: %s", ip)
+	}
+	if _, err := parseCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Fatal("Invalid proxy accepted")
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	var lists AccessLists
+	cf := Config{AllowCreate: []string{"10.0.0.0/8"}, DenyCreate: []string{"10.0.0.1"}, DenyRead: []string{"192.168.0.0/16"}}
+	if err := lists.Load(&cf); err != nil {
+		t.Fatalf("Loading access lists failed: %s", err)
+	}
+	if !lists.Create.Permitted("10.1.2.3") || lists.Create.Permitted("10.0.0.1") || lists.Create.Permitted("1.2.3.4") {
+		t.Fatal("Create access list not applied")
+	}
+	if !lists.Read.Permitted("1.2.3.4") || lists.Read.Permitted("192.168.1.1") {
+		t.Fatal("Read access list not applied")
+	}
+	if !lists.Delete.Permitted("1.2.3.4") {
+		t.Fatal("Empty access list rejects clients")
+	}
+	// Invalid lists must not change the active lists
+	cf.AllowCreate = []string{"invalid"}
+	if err := lists.Load(&cf); err == nil {
+		t.Fatal("Invalid access list accepted")
+	}
+	if lists.Create.Permitted("1.2.3.4") {
+		t.Fatal("Invalid access list partially applied")
+	}
+}
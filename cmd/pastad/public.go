@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+)
+
+/* PublicPastas is the list of public pastas, newest first. It is kept in memory and persisted in the bowl.
+ * The list is only persisted once it has been loaded, so that the public pastas in the bowl are kept while PublicPastas is 0 */
+type PublicPastas struct {
+	mutex  sync.RWMutex
+	pastas []Pasta
+	loaded bool
+}
+
+var publicPastas PublicPastas
+
+// Set replaces the public pastas and marks the list as loaded
+func (public *PublicPastas) Set(pastas []Pasta) {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	public.pastas = pastas
+	public.loaded = true
+}
+
+// Unload clears the list without changing the public pastas in the bowl
+func (public *PublicPastas) Unload() {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	public.pastas = make([]Pasta, 0)
+	public.loaded = false
+}
+
+// Crop keeps at most max pastas. Returns false if the list is not loaded
+func (public *PublicPastas) Crop(max int) bool {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	if len(public.pastas) > max {
+		public.pastas = public.pastas[:max]
+	}
+	return public.loaded
+}
+
+// Add a pasta at the beginning and keep at most max pastas. Pastas are not added to a list that is not loaded
+func (public *PublicPastas) Add(pasta Pasta, max int) {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	if !public.loaded {
+		return
+	}
+	pastas := make([]Pasta, 0, len(public.pastas)+1)
+	pastas = append(pastas, pasta)
+	pastas = append(pastas, public.pastas...)
+	if len(pastas) > max {
+		pastas = pastas[:max]
+	}
+	public.pastas = pastas
+}
+
+// Remove a pasta, if present
+func (public *PublicPastas) Remove(id string) {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	pastas := make([]Pasta, 0, len(public.pastas))
+	for _, pasta := range public.pastas {
+		if pasta.Id != id {
+			pastas = append(pastas, pasta)
+		}
+	}
+	public.pastas = pastas
+}
+
+// List returns a copy of the public pastas
+func (public *PublicPastas) List() []Pasta {
+	public.mutex.RLock()
+	defer public.mutex.RUnlock()
+	return append(make([]Pasta, 0, len(public.pastas)), public.pastas...)
+}
+
+// Persist writes the public pastas to the bowl, if the list is loaded. Concurrent writes are serialized
+func (public *PublicPastas) Persist(bowl *PastaBowl) error {
+	public.mutex.Lock()
+	defer public.mutex.Unlock()
+	if !public.loaded {
+		return nil
+	}
+	return bowl.WritePublicPastas(public.pastas)
+}
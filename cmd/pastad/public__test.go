@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublicPastas(t *testing.T) {
+	var public PublicPastas
+	public.Set(make([]Pasta, 0))
+	for i := 0; i < 5; i++ {
+		public.Add(Pasta{Id: fmt.Sprintf("p%d", i)}, 3)
+	}
+	pastas := public.List()
+	if len(pastas) != 3 || pastas[0].Id != "p4" || pastas[2].Id != "p2" {
+		t.Fatalf("Unexpected public pastas: %v", pastas)
+	}
+	public.Remove("p3")
+	if pastas := public.List(); len(pastas) != 2 || pastas[1].Id != "p2" {
+		t.Fatalf("Public pasta not removed: %v", pastas)
+	}
+	// The returned list is a copy
+	pastas = public.List()
+	pastas[0].Id = "modified"
+	if public.List()[0].Id != "p4" {
+		t.Fatal("Public pastas modified through the returned list")
+	}
+	if !public.Crop(1) || len(public.List()) != 1 {
+		t.Fatalf("Public pastas not cropped: %v", public.List())
+	}
+}
+
+/* The public pastas in the bowl are kept, as long as the list is not loaded */
+func TestPersistPublicPastas(t *testing.T) {
+	defer publicPastas.Unload()
+	useTestBowl(t, func(config *Config) {
+		config.PublicPastas = 0
+	})
+	if err := bowl.WritePublicPastaIDs([]string{"abc"}); err != nil {
+		t.Fatalf("Error writing public pastas: %s", err)
+	}
+	loadPublicPastas()
+	publicPastas.Add(Pasta{Id: "def"}, 0)
+	if err := persistPublicPastas(); err != nil {
+		t.Fatalf("Error persisting public pastas: %s", err)
+	}
+	if ids, _ := bowl.GetPublicPastas(); len(ids) != 1 || ids[0] != "abc" {
+		t.Fatalf("Public pastas changed while not loaded: %v", ids)
+	}
+	if publicPastas.Crop(1) {
+		t.Fatal("Unloaded public pastas reported as loaded")
+	}
+	publicPastas.Set(make([]Pasta, 0))
+	if err := persistPublicPastas(); err != nil {
+		t.Fatalf("Error persisting public pastas: %s", err)
+	}
+	if ids, _ := bowl.GetPublicPastas(); len(ids) != 0 {
+		t.Fatalf("Loaded public pastas not persisted: %v", ids)
+	}
+}
+
+func TestResizePublicPastas(t *testing.T) {
+	defer publicPastas.Unload()
+	useTestBowl(t, func(config *Config) {
+		config.PublicPastas = 0
+	})
+	ids := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		pasta := Pasta{}
+		file, err := bowl.CreatePasta(&pasta)
+		if err != nil {
+			t.Fatalf("Error creating pasta: %s", err)
+		}
+		file.Write([]byte("public"))
+		if err := file.Commit(6); err != nil {
+			t.Fatalf("Error committing pasta: %s", err)
+		}
+		ids = append(ids, pasta.Id)
+	}
+	bowl.WritePublicPastaIDs(ids)
+	loadPublicPastas()
+	resize := func(max int) {
+		config := *cf()
+		config.PublicPastas = max
+		setConfig(&config)
+		resizePublicPastas(max)
+	}
+	// Raising the number from 0 loads the list
+	resize(5)
+	if pastas := publicPastas.List(); len(pastas) != 3 || pastas[0].Id != ids[0] {
+		t.Fatalf("Public pastas not loaded: %v", pastas)
+	}
+	resize(2)
+	if pastas := publicPastas.List(); len(pastas) != 2 || pastas[1].Id != ids[1] {
+		t.Fatalf("Public pastas not cropped: %v", pastas)
+	}
+	if stored, _ := bowl.GetPublicPastas(); len(stored) != 2 {
+		t.Fatalf("Cropped public pastas not persisted: %v", stored)
+	}
+	// Disabling the list keeps the public pastas in the bowl
+	resize(0)
+	if pastas := publicPastas.List(); len(pastas) != 0 {
+		t.Fatalf("Public pastas not unloaded: %v", pastas)
+	}
+	if err := persistPublicPastas(); err != nil {
+		t.Fatalf("Error persisting public pastas: %s", err)
+	}
+	if stored, _ := bowl.GetPublicPastas(); len(stored) != 2 {
+		t.Fatalf("Public pastas in the bowl changed: %v", stored)
+	}
+}
+
+/* Concurrent uploads, downloads, listings and deletions, run with "go test -race" */
+func TestConcurrentRequests(t *testing.T) {
+	oldLimits := limiter.limits
+	defer func() {
+		limiter.SetLimits(oldLimits)
+		publicPastas.Unload()
+	}()
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+		config.PublicPastas = 5
+	})
+	limiter.SetLimits(rateLimitsFromConfig(cf()))
+	loadPublicPastas()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	mux.HandleFunc("/public", handlerPublic)
+	mux.HandleFunc("/public.json", handlerPublicJson)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method string, url string, body string) (string, error) {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("public", "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		buf, err := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s %s: status %d: %s", method, url, resp.StatusCode, string(buf))
+		}
+		return string(buf), err
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				content := fmt.Sprintf("pasta %d %d", i, j)
+				reply, err := request("POST", server.URL+"/", content)
+				if err != nil {
+					errs <- err
+					return
+				}
+				var url, token string
+				if _, err := fmt.Sscanf(reply, "url: %s\ntoken: %s\n", &url, &token); err != nil {
+					errs <- fmt.Errorf("unexpected reply: %s", reply)
+					return
+				}
+				for _, path := range []string{url, server.URL + "/", server.URL + "/public", server.URL + "/public.json"} {
+					if _, err := request("GET", path, ""); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if _, err := request("DELETE", url+"?token="+token, ""); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	// Readers, that only list the public pastas
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				handlerPublicJson(httptest.NewRecorder(), httptest.NewRequest("GET", "/public.json", nil))
+				handlerIndex(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if pastas := publicPastas.List(); len(pastas) != 0 {
+		t.Errorf("Deleted pastas still public: %d", len(pastas))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/* QuotaLimits define the limits for a single API key or client IP. 0 means unlimited */
+type QuotaLimits struct {
+	Bytes   int64 // Maximum number of stored bytes
+	Pastas  int   // Maximum number of live pastas
+	Uploads int   // Maximum number of uploads per hour
+}
+
+/* Usage of a single API key or client IP */
+type QuotaUsage struct {
+	Bytes   int64
+	Pastas  int
+	uploads []int64 // unix timestamps of the uploads within the last hour
+}
+
+/* QuotaTracker keeps track of the usage per API key and client IP */
+type QuotaTracker struct {
+	mutex sync.Mutex
+	usage map[string]*QuotaUsage
+}
+
+var quotas QuotaTracker
+
+// Enabled returns true if the limits restrict anything
+func (limits QuotaLimits) Enabled() bool {
+	return limits.Bytes > 0 || limits.Pastas > 0 || limits.Uploads > 0
+}
+
+// quotaLimits returns the limits for the given API key. Limits of the key have precedence over the global limits
+func quotaLimits(key *APIKey) QuotaLimits {
+	limits := QuotaLimits{Bytes: int64(cf().QuotaBytes), Pastas: cf().QuotaPastas, Uploads: cf().QuotaUploads}
+	if key != nil {
+		if key.QuotaBytes != 0 {
+			limits.Bytes = int64(key.QuotaBytes)
+		}
+		if key.QuotaPastas != 0 {
+			limits.Pastas = key.QuotaPastas
+		}
+		if key.QuotaUploads != 0 {
+			limits.Uploads = key.QuotaUploads
+		}
+	}
+	return limits
+}
+
+/* Get the quota subject of a pasta or request. Pastas created with an API key count for the key, otherwise for the client IP */
+func quotaSubject(owner string, client string) string {
+	if owner != "" {
+		return "key:" + owner
+	}
+	if client != "" {
+		return "ip:" + client
+	}
+	return ""
+}
+
+func (quota *QuotaTracker) get(subject string) *QuotaUsage {
+	if quota.usage == nil {
+		quota.usage = make(map[string]*QuotaUsage, 0)
+	}
+	usage, ok := quota.usage[subject]
+	if !ok {
+		usage = &QuotaUsage{}
+		quota.usage[subject] = usage
+	}
+	return usage
+}
+
+/* Remove upload timestamps older than one hour */
+func (usage *QuotaUsage) expireUploads(now int64) {
+	i := 0
+	for i < len(usage.uploads) && usage.uploads[i] <= now-3600 {
+		i++
+	}
+	usage.uploads = usage.uploads[i:]
+}
+
+// Usage returns the current usage of the given subject
+func (quota *QuotaTracker) Usage(subject string) QuotaUsage {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	usage := quota.get(subject)
+	usage.expireUploads(time.Now().Unix())
+	ret := *usage
+	ret.uploads = nil
+	return ret
+}
+
+// Uploads returns the number of uploads of the given subject within the last hour
+func (quota *QuotaTracker) Uploads(subject string) int {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	usage := quota.get(subject)
+	usage.expireUploads(time.Now().Unix())
+	return len(usage.uploads)
+}
+
+/* Check if the subject may upload a new pasta of the given size (0 if unknown). On success the upload is counted.
+ * Returns the http status code and a message if the quota is exceeded, 0 otherwise */
+func (quota *QuotaTracker) BeginUpload(subject string, limits QuotaLimits, size int64) (int, string) {
+	if subject == "" || !limits.Enabled() {
+		return 0, ""
+	}
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	usage := quota.get(subject)
+	now := time.Now().Unix()
+	usage.expireUploads(now)
+	if limits.Uploads > 0 && len(usage.uploads) >= limits.Uploads {
+		return http.StatusTooManyRequests, fmt.Sprintf("quota exceeded: at most %d uploads per hour allowed", limits.Uploads)
+	}
+	if limits.Pastas > 0 && usage.Pastas >= limits.Pastas {
+		return http.StatusTooManyRequests, fmt.Sprintf("quota exceeded: at most %d pastas allowed", limits.Pastas)
+	}
+	if limits.Bytes > 0 && usage.Bytes+size > limits.Bytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("quota exceeded: at most %d bytes allowed, %d bytes in use", limits.Bytes, usage.Bytes)
+	}
+	usage.uploads = append(usage.uploads, now)
+	return 0, ""
+}
+
+/* Add a received pasta of the given size to the usage of the subject. Returns the http status code and message if this exceeds the pastas or bytes quota.
+ * In this case the pasta is not added and needs to be deleted. The limits are checked again, because concurrent uploads all pass BeginUpload */
+func (quota *QuotaTracker) Add(subject string, limits QuotaLimits, size int64) (int, string) {
+	if subject == "" {
+		return 0, ""
+	}
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	usage := quota.get(subject)
+	if limits.Pastas > 0 && usage.Pastas >= limits.Pastas {
+		return http.StatusTooManyRequests, fmt.Sprintf("quota exceeded: at most %d pastas allowed", limits.Pastas)
+	}
+	if limits.Bytes > 0 && usage.Bytes+size > limits.Bytes {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("quota exceeded: at most %d bytes allowed, %d bytes in use", limits.Bytes, usage.Bytes)
+	}
+	usage.Bytes += size
+	usage.Pastas++
+	return 0, ""
+}
+
+// Remove subtracts the given pasta from the usage
+func (quota *QuotaTracker) Remove(pasta Pasta) {
+	subject := quotaSubject(pasta.Owner, pasta.Client)
+	if subject == "" {
+		return
+	}
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	usage := quota.get(subject)
+	usage.Bytes -= pasta.Size
+	usage.Pastas--
+	if usage.Bytes < 0 {
+		usage.Bytes = 0
+	}
+	if usage.Pastas < 0 {
+		usage.Pastas = 0
+	}
+}
+
+/* Recompute the stored bytes and pastas from the pastas in the bowl. The uploads within the last hour are kept.
+ * The lock is held during the whole recompute, so that pastas added or removed in the meantime are not lost */
+func (quota *QuotaTracker) Recompute(bowl *PastaBowl) error {
+	quota.mutex.Lock()
+	defer quota.mutex.Unlock()
+	pastas, err := bowl.ListPastas()
+	if err != nil {
+		return err
+	}
+	usage := make(map[string]*QuotaUsage, 0)
+	for _, pasta := range pastas {
+		subject := quotaSubject(pasta.Owner, pasta.Client)
+		if subject == "" || pasta.Expired() {
+			continue
+		}
+		if _, ok := usage[subject]; !ok {
+			usage[subject] = &QuotaUsage{}
+		}
+		usage[subject].Bytes += pasta.Size
+		usage[subject].Pastas++
+	}
+	now := time.Now().Unix()
+	for subject, old := range quota.usage {
+		old.expireUploads(now)
+		if len(old.uploads) == 0 {
+			continue
+		}
+		if _, ok := usage[subject]; !ok {
+			usage[subject] = &QuotaUsage{}
+		}
+		usage[subject].uploads = old.uploads
+	}
+	quota.usage = usage
+	return nil
+}
+
+// Report the quota usage and limits of the caller
+func handlerQuotaJson(w http.ResponseWriter, r *http.Request) {
+	type Quota struct {
+		Used  int64 `json:"used"`
+		Limit int64 `json:"limit"` // 0 = unlimited
+	}
+	type Report struct {
+		Subject string `json:"subject"`
+		Bytes   Quota  `json:"bytes"`
+		Pastas  Quota  `json:"pastas"`
+		Uploads Quota  `json:"uploads"` // uploads within the last hour
+	}
+	key, ok, err := requestKey(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "invalid api key")
+		return
+	}
+	var limits QuotaLimits
+	var subject string
+	if ok {
+		limits = quotaLimits(&key)
+		subject = quotaSubject(key.Label, "")
+	} else {
+		limits = quotaLimits(nil)
+		subject = quotaSubject("", clientIP(r))
+	}
+	usage := quotas.Usage(subject)
+	report := Report{Subject: subject}
+	report.Bytes = Quota{Used: usage.Bytes, Limit: limits.Bytes}
+	report.Pastas = Quota{Used: int64(usage.Pastas), Limit: int64(limits.Pastas)}
+	report.Uploads = Quota{Used: int64(quotas.Uploads(subject)), Limit: int64(limits.Uploads)}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		slog.Error("json error", "error", err)
+		w.WriteHeader(500)
+		w.Write([]byte("Server error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(buf)
+}
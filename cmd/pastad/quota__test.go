@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaTracker(t *testing.T) {
+	var quota QuotaTracker
+	limits := QuotaLimits{Bytes: 100, Pastas: 2, Uploads: 3}
+
+	if status, _ := quota.BeginUpload("ip:1", limits, 101); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Upload exceeding the bytes quota accepted: %d", status)
+	}
+	for i := 0; i < 2; i++ {
+		if status, message := quota.BeginUpload("ip:1", limits, 10); status != 0 {
+			t.Fatalf("Upload %d rejected: %s", i+1, message)
+		}
+		if status, message := quota.Add("ip:1", limits, 40); status != 0 {
+			t.Fatalf("Pasta %d rejected: %s", i+1, message)
+		}
+	}
+	if status, _ := quota.BeginUpload("ip:1", limits, 0); status != http.StatusTooManyRequests {
+		t.Fatalf("Upload exceeding the pastas quota accepted: %d", status)
+	}
+	// Concurrent uploads pass BeginUpload, the pastas quota is checked again when adding them
+	if status, _ := quota.Add("ip:1", limits, 1); status != http.StatusTooManyRequests {
+		t.Fatalf("Pasta exceeding the pastas quota added: %d", status)
+	}
+	if usage := quota.Usage("ip:1"); usage.Bytes != 80 || usage.Pastas != 2 {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+
+	quota.Remove(Pasta{Client: "1", Size: 40})
+	if status, _ := quota.Add("ip:1", limits, 70); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Pasta exceeding the bytes quota added: %d", status)
+	}
+	if status, message := quota.BeginUpload("ip:1", limits, 10); status != 0 {
+		t.Fatalf("Upload after removing a pasta rejected: %s", message)
+	}
+	// Three uploads within the last hour
+	if status, _ := quota.BeginUpload("ip:1", limits, 10); status != http.StatusTooManyRequests {
+		t.Fatalf("Upload exceeding the uploads quota accepted: %d", status)
+	}
+	if uploads := quota.Uploads("ip:1"); uploads != 3 {
+		t.Fatalf("Unexpected number of uploads: %d", uploads)
+	}
+	// Other subjects and disabled limits are not affected
+	if status, _ := quota.BeginUpload("key:bob", limits, 10); status != 0 {
+		t.Fatal("Upload of other subject rejected")
+	}
+	if status, _ := quota.BeginUpload("ip:1", QuotaLimits{}, 1000); status != 0 {
+		t.Fatal("Upload without limits rejected")
+	}
+
+	// Removing more than is in use doesn't result in a negative usage
+	quota.Remove(Pasta{Client: "1", Size: 1000})
+	quota.Remove(Pasta{Client: "1", Size: 1000})
+	if usage := quota.Usage("ip:1"); usage.Bytes != 0 || usage.Pastas != 0 {
+		t.Fatalf("Unexpected usage after removing: %+v", usage)
+	}
+}
+
+func TestQuotaRecompute(t *testing.T) {
+	useTestBowl(t, nil)
+	create := func(pasta Pasta, content string) {
+		file, err := bowl.CreatePasta(&pasta)
+		if err != nil {
+			t.Fatalf("Error creating pasta: %s", err)
+		}
+		file.Write([]byte(content))
+		if err := file.Commit(int64(len(content))); err != nil {
+			t.Fatalf("Error committing pasta: %s", err)
+		}
+	}
+	create(Pasta{Owner: "alice"}, "0123456789")
+	create(Pasta{Owner: "alice", Client: "192.0.2.1"}, "01234")
+	create(Pasta{Client: "192.0.2.1"}, "012")
+	create(Pasta{Client: "192.0.2.1", ExpireDate: time.Now().Unix() - 10}, "0123456789")
+	create(Pasta{}, "0123456789")
+
+	var quota QuotaTracker
+	quota.BeginUpload("ip:192.0.2.1", QuotaLimits{Uploads: 10}, 0)
+	quota.Add("ip:192.0.2.2", QuotaLimits{}, 100)
+	if err := quota.Recompute(&bowl); err != nil {
+		t.Fatalf("Error recomputing quotas: %s", err)
+	}
+	if usage := quota.Usage("key:alice"); usage.Bytes != 15 || usage.Pastas != 2 {
+		t.Errorf("Unexpected usage of alice: %+v", usage)
+	}
+	// Expired pastas don't count, the uploads within the last hour are kept
+	if usage := quota.Usage("ip:192.0.2.1"); usage.Bytes != 3 || usage.Pastas != 1 {
+		t.Errorf("Unexpected usage of client: %+v", usage)
+	}
+	if uploads := quota.Uploads("ip:192.0.2.1"); uploads != 1 {
+		t.Errorf("Uploads not kept: %d", uploads)
+	}
+	if usage := quota.Usage("ip:192.0.2.2"); usage.Bytes != 0 || usage.Pastas != 0 {
+		t.Errorf("Usage without pastas not reset: %+v", usage)
+	}
+}
+
+func TestQuotaRequests(t *testing.T) {
+	defer func() {
+		quotas.usage = nil
+	}()
+	useTestBowl(t, func(config *Config) {
+		config.SetDefaults()
+		config.QuotaPastas = 2
+		config.QuotaBytes = 20
+	})
+	quotas.usage = nil
+	upload := func(content string, contentLength bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(content))
+		if contentLength {
+			r.Header.Set("Content-Length", "1000")
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	if w := upload("0123456789", false); w.Code != http.StatusOK {
+		t.Fatalf("Upload rejected: %d %s", w.Code, w.Body.String())
+	}
+	// The bytes quota is checked by Content-Length and after receiving the pasta
+	if w := upload("0123", true); w.Code != http.StatusRequestEntityTooLarge || w.Body.String() != "quota exceeded: at most 20 bytes allowed, 10 bytes in use" {
+		t.Errorf("Unexpected reply for upload exceeding the bytes quota: %d %s", w.Code, w.Body.String())
+	}
+	if w := upload("01234567890123456789", false); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Received pasta exceeding the bytes quota accepted: %d %s", w.Code, w.Body.String())
+	}
+	if pastas, _ := bowl.ListPastas(); len(pastas) != 1 {
+		t.Errorf("Rejected pasta not deleted: %d pastas", len(pastas))
+	}
+	if w := upload("0123", false); w.Code != http.StatusOK {
+		t.Fatalf("Upload rejected: %d %s", w.Code, w.Body.String())
+	}
+	if w := upload("0123", false); w.Code != http.StatusTooManyRequests || w.Body.String() != "quota exceeded: at most 2 pastas allowed" {
+		t.Errorf("Unexpected reply for upload exceeding the pastas quota: %d %s", w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	handlerQuotaJson(w, httptest.NewRequest("GET", "/quota.json", nil))
+	var report struct {
+		Subject string
+		Bytes   struct{ Used, Limit int64 }
+		Pastas  struct{ Used, Limit int64 }
+		Uploads struct{ Used, Limit int64 }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Invalid quota report: %s", err)
+	}
+	if report.Subject != "ip:192.0.2.1" || report.Bytes.Used != 14 || report.Bytes.Limit != 20 || report.Pastas.Used != 2 || report.Pastas.Limit != 2 || report.Uploads.Used != 3 || report.Uploads.Limit != 0 {
+		t.Errorf("Unexpected quota report: %+v", report)
+	}
+	r := httptest.NewRequest("GET", "/quota.json", nil)
+	r.Header.Set("Authorization", "Bearer invalid")
+	w = httptest.NewRecorder()
+	handlerQuotaJson(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Quota report with invalid api key: %d", w.Code)
+	}
+}
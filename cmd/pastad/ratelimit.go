@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* RateLimit defines a token bucket: Rate tokens per second are refilled up to Burst tokens */
+type RateLimit struct {
+	Rate  float64 // tokens per second, 0 = unlimited
+	Burst float64 // maximum number of tokens
+}
+
+type bucket struct {
+	budget string
+	tokens float64
+	last   time.Time // last refill
+}
+
+/* RateLimiter is a token bucket rate limiter with separate budgets (e.g. per http method) per client */
+type RateLimiter struct {
+	mutex   sync.Mutex
+	limits  map[string]RateLimit // limits per budget
+	buckets map[string]*bucket   // buckets per budget and client
+}
+
+var limiter RateLimiter
+
+// evictPerCall is the number of idle buckets that are checked for eviction on every call
+const evictPerCall = 2
+
+/* Create the rate limits from the config. RequestDelay is still supported as limit for POST and DELETE requests, if no explicit limit is configured */
+func rateLimitsFromConfig(cf *Config) map[string]RateLimit {
+	limits := make(map[string]RateLimit, 0)
+	burst := float64(cf.RateLimitBurst)
+	if burst < 1 {
+		burst = 1
+	}
+	perMinute := func(n float64) RateLimit {
+		return RateLimit{Rate: n / 60.0, Burst: burst}
+	}
+	if cf.RateLimitPost > 0 {
+		limits[http.MethodPost] = perMinute(cf.RateLimitPost)
+	} else if cf.RequestDelay > 0 {
+		limits[http.MethodPost] = RateLimit{Rate: 1000.0 / float64(cf.RequestDelay), Burst: 1}
+	}
+	if cf.RateLimitDelete > 0 {
+		limits[http.MethodDelete] = perMinute(cf.RateLimitDelete)
+	} else if cf.RequestDelay > 0 {
+		limits[http.MethodDelete] = RateLimit{Rate: 1000.0 / float64(cf.RequestDelay), Burst: 1}
+	}
+	if cf.RateLimitGet > 0 {
+		limits[http.MethodGet] = perMinute(cf.RateLimitGet)
+	}
+	return limits
+}
+
+// SetLimits replaces the limits of the rate limiter
+func (limiter *RateLimiter) SetLimits(limits map[string]RateLimit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.limits = limits
+}
+
+/* Allow takes a token from the bucket of the given client in the given budget.
+ * Returns true if the request is allowed, otherwise false and the time until the next token is available */
+func (limiter *RateLimiter) Allow(budget string, client string, now time.Time) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.evict(now, evictPerCall)
+	limit, ok := limiter.limits[budget]
+	if !ok || limit.Rate <= 0 {
+		return true, 0
+	}
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[string]*bucket, 0)
+	}
+	key := budget + " " + client
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{budget: budget, tokens: limit.Burst, last: now}
+		limiter.buckets[key] = b
+	} else {
+		b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+/* Remove up to n idle buckets. A bucket is idle, if it would be completely refilled by now.
+ * Go randomizes the map iteration order, so repeated calls eventually visit all buckets. Must be called while holding the mutex */
+func (limiter *RateLimiter) evict(now time.Time, n int) {
+	for key, b := range limiter.buckets {
+		if n <= 0 {
+			return
+		}
+		n--
+		limit, ok := limiter.limits[b.budget]
+		if !ok || limit.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.Burst {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Size returns the number of tracked buckets
+func (limiter *RateLimiter) Size() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return len(limiter.buckets)
+}
+
+/* Get the rate limit key of the request. Requests with a valid API key are limited per key, others per client IP */
+func rateLimitKey(r *http.Request) string {
+	if key, ok, _ := requestKey(r); ok {
+		return "key:" + key.Label
+	}
+	return "ip:" + clientIP(r)
+}
+
+/* Check the rate limit of the given budget for the request. If the limit is exceeded, a "429 Too Many Requests" is sent and false is returned */
+func rateLimit(w http.ResponseWriter, r *http.Request, budget string) bool {
+	ok, wait := limiter.Allow(budget, rateLimitKey(r), time.Now())
+	if ok {
+		return true
+	}
+	retry := int64(math.Ceil(wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	slog.Warn("rate limit exceeded", "client", clientIP(r), "budget", budget)
+	metrics.Add("pasta_ratelimit_rejections_total", 1, "budget", budget)
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "too many requests - retry in %d seconds", retry)
+	return false
+}
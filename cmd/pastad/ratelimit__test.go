@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var rl RateLimiter
+	rl.SetLimits(map[string]RateLimit{"POST": {Rate: 1, Burst: 2}})
+	now := time.Now()
+
+	// Burst of two requests, then the third must be rejected
+	for i := 0; i < 2; i++ {
+		if ok, _ := rl.Allow("POST", "ip:1", now); !ok {
+			t.Fatalf("Request %d within burst rejected", i+1)
+		}
+	}
+	ok, wait := rl.Allow("POST", "ip:1", now)
+	if ok {
+		t.Fatal("Request exceeding the burst allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Fatalf("Unexpected retry time: %s", wait)
+	}
+	// Other clients and budgets are not affected
+	if ok, _ := rl.Allow("POST", "ip:2", now); !ok {
+		t.Fatal("Request from other client rejected")
+	}
+	if ok, _ := rl.Allow("GET", "ip:1", now); !ok {
+		t.Fatal("Request in unlimited budget rejected")
+	}
+	// A token is refilled after one second
+	if ok, _ := rl.Allow("POST", "ip:1", now.Add(time.Second)); !ok {
+		t.Fatal("Request after refill rejected")
+	}
+
+	// Idle buckets are evicted incrementally
+	later := now.Add(time.Hour)
+	for i := 0; i < 10 && rl.Size() > 0; i++ {
+		rl.Allow("GET", "ip:1", later)
+	}
+	if rl.Size() != 0 {
+		t.Fatalf("Idle buckets not evicted: %d remaining", rl.Size())
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"sync"
+)
+
+/* Config reload: re-read the config file, the environment variables and the mime types file and apply them while running */
+
+/* Settings that are only applied when pastad is restarted */
+var restartSettings = []string{"PastaDir", "BindAddress", "TLSBindAddress", "TLSCert", "TLSKey", "UnixSocket", "UnixSocketMode", "MetricsBindAddress", "QuarantineDir", "ReplicaOf", "LogFormat", "AccessLog", "AccessLogFormat", "AuditLog", "ShutdownTimeout"}
+
+var configFile string         // config file given on the command line
+var configFlags *ParserConfig // program arguments, which overwrite the config file
+var reloadMutex sync.Mutex
+
+/* Reload the config and apply it. Settings that require a restart keep their current value and are returned.
+ * If the new config is invalid, nothing is changed */
+func reloadConfig() ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	config, _, err := loadConfig(configFile, configFlags)
+	if err != nil {
+		return nil, err
+	}
+	current := cf()
+	restart := make([]string, 0)
+	values, currentValues := configValues(&config), configValues(current)
+	for _, key := range restartSettings {
+		if !reflect.DeepEqual(values[key], currentValues[key]) {
+			restart = append(restart, key)
+		}
+	}
+	// The cleanup thread is only started if enabled at startup
+	if current.CleanupInterval == 0 && config.CleanupInterval != 0 {
+		restart = append(restart, "Cleanup")
+		config.CleanupInterval = 0
+	}
+	config.PastaDir, config.BindAddr, config.TLSBindAddr = current.PastaDir, current.BindAddr, current.TLSBindAddr
+	config.TLSCert, config.TLSKey = current.TLSCert, current.TLSKey
+	config.UnixSocket, config.UnixSocketMode = current.UnixSocket, current.UnixSocketMode
+	config.MetricsBindAddr, config.QuarantineDir, config.ReplicaOf = current.MetricsBindAddr, current.QuarantineDir, current.ReplicaOf
+	config.LogFormat, config.AccessLog, config.AccessLogFormat = current.LogFormat, current.AccessLog, current.AccessLogFormat
+	config.AuditLog, config.ShutdownTimeout = current.AuditLog, current.ShutdownTimeout
+
+	// Everything is prepared first, so that a failure doesn't leave a partially applied config.
+	// The api keys have already been validated, but the keys file might have changed in the meantime
+	apikeys, err := loadAPIKeys(&config)
+	if err != nil {
+		return nil, err
+	}
+	extensions := make(map[string]string, 0)
+	if config.MimeTypesFile != "" {
+		if extensions, err = loadMimeTypes(config.MimeTypesFile); err != nil {
+			slog.Warn("cannot load mime types file, keeping the current mime types", "file", config.MimeTypesFile, "error", err)
+			extensions = nil
+		}
+	}
+	accessLists, err := parseAccessLists(&config)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newMimePolicy(&config)
+	if err != nil {
+		return nil, err
+	}
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	if extensions != nil {
+		setMimeExtensions(extensions)
+	}
+	setConfig(&config)
+	keys.Set(apikeys)
+	acls.Set(accessLists)
+	trustedProxies.Set(proxies)
+	mimePolicy.Set(policy)
+	limiter.SetLimits(rateLimitsFromConfig(&config))
+	logLevel.Set(level)
+	if config.PublicPastas != current.PublicPastas {
+		resizePublicPastas(config.PublicPastas)
+	}
+	return restart, nil
+}
+
+/* Apply a changed number of public pastas. A loaded list is cropped, otherwise it is loaded from the bowl */
+func resizePublicPastas(max int) {
+	if max <= 0 {
+		publicPastas.Unload()
+	} else if publicPastas.Crop(max) {
+		if err := publicPastas.Persist(&bowl); err != nil {
+			slog.Error("error writing public pastas", "error", err)
+		}
+	} else {
+		loadPublicPastas()
+	}
+}
+
+// Log the result of a config reload
+func logReload(restart []string, err error) {
+	if err != nil {
+		slog.Error("error reloading config, keeping the current config", "error", err)
+		return
+	}
+	slog.Info("reloaded config", "api_keys", keys.Count())
+	if len(restart) > 0 {
+		slog.Warn("changed settings require a restart", "settings", restart)
+	}
+}
+
+/* Validate the config and print the effective settings with their source. Returns the exit code */
+func checkConfigMain(configFile string, pc *ParserConfig) int {
+	config, sources, err := loadConfig(configFile, pc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %s\n", err)
+		return 1
+	}
+	if err := printConfig(os.Stdout, &config, sources); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
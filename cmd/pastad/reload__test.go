@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	oldCf, oldFile, oldFlags := cf(), configFile, configFlags
+	defer func() {
+		setConfig(oldCf)
+		configFile, configFlags = oldFile, oldFlags
+	}()
+	configFile, configFlags = t.TempDir()+"/pastad.toml", nil
+	if err := os.WriteFile(configFile, []byte("MaxPastaSize = 1024\nBindAddress = \":8199\"\n"), 0600); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	config, _, err := loadConfig(configFile, nil)
+	if err != nil {
+		t.Fatalf("Error loading config: %s", err)
+	}
+	setConfig(&config)
+
+	os.WriteFile(configFile, []byte("MaxPastaSize = 4096\nBindAddress = \":8200\"\n"), 0600)
+	restart, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+	if cf().MaxPastaSize != 4096 {
+		t.Errorf("MaxPastaSize not reloaded: %d", cf().MaxPastaSize)
+	}
+	if cf().BindAddr != ":8199" || len(restart) != 1 || restart[0] != "BindAddress" {
+		t.Errorf("Changed bind address not reported: %s %v", cf().BindAddr, restart)
+	}
+	// Access lists, the mime types and the mime policy are applied
+	defer func() {
+		acls.Load(&Config{})
+		setMimeExtensions(make(map[string]string, 0))
+		mimePolicy.rules, mimePolicy.defaultAction, mimePolicy.defaultSize = nil, "", 0
+	}()
+	mimeFile := t.TempDir() + "/mime.types"
+	os.WriteFile(mimeFile, []byte("xyz = text/x-test\n"), 0600)
+	os.WriteFile(configFile, []byte("MaxPastaSize = 4096\nAllowCreate = [\"10.0.0.0/8\"]\nMimeTypes = \""+mimeFile+"\"\nMimeDefaultAction = \"download\"\n"), 0600)
+	if _, err := reloadConfig(); err != nil {
+		t.Fatalf("Error reloading config: %s", err)
+	}
+	if acls.Create.Allow.Empty() || mimeByFilename("a.xyz") != "text/x-test" || mimePolicy.Decide("text/plain").Action != MimeDownload {
+		t.Fatal("Access lists or mime settings not reloaded")
+	}
+	// An invalid config is not applied
+	os.WriteFile(mimeFile, []byte("xyz = text/x-changed\n"), 0600)
+	os.WriteFile(configFile, []byte("MaxPastaSize = 8192\nLogLevel = \"loud\"\nMimeTypes = \""+mimeFile+"\"\n"), 0600)
+	if _, err := reloadConfig(); err == nil {
+		t.Fatal("Invalid config applied")
+	}
+	if cf().MaxPastaSize != 4096 {
+		t.Errorf("Config changed by invalid reload: %d", cf().MaxPastaSize)
+	}
+	if acls.Create.Allow.Empty() || mimeByFilename("a.xyz") != "text/x-test" || mimePolicy.Decide("text/plain").Action != MimeDownload {
+		t.Error("Access lists or mime settings changed by invalid reload")
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Replication: the primary records every change of its pastas in a change feed, replicas follow the feed
+ * via /replication/changes and fetch changed pastas via /replication/pastas/ID */
+
+// changeRetention is the number of changes kept in the journal. Replicas that fall further behind need a full resync
+const changeRetention = 10000
+
+// maxChangesBatch is the maximum number of changes per response
+const maxChangesBatch = 1000
+
+// maxChangesWait is the maximum time a replica can wait for new changes
+const maxChangesWait = 60 * time.Second
+
+// errResync is returned, if the replica cannot catch up from its checkpoint
+var errResync = errors.New("checkpoint not in change feed, full resync required")
+
+/* Change is a single entry of the change feed */
+type Change struct {
+	Seq   int64  `json:"seq"`
+	Time  int64  `json:"time"`  // unix timestamp
+	Event string `json:"event"` // create, update or delete
+	Id    string `json:"id"`
+}
+
+/* ChangeFeed records the changes of the pastas in the journal file "_changes" of the pasta directory */
+type ChangeFeed struct {
+	mutex   sync.Mutex
+	file    *os.File
+	epoch   string        // identifies the journal. Replicas of another epoch need a full resync
+	changes []Change      // retained changes, oldest first
+	seq     int64         // sequence number of the last change
+	notify  chan struct{} // closed on every new change
+}
+
+/* ChangesReply is the reply of /replication/changes */
+type ChangesReply struct {
+	Epoch   string   `json:"epoch"`
+	Seq     int64    `json:"seq"` // last sequence number of the primary
+	Changes []Change `json:"changes"`
+}
+
+/* SnapshotReply is the reply of /replication/pastas */
+type SnapshotReply struct {
+	Epoch  string   `json:"epoch"`
+	Seq    int64    `json:"seq"` // sequence number at the time of the snapshot. Later changes must be applied on top
+	Pastas []string `json:"pastas"`
+	Public []string `json:"public"`
+}
+
+/* ReplicationCheckpoint is the replication state of a replica, stored in "_replication" of its pasta directory */
+type ReplicationCheckpoint struct {
+	Primary string `json:"primary"`
+	Epoch   string `json:"epoch"`
+	Seq     int64  `json:"seq"` // last applied change
+}
+
+var changes ChangeFeed
+
+// Open the journal. A new journal with a new epoch is created, if the file doesn't exist
+func (feed *ChangeFeed) Open(filename string) error {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	feed.changes = make([]Change, 0)
+	feed.notify = make(chan struct{})
+	if file, err := os.Open(filename); err == nil {
+		scanner := bufio.NewScanner(file)
+		if scanner.Scan() {
+			var header struct {
+				Epoch string `json:"epoch"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &header); err == nil {
+				feed.epoch = header.Epoch
+			}
+		}
+		for scanner.Scan() {
+			var change Change
+			if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+				// Incomplete last line after a crash
+				break
+			}
+			feed.changes = append(feed.changes, change)
+			feed.seq = change.Seq
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if feed.epoch == "" {
+		feed.epoch = RandomString(16)
+		feed.changes = feed.changes[:0]
+	}
+	if len(feed.changes) > changeRetention {
+		feed.changes = feed.changes[len(feed.changes)-changeRetention:]
+	}
+	// Rewrite the journal, so that a truncated last line doesn't remain
+	return feed.rewrite(filename)
+}
+
+// Rewrite the journal with the retained changes. The mutex must be held
+func (feed *ChangeFeed) rewrite(filename string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".tmp-changes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	header, _ := json.Marshal(map[string]string{"epoch": feed.epoch})
+	writer := bufio.NewWriter(tmp)
+	writer.Write(append(header, '\n'))
+	for _, change := range feed.changes {
+		buf, _ := json.Marshal(change)
+		writer.Write(append(buf, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	if feed.file != nil {
+		feed.file.Close()
+	}
+	feed.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0640)
+	return err
+}
+
+// Record a change of a pasta. Does nothing, if the journal is not open
+func (feed *ChangeFeed) Record(event string, id string) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	if feed.file == nil {
+		return
+	}
+	feed.seq++
+	change := Change{Seq: feed.seq, Time: time.Now().Unix(), Event: event, Id: id}
+	feed.changes = append(feed.changes, change)
+	buf, _ := json.Marshal(change)
+	if _, err := feed.file.Write(append(buf, '\n')); err != nil {
+		slog.Error("cannot write change journal", "error", err)
+	}
+	if len(feed.changes) > 2*changeRetention {
+		feed.changes = append([]Change{}, feed.changes[len(feed.changes)-changeRetention:]...)
+		if err := feed.rewrite(feed.file.Name()); err != nil {
+			slog.Error("cannot compact change journal", "error", err)
+		}
+	}
+	close(feed.notify)
+	feed.notify = make(chan struct{})
+}
+
+// Current epoch and sequence number
+func (feed *ChangeFeed) Position() (string, int64) {
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+	return feed.epoch, feed.seq
+}
+
+/* Get the changes after the given sequence number. Waits up to the given duration, if there are no changes yet.
+ * Stops waiting when the context is done or the shutdown begins.
+ * Returns errResync, if the epoch doesn't match or the changes are not retained anymore */
+func (feed *ChangeFeed) Since(ctx context.Context, epoch string, since int64, wait time.Duration) (ChangesReply, error) {
+	deadline := time.After(wait)
+	for {
+		feed.mutex.Lock()
+		reply := ChangesReply{Epoch: feed.epoch, Seq: feed.seq, Changes: make([]Change, 0)}
+		first := feed.seq + 1 // sequence number of the oldest retained change
+		if len(feed.changes) > 0 {
+			first = feed.changes[0].Seq
+		}
+		if epoch != feed.epoch || since > feed.seq || since < first-1 {
+			feed.mutex.Unlock()
+			return reply, errResync
+		}
+		for _, change := range feed.changes[since-first+1:] {
+			if len(reply.Changes) >= maxChangesBatch {
+				break
+			}
+			reply.Changes = append(reply.Changes, change)
+		}
+		notify := feed.notify
+		feed.mutex.Unlock()
+		if len(reply.Changes) > 0 {
+			return reply, nil
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			return reply, nil
+		case <-ctx.Done():
+			return reply, nil
+		case <-shutdown.Stopping():
+			return reply, nil
+		}
+	}
+}
+
+/* Handler for the replication endpoints of the primary. Requires the replication key */
+func handlerReplication(w http.ResponseWriter, r *http.Request) {
+	if cf().ReplicationKey == "" {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "replication disabled")
+		return
+	}
+	if !bearerAuthorized(r, cf().ReplicationKey) {
+		slog.Warn("replication request rejected", "client", clientIP(r))
+		w.Header().Set("WWW-Authenticate", "Bearer realm=\"pasta replication\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintf(w, "replication key required")
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "method not allowed")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/replication"), "/")
+	if path == "changes" {
+		since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		wait, _ := strconv.Atoi(r.URL.Query().Get("wait"))
+		timeout := time.Duration(wait) * time.Second
+		if timeout > maxChangesWait {
+			timeout = maxChangesWait
+		}
+		reply, err := changes.Since(r.Context(), r.URL.Query().Get("epoch"), since, timeout)
+		if err == errResync {
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		writeJson(w, reply)
+	} else if path == "pastas" {
+		// Take the position before listing, changes in between are applied again by the replica
+		epoch, seq := changes.Position()
+		pastas, err := bowl.ListPastas()
+		if err != nil {
+			storageError(w, "", err)
+			return
+		}
+		public, err := bowl.GetPublicPastas()
+		if err != nil {
+			storageError(w, "", err)
+			return
+		}
+		reply := SnapshotReply{Epoch: epoch, Seq: seq, Pastas: make([]string, 0, len(pastas)), Public: public}
+		for _, pasta := range pastas {
+			reply.Pastas = append(reply.Pastas, pasta.Id)
+		}
+		writeJson(w, reply)
+	} else if id := strings.TrimPrefix(path, "pastas/"); id != path && id != "" && containsOnlyAlphaNumeric(id) {
+		// Raw pasta file, including the metadata
+		file, err := os.Open(bowl.filename(id))
+		if err != nil {
+			if os.IsNotExist(err) {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprintf(w, "pasta not found")
+			} else {
+				storageError(w, id, err)
+			}
+			return
+		}
+		defer file.Close()
+		public, _ := publicSet(&bowl)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Pasta-Public", strconv.FormatBool(public[id]))
+		io.Copy(w, file)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "not found")
+	}
+}
+
+/* Reject modifications on a replica. Returns true, if the request has been rejected */
+func replicaReadOnly(w http.ResponseWriter) bool {
+	if cf().ReplicaOf == "" {
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "read-only replica")
+	return true
+}
+
+/* Replica follows the change feed of a primary and applies the changes to its bowl */
+type Replica struct {
+	Primary    string     // base URL of the primary
+	Key        string     // replication key
+	Bowl       *PastaBowl // local storage
+	OnPublic   func()     // called after the public pastas have changed
+	client     *http.Client
+	checkpoint ReplicationCheckpoint
+}
+
+func NewReplica(primary string, key string, bowl *PastaBowl) *Replica {
+	return &Replica{Primary: strings.TrimSuffix(primary, "/"), Key: key, Bowl: bowl, client: &http.Client{Timeout: maxChangesWait + 30*time.Second}}
+}
+
+func (replica *Replica) checkpointFile() string {
+	return replica.Bowl.filename("_replication")
+}
+
+// Load the checkpoint. A missing checkpoint or one of another primary starts from scratch
+func (replica *Replica) loadCheckpoint() error {
+	replica.checkpoint = ReplicationCheckpoint{Primary: replica.Primary}
+	buf, err := os.ReadFile(replica.checkpointFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var checkpoint ReplicationCheckpoint
+	if err := json.Unmarshal(buf, &checkpoint); err != nil {
+		slog.Warn("ignoring invalid replication checkpoint", "error", err)
+		return nil
+	}
+	if checkpoint.Primary == replica.Primary {
+		replica.checkpoint = checkpoint
+	}
+	return nil
+}
+
+func (replica *Replica) saveCheckpoint() error {
+	buf, _ := json.Marshal(replica.checkpoint)
+	tmp, err := os.CreateTemp(replica.Bowl.Directory, ".tmp-replication-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), replica.checkpointFile())
+}
+
+func (replica *Replica) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, replica.Primary+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+replica.Key)
+	return replica.client.Do(req)
+}
+
+// Decode a JSON reply of the primary
+func (replica *Replica) getJson(path string, v interface{}) error {
+	resp, err := replica.get(path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errResync
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Add or remove a pasta from the public pastas. Returns true, if the public pastas changed
+func (replica *Replica) setPublic(id string, public bool) (bool, error) {
+	ids, err := replica.Bowl.GetPublicPastas()
+	if err != nil {
+		return false, err
+	}
+	contained := false
+	remaining := make([]string, 0, len(ids)+1)
+	for _, current := range ids {
+		if current == id {
+			contained = true
+		} else {
+			remaining = append(remaining, current)
+		}
+	}
+	if contained == public {
+		return false, nil
+	}
+	if public {
+		remaining = append(remaining, id)
+	}
+	return true, replica.Bowl.WritePublicPastaIDs(remaining)
+}
+
+/* Fetch a pasta from the primary and store it. A pasta that doesn't exist anymore on the primary is deleted.
+ * Returns the public state of the pasta */
+func (replica *Replica) fetch(id string) (bool, error) {
+	resp, err := replica.get("/replication/pastas/" + url.PathEscape(id))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, replica.remove(id)
+	} else if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("primary returned %s for pasta %s", resp.Status, id)
+	}
+	old, err := replica.Bowl.GetPasta(id)
+	if err != nil && !errors.Is(err, errCorruptPasta) {
+		return false, err
+	}
+	reader := bufio.NewReader(resp.Body)
+	pasta := Pasta{Id: id}
+	if err := readMetadata(reader, &pasta); err != nil {
+		return false, fmt.Errorf("pasta %s: %w", id, err)
+	}
+	file, err := replica.Bowl.CreatePasta(&pasta)
+	if err != nil {
+		return false, err
+	}
+	defer file.Abort()
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		return false, err
+	}
+	if pasta.RecordedSize > 0 && size != pasta.RecordedSize {
+		return false, fmt.Errorf("size mismatch for pasta %s: %d bytes, expected %d", id, size, pasta.RecordedSize)
+	}
+	if err := file.Commit(size); err != nil {
+		return false, err
+	}
+	if old.Id == "" {
+		metrics.AddGauge("pasta_pastas", 1)
+	}
+	metrics.AddGauge("pasta_stored_bytes", float64(size-old.Size))
+	return resp.Header.Get("X-Pasta-Public") == "true", nil
+}
+
+// Delete a pasta locally
+func (replica *Replica) remove(id string) error {
+	pasta, err := replica.Bowl.GetPasta(id)
+	if err != nil && !errors.Is(err, errCorruptPasta) {
+		return err
+	}
+	if err := replica.Bowl.DeletePasta(id); err != nil {
+		return err
+	}
+	if pasta.Id != "" {
+		metrics.PastaRemoved(pasta.Size)
+	}
+	return nil
+}
+
+/* Copy all pastas of the primary and remove local pastas, that don't exist on the primary */
+func (replica *Replica) FullSync() error {
+	var snapshot SnapshotReply
+	if err := replica.getJson("/replication/pastas", &snapshot); err != nil {
+		return err
+	}
+	slog.Info("replication: full sync", "primary", replica.Primary, "pastas", len(snapshot.Pastas))
+	present := make(map[string]bool, len(snapshot.Pastas))
+	for _, id := range snapshot.Pastas {
+		if _, err := replica.fetch(id); err != nil {
+			return err
+		}
+		present[id] = true
+	}
+	local, err := replica.Bowl.ListPastas()
+	if err != nil {
+		return err
+	}
+	for _, pasta := range local {
+		if !present[pasta.Id] {
+			if err := replica.remove(pasta.Id); err != nil {
+				return err
+			}
+		}
+	}
+	public := make([]string, 0, len(snapshot.Public))
+	for _, id := range snapshot.Public {
+		if present[id] {
+			public = append(public, id)
+		}
+	}
+	if err := replica.Bowl.WritePublicPastaIDs(public); err != nil {
+		return err
+	}
+	if replica.OnPublic != nil {
+		replica.OnPublic()
+	}
+	if err := metrics.UpdateStorage(replica.Bowl); err != nil {
+		slog.Error("error updating storage metrics", "error", err)
+	}
+	replica.checkpoint = ReplicationCheckpoint{Primary: replica.Primary, Epoch: snapshot.Epoch, Seq: snapshot.Seq}
+	metrics.Set("pasta_replication_seq", float64(snapshot.Seq))
+	return replica.saveCheckpoint()
+}
+
+/* Apply the next batch of changes of the primary, waiting up to the given duration for new changes.
+ * Returns errResync, if the replica cannot catch up from its checkpoint */
+func (replica *Replica) Poll(wait time.Duration) error {
+	var reply ChangesReply
+	path := fmt.Sprintf("/replication/changes?epoch=%s&since=%d&wait=%d", url.QueryEscape(replica.checkpoint.Epoch), replica.checkpoint.Seq, int(wait.Seconds()))
+	if err := replica.getJson(path, &reply); err != nil {
+		return err
+	}
+	publicChanged := false
+	for _, change := range reply.Changes {
+		if change.Event == "delete" {
+			if err := replica.remove(change.Id); err != nil {
+				return err
+			}
+			if changed, err := replica.setPublic(change.Id, false); err != nil {
+				return err
+			} else if changed {
+				publicChanged = true
+			}
+		} else {
+			public, err := replica.fetch(change.Id)
+			if err != nil {
+				return err
+			}
+			if changed, err := replica.setPublic(change.Id, public && replica.Bowl.Exists(change.Id)); err != nil {
+				return err
+			} else if changed {
+				publicChanged = true
+			}
+		}
+		replica.checkpoint.Seq = change.Seq
+		metrics.Add("pasta_replication_changes_total", 1, "event", change.Event)
+	}
+	if publicChanged && replica.OnPublic != nil {
+		replica.OnPublic()
+	}
+	if len(reply.Changes) == 0 {
+		return nil
+	}
+	metrics.Set("pasta_replication_seq", float64(replica.checkpoint.Seq))
+	return replica.saveCheckpoint()
+}
+
+/* Follow the primary forever. Catches up from the checkpoint after errors and restarts */
+func (replica *Replica) Run() {
+	if err := replica.loadCheckpoint(); err != nil {
+		slog.Error("cannot load replication checkpoint", "error", err)
+	}
+	backoff := time.Second
+	for {
+		var err error
+		if replica.checkpoint.Epoch == "" {
+			err = replica.FullSync()
+		} else {
+			err = replica.Poll(maxChangesWait / 2)
+			if err == errResync {
+				slog.Warn("replication: checkpoint not in change feed of primary", "seq", replica.checkpoint.Seq)
+				replica.checkpoint.Epoch = ""
+				continue
+			}
+		}
+		if err != nil {
+			metrics.Add("pasta_replication_errors_total", 1)
+			slog.Error("replication error", "primary", replica.Primary, "error", err)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChangeFeed(t *testing.T) {
+	var feed ChangeFeed
+	filename := t.TempDir() + "/_changes"
+	if err := feed.Open(filename); err != nil {
+		t.Fatalf("Error opening change feed: %s", err)
+	}
+	feed.Record("create", "a")
+	feed.Record("delete", "a")
+	epoch, seq := feed.Position()
+	if seq != 2 {
+		t.Fatalf("Unexpected sequence number: %d", seq)
+	}
+	reply, err := feed.Since(context.Background(), epoch, 1, 0)
+	if err != nil || len(reply.Changes) != 1 || reply.Changes[0].Event != "delete" {
+		t.Fatalf("Unexpected changes: %+v, %v", reply, err)
+	}
+	if _, err := feed.Since(context.Background(), "other", 0, 0); err != errResync {
+		t.Fatal("Changes of another epoch returned")
+	}
+	// Waiting replicas are woken up by new changes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		feed.Record("create", "b")
+	}()
+	reply, err = feed.Since(context.Background(), epoch, 2, 5*time.Second)
+	if err != nil || len(reply.Changes) != 1 || reply.Changes[0].Id != "b" {
+		t.Fatalf("Unexpected changes after waiting: %+v, %v", reply, err)
+	}
+	// Waiting replicas return when the request is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	reply, err = feed.Since(ctx, epoch, 3, 5*time.Second)
+	if err != nil || len(reply.Changes) != 0 || time.Since(start) > time.Second {
+		t.Fatalf("Unexpected changes after cancelling: %+v, %v", reply, err)
+	}
+	// and when the shutdown begins
+	oldShutdown := shutdown
+	defer func() { shutdown = oldShutdown }()
+	shutdown = NewShutdown()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		shutdown.Run(nil, time.Second)
+	}()
+	start = time.Now()
+	reply, err = feed.Since(context.Background(), epoch, 3, 5*time.Second)
+	if err != nil || len(reply.Changes) != 0 || time.Since(start) > time.Second {
+		t.Fatalf("Unexpected changes after shutdown: %+v, %v", reply, err)
+	}
+	// The journal survives a restart
+	var reopened ChangeFeed
+	if err := reopened.Open(filename); err != nil {
+		t.Fatalf("Error reopening change feed: %s", err)
+	}
+	if reopenedEpoch, reopenedSeq := reopened.Position(); reopenedEpoch != epoch || reopenedSeq != 3 {
+		t.Fatalf("Journal not restored: %s %d", reopenedEpoch, reopenedSeq)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	// The primary uses the global bowl and change feed
+	useTestBowl(t, func(config *Config) {
+		config.ReplicationKey = "secret"
+	})
+	if err := changes.Open(bowl.filename("_changes")); err != nil {
+		t.Fatalf("Error opening change feed: %s", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handlerReplication))
+	defer server.Close()
+	create := func(content string) Pasta {
+		var pasta Pasta
+		file, err := bowl.CreatePasta(&pasta)
+		if err != nil {
+			t.Fatalf("Error creating pasta: %s", err)
+		}
+		file.Write([]byte(content))
+		if err := file.Commit(int64(len(content))); err != nil {
+			t.Fatalf("Error committing pasta: %s", err)
+		}
+		changes.Record("create", pasta.Id)
+		return pasta
+	}
+	checkContent := func(replica *PastaBowl, id string, content string) {
+		reader, err := replica.GetPastaReader(id)
+		if err != nil {
+			t.Fatalf("Pasta %s not replicated: %s", id, err)
+		}
+		defer reader.Close()
+		buf, _ := ioutil.ReadAll(reader)
+		if string(buf) != content {
+			t.Fatalf("Replicated content mismatch: %s", string(buf))
+		}
+	}
+
+	first := create("first pasta")
+	bowl.WritePublicPastaIDs([]string{first.Id})
+	replicaBowl := PastaBowl{Directory: t.TempDir()}
+	if err := NewReplica(server.URL, "wrong", &replicaBowl).FullSync(); err == nil {
+		t.Fatal("Replication with invalid key succeeded")
+	}
+	replica := NewReplica(server.URL, "secret", &replicaBowl)
+	if err := replica.loadCheckpoint(); err != nil {
+		t.Fatalf("Error loading checkpoint: %s", err)
+	}
+	if err := replica.FullSync(); err != nil {
+		t.Fatalf("Full sync failed: %s", err)
+	}
+	checkContent(&replicaBowl, first.Id, "first pasta")
+	if pasta, _ := replicaBowl.GetPasta(first.Id); pasta.Token != first.Token {
+		t.Fatal("Metadata not replicated")
+	}
+	if public, _ := replicaBowl.GetPublicPastas(); len(public) != 1 || public[0] != first.Id {
+		t.Fatalf("Public pastas not replicated: %v", public)
+	}
+
+	// Incremental changes
+	second := create("second pasta")
+	bowl.DeletePasta(first.Id)
+	changes.Record("delete", first.Id)
+	if err := replica.Poll(0); err != nil {
+		t.Fatalf("Poll failed: %s", err)
+	}
+	checkContent(&replicaBowl, second.Id, "second pasta")
+	if replicaBowl.Exists(first.Id) {
+		t.Fatal("Deletion not replicated")
+	}
+	if public, _ := replicaBowl.GetPublicPastas(); len(public) != 0 {
+		t.Fatalf("Deleted pasta still public: %v", public)
+	}
+
+	// A restarted replica catches up from its checkpoint
+	third := create("third pasta")
+	restarted := NewReplica(server.URL, "secret", &replicaBowl)
+	if err := restarted.loadCheckpoint(); err != nil {
+		t.Fatalf("Error loading checkpoint: %s", err)
+	}
+	if restarted.checkpoint.Seq != replica.checkpoint.Seq || restarted.checkpoint.Epoch == "" {
+		t.Fatalf("Checkpoint not restored: %+v", restarted.checkpoint)
+	}
+	if err := restarted.Poll(0); err != nil {
+		t.Fatalf("Poll after restart failed: %s", err)
+	}
+	checkContent(&replicaBowl, third.Id, "third pasta")
+	// A checkpoint of another journal requires a full resync
+	restarted.checkpoint.Epoch = "other"
+	if err := restarted.Poll(0); err != errResync {
+		t.Fatalf("Expected resync, got %v", err)
+	}
+}
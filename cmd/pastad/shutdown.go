@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/* Graceful shutdown: drain the listeners, wait for background tasks and run the shutdown hooks */
+
+type shutdownHook struct {
+	name string
+	hook func() error
+}
+
+/* Shutdown coordinates the graceful shutdown of pastad */
+type Shutdown struct {
+	mutex    sync.Mutex
+	stopping chan struct{}
+	stopped  bool
+	tasks    sync.WaitGroup // background tasks (e.g. a cleanup cycle) that are completed before exiting
+	hooks    []shutdownHook
+}
+
+var shutdown = NewShutdown()
+
+// NewShutdown creates a new shutdown coordinator
+func NewShutdown() *Shutdown {
+	return &Shutdown{stopping: make(chan struct{}), hooks: make([]shutdownHook, 0)}
+}
+
+// OnShutdown registers a hook, that runs after the listeners are drained. Hooks run in the order of registration
+func (s *Shutdown) OnShutdown(name string, hook func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name: name, hook: hook})
+}
+
+// Stopping returns a channel, that is closed when the shutdown begins
+func (s *Shutdown) Stopping() <-chan struct{} {
+	return s.stopping
+}
+
+/* BeginTask registers a background task, that must be completed before exiting.
+ * Returns false if the shutdown has already begun, then the task must not be started */
+func (s *Shutdown) BeginTask() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return false
+	}
+	s.tasks.Add(1)
+	return true
+}
+
+// EndTask marks a background task as completed
+func (s *Shutdown) EndTask() {
+	s.tasks.Done()
+}
+
+// Wait for the background tasks until the context is done. Returns false on timeout
+func (s *Shutdown) waitTasks(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/* Run the graceful shutdown. The listeners stop accepting new connections and in-flight requests are completed
+ * within the given timeout. Remaining connections are closed afterwards. Then the shutdown hooks run */
+func (s *Shutdown) Run(listeners []*Listener, timeout time.Duration) {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.stopped = true
+	close(s.stopping)
+	s.mutex.Unlock()
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener *Listener) {
+			defer wg.Done()
+			if err := listener.server.Shutdown(ctx); err != nil {
+				slog.Warn("drain timeout exceeded, closing connections", "listener", listener.Name, "error", err)
+				listener.server.Close()
+			}
+		}(listener)
+	}
+	wg.Wait()
+	// The drain may have used up the timeout, background tasks get their own deadline
+	tasksCtx, tasksCancel := context.WithTimeout(context.Background(), timeout)
+	defer tasksCancel()
+	if !s.waitTasks(tasksCtx) {
+		slog.Warn("drain timeout exceeded, background tasks still running")
+	}
+
+	s.mutex.Lock()
+	hooks := s.hooks
+	s.mutex.Unlock()
+	for _, hook := range hooks {
+		if err := hook.hook(); err != nil {
+			slog.Error("shutdown hook failed", "hook", hook.name, "error", err)
+		}
+	}
+	slog.Info("shutdown complete")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	s := NewShutdown()
+	entered := make(chan bool)
+	release := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+		io.WriteString(w, "done")
+	})
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	listener := newListener("http", socket, handler, nil)
+	go listener.Serve()
+
+	// An in-flight request is completed
+	result := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + socket.Addr().String() + "/")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		result <- string(body)
+	}()
+	<-entered
+	if !s.BeginTask() {
+		t.Fatal("Task rejected before shutdown")
+	}
+	hookCalled := false
+	s.OnShutdown("test", func() error {
+		hookCalled = true
+		return nil
+	})
+	done := make(chan bool)
+	go func() {
+		s.Run([]*Listener{listener}, 5*time.Second)
+		done <- true
+	}()
+	<-s.Stopping()
+	if s.BeginTask() {
+		t.Error("Task started while shutting down")
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("Shutdown completed with a request in flight")
+	default:
+	}
+	release <- true
+	if body := <-result; body != "done" {
+		t.Fatalf("In-flight request not completed: %s", body)
+	}
+	// The shutdown waits for running tasks
+	time.Sleep(50 * time.Millisecond)
+	if hookCalled {
+		t.Fatal("Shutdown hook called while a task is running")
+	}
+	s.EndTask()
+	<-done
+	if !hookCalled {
+		t.Fatal("Shutdown hook not called")
+	}
+	if _, err := net.Dial("tcp", socket.Addr().String()); err == nil {
+		t.Error("Listener still accepting connections")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := NewShutdown()
+	entered := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-r.Context().Done()
+	})
+	socket, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	listener := newListener("http", socket, handler, nil)
+	go listener.Serve()
+	go http.Get("http://" + socket.Addr().String() + "/")
+	<-entered
+	// A background task, that is still running after the drain timeout
+	s.BeginTask()
+	taskDone := false
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		taskDone = true
+		s.EndTask()
+	}()
+	hookCalled := false
+	s.OnShutdown("test", func() error {
+		hookCalled = taskDone
+		return nil
+	})
+	start := time.Now()
+	s.Run([]*Listener{listener}, 100*time.Millisecond)
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("Drain timeout not applied")
+	}
+	if !hookCalled {
+		t.Fatal("Background task not awaited after the drain timeout")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	if ok, err := sdNotify("READY=1"); ok || err != nil {
+		t.Fatalf("Notification without service manager: %v %v", ok, err)
+	}
+	filename := t.TempDir() + "/notify"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filename, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Error creating notify socket: %s", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", filename)
+	if ok, err := sdNotify("READY=1"); !ok || err != nil {
+		t.Fatalf("Notification failed: %v %v", ok, err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("Unexpected notification: %q %v", string(buf[:n]), err)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := watchdogInterval(); interval != 2*time.Second {
+		t.Errorf("Unexpected watchdog interval: %s", interval)
+	}
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("Watchdog of another process enabled: %s", interval)
+	}
+}
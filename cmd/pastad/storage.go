@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -21,8 +23,16 @@ type Pasta struct {
 	ExpireDate      int64  // Unix() date when it will expire
 	Size            int64  // file size
 	Mime            string // mime type
+	Owner           string // label of the API key used to create the pasta
+	Client          string // client IP address, only recorded for anonymous pastas
+	RecordedSize    int64  // size as recorded in the metadata after receiving, 0 if not recorded
+	Pinned          bool   // pinned pastas are never evicted
+	ModTime         int64  // modification time of the pasta file (unix timestamp)
 }
 
+// sizeFieldWidth is the width of the size metadata field, so that the size can be written after receiving
+const sizeFieldWidth = 20
+
 func (pasta *Pasta) Expired() bool {
 	if pasta.ExpireDate == 0 {
 		return false
@@ -97,38 +107,144 @@ func strBool(val string, def bool) bool {
 
 /* PastaBowl is the main storage instance */
 type PastaBowl struct {
-	Directory string // Directory where the pastas are
+	Directory     string // Directory where the pastas are
+	QuarantineDir string // Directory for corrupt pastas. If empty, "_quarantine" in Directory is used
 }
 
+// errCorruptPasta is returned for pasta files that cannot be parsed
+var errCorruptPasta = errors.New("corrupt pasta")
+
 func (bowl *PastaBowl) filename(id string) string {
 	return fmt.Sprintf("%s/%s", bowl.Directory, id)
 }
 
+/* Internal files (e.g. _public) and temporary files are not pastas */
+func internalFile(name string) bool {
+	return strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".")
+}
+
 func (bowl *PastaBowl) Exists(id string) bool {
 	return FileExists(bowl.filename(id))
 }
 
-/** Check for expired pastas and delete them */
-func (bowl *PastaBowl) RemoveExpired() error {
+// ListPastas returns the metadata of all pastas in the bowl
+func (bowl *PastaBowl) ListPastas() ([]Pasta, error) {
+	ret := make([]Pasta, 0)
 	files, err := ioutil.ReadDir(bowl.Directory)
 	if err != nil {
-		return err
+		return ret, err
 	}
 	for _, file := range files {
-		if file.Size() == 0 {
+		if file.IsDir() || file.Size() == 0 || internalFile(file.Name()) {
 			continue
 		}
 		pasta, err := bowl.GetPasta(file.Name())
-		if err != nil {
-			return err
+		if errors.Is(err, errCorruptPasta) {
+			// Corrupt pastas are quarantined by the cleanup
+			continue
+		} else if err != nil {
+			return ret, err
+		}
+		if pasta.Id != "" {
+			ret = append(ret, pasta)
+		}
+	}
+	return ret, nil
+}
+
+/** Check for expired pastas and delete them. Returns the deleted pastas and the ids of quarantined pastas.
+ * Corrupt pastas are quarantined. Errors don't stop the sweep, all errors are returned at the end */
+func (bowl *PastaBowl) RemoveExpired() ([]Pasta, []string, error) {
+	removed := make([]Pasta, 0)
+	quarantined := make([]string, 0)
+	files, err := ioutil.ReadDir(bowl.Directory)
+	if err != nil {
+		return removed, quarantined, err
+	}
+	errs := make([]error, 0)
+	for _, file := range files {
+		if file.IsDir() || file.Size() == 0 || internalFile(file.Name()) {
+			continue
+		}
+		pasta, err := bowl.GetPasta(file.Name())
+		if errors.Is(err, errCorruptPasta) {
+			if _, err := bowl.Quarantine(file.Name()); err != nil {
+				errs = append(errs, err)
+			} else {
+				quarantined = append(quarantined, file.Name())
+			}
+			continue
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
 		}
 		if pasta.Expired() {
 			if err := bowl.DeletePasta(pasta.Id); err != nil {
-				return err
+				errs = append(errs, err)
+				continue
 			}
+			removed = append(removed, pasta)
+		}
+	}
+	return removed, quarantined, errors.Join(errs...)
+}
+
+func (bowl *PastaBowl) quarantineDir() string {
+	if bowl.QuarantineDir != "" {
+		return bowl.QuarantineDir
+	}
+	return fmt.Sprintf("%s/_quarantine", bowl.Directory)
+}
+
+/* Move a corrupt pasta file to the quarantine directory. Returns the new filename */
+func (bowl *PastaBowl) Quarantine(id string) (string, error) {
+	dir := bowl.quarantineDir()
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("%s/%s-%d", dir, id, time.Now().Unix())
+	return filename, os.Rename(bowl.filename(id), filename)
+}
+
+// Apply a single metadata value to a pasta. Unknown names are ignored
+func setMetadata(pasta *Pasta, name string, value string) {
+	if name == "token" {
+		pasta.Token = value
+	} else if name == "expire" {
+		pasta.ExpireDate, _ = strconv.ParseInt(value, 10, 64)
+	} else if name == "mime" {
+		pasta.Mime = value
+	} else if name == "filename" {
+		pasta.ContentFilename = value
+	} else if name == "owner" {
+		pasta.Owner = value
+	} else if name == "client" {
+		pasta.Client = value
+	} else if name == "size" {
+		pasta.RecordedSize, _ = strconv.ParseInt(value, 10, 64)
+	} else if name == "pinned" {
+		pasta.Pinned = strBool(value, false)
+	}
+}
+
+/* Read the metadata of a pasta file from the reader, which is left at the beginning of the content */
+func readMetadata(reader *bufio.Reader, pasta *Pasta) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: missing metadata terminator", errCorruptPasta)
+			}
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "---" {
+			return nil
+		}
+		if i := strings.Index(line, ":"); i > 0 {
+			setMetadata(pasta, strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
 		}
 	}
-	return nil
 }
 
 // get pasta metadata
@@ -137,26 +253,26 @@ func (bowl *PastaBowl) GetPasta(id string) (Pasta, error) {
 	stat, err := os.Stat(bowl.filename(id))
 	if err != nil {
 		// Does not exists results in empty pasta result
-		if !os.IsExist(err) {
+		if os.IsNotExist(err) {
 			return pasta, nil
 		}
 		return pasta, err
 	}
 	pasta.Size = stat.Size()
+	pasta.ModTime = stat.ModTime().Unix()
 	file, err := os.OpenFile(pasta.DiskFilename, os.O_RDONLY, 0400)
 	if err != nil {
 		return pasta, err
 	}
 	defer file.Close()
 	// Read metadata (until "---")
+	terminated := false
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		if err = scanner.Err(); err != nil {
-			return pasta, err
-		}
 		line := scanner.Text()
 		pasta.Size -= int64(len(line) + 1)
 		if line == "---" {
+			terminated = true
 			break
 		}
 		// Parse metadata (name: value)
@@ -164,17 +280,16 @@ func (bowl *PastaBowl) GetPasta(id string) (Pasta, error) {
 		if i <= 0 {
 			continue
 		}
-		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
-		if name == "token" {
-			pasta.Token = value
-		} else if name == "expire" {
-			pasta.ExpireDate, _ = strconv.ParseInt(value, 10, 64)
-		} else if name == "mime" {
-			pasta.Mime = value
-		} else if name == "filename" {
-			pasta.ContentFilename = value
+		setMetadata(&pasta, strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return pasta, fmt.Errorf("%w %s: %s", errCorruptPasta, id, err)
 		}
-
+		return pasta, err
+	}
+	if !terminated {
+		return pasta, fmt.Errorf("%w %s: missing metadata terminator", errCorruptPasta, id)
 	}
 	// All good
 	pasta.Id = id
@@ -192,12 +307,11 @@ func (bowl *PastaBowl) getPastaFile(id string, flag int) (*os.File, error) {
 	for {
 		n, err := file.Read(buf)
 		if err != nil {
+			file.Close()
 			if err == io.EOF {
-				file.Close()
-				return nil, errors.New("unexpected end of block")
+				return nil, fmt.Errorf("%w %s: unexpected end of block", errCorruptPasta, id)
 			}
-			file.Close()
-			return nil, errors.New("unexpected end of block")
+			return nil, err
 		}
 		if n == 0 {
 			continue
@@ -225,8 +339,52 @@ func (bowl *PastaBowl) GetPastaWriter(id string) (*os.File, error) {
 	return bowl.getPastaFile(id, os.O_RDWR)
 }
 
-// Prepare a pasta file to be written. Id and Token will be set, if not already done
-func (bowl *PastaBowl) InsertPasta(pasta *Pasta) error {
+// Format the metadata header of a pasta, including the "---" terminator. Returns the header and the offset of the size field value
+func formatMetadata(pasta *Pasta) ([]byte, int64) {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("token:%s\n", pasta.Token))
+	if pasta.ExpireDate > 0 {
+		buf.WriteString(fmt.Sprintf("expire:%d\n", pasta.ExpireDate))
+	}
+	// Values must not contain line breaks, which would inject further metadata or end the header
+	if pasta.Mime != "" {
+		buf.WriteString(fmt.Sprintf("mime:%s\n", removeControl(pasta.Mime)))
+	}
+	if pasta.ContentFilename != "" {
+		buf.WriteString(fmt.Sprintf("filename:%s\n", removeControl(pasta.ContentFilename)))
+	}
+	if pasta.Owner != "" {
+		buf.WriteString(fmt.Sprintf("owner:%s\n", removeControl(pasta.Owner)))
+	}
+	if pasta.Client != "" {
+		buf.WriteString(fmt.Sprintf("client:%s\n", removeControl(pasta.Client)))
+	}
+	if pasta.Pinned {
+		buf.WriteString("pinned:true\n")
+	}
+	// The size field has a fixed width and is left empty, if the size is not yet known
+	size := ""
+	if pasta.RecordedSize > 0 {
+		size = strconv.FormatInt(pasta.RecordedSize, 10)
+	}
+	offset := int64(buf.Len() + len("size:"))
+	buf.WriteString(fmt.Sprintf("size:%-*s\n", sizeFieldWidth, size))
+	buf.WriteString("---\n")
+	return buf.Bytes(), offset
+}
+
+/* PastaFile is a pasta being written. The pasta is written to a temporary file in the pasta directory
+ * and only renamed into place by Commit, so that a pasta is either complete or absent */
+type PastaFile struct {
+	*os.File
+	pasta      *Pasta
+	bowl       *PastaBowl
+	sizeOffset int64 // offset of the size field value
+	done       bool  // committed or aborted
+}
+
+// Create a new pasta file with the metadata of the given pasta. Id and Token will be set, if not already done
+func (bowl *PastaBowl) CreatePasta(pasta *Pasta) (*PastaFile, error) {
 	if pasta.Id == "" {
 		// TODO: Use crypto rand
 		pasta.Id = bowl.GenerateRandomBinId(8) // Use default length here
@@ -236,36 +394,85 @@ func (bowl *PastaBowl) InsertPasta(pasta *Pasta) error {
 		pasta.Token = RandomString(16)
 	}
 	pasta.DiskFilename = bowl.filename(pasta.Id)
-	file, err := os.OpenFile(pasta.DiskFilename, os.O_RDWR|os.O_CREATE, 0640)
+	tmp, err := os.CreateTemp(bowl.Directory, fmt.Sprintf(".tmp-%s-*", pasta.Id))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer file.Close()
-	if _, err := file.Write([]byte(fmt.Sprintf("token:%s\n", pasta.Token))); err != nil {
-		return err
+	file := &PastaFile{File: tmp, pasta: pasta, bowl: bowl}
+	if err := tmp.Chmod(0640); err != nil {
+		file.Abort()
+		return nil, err
 	}
-	if pasta.ExpireDate > 0 {
-		if _, err := file.Write([]byte(fmt.Sprintf("expire:%d\n", pasta.ExpireDate))); err != nil {
-			return err
-		}
+	metadata, offset := formatMetadata(pasta)
+	if _, err := tmp.Write(metadata); err != nil {
+		file.Abort()
+		return nil, err
 	}
-	if pasta.Mime != "" {
-		if _, err := file.Write([]byte(fmt.Sprintf("mime:%s\n", pasta.Mime))); err != nil {
-			return err
-		}
+	file.sizeOffset = offset
+	return file, nil
+}
+
+// Record the content size, sync the file and move it into place
+func (file *PastaFile) Commit(size int64) error {
+	if file.done {
+		return fmt.Errorf("pasta file already closed")
 	}
-	if pasta.ContentFilename != "" {
-		if _, err := file.Write([]byte(fmt.Sprintf("filename:%s\n", pasta.ContentFilename))); err != nil {
+	if size > 0 {
+		value := fmt.Sprintf("%-*d", sizeFieldWidth, size)
+		if _, err := file.WriteAt([]byte(value), file.sizeOffset); err != nil {
+			file.Abort()
 			return err
 		}
 	}
+	if err := file.Sync(); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		file.Abort()
+		return err
+	}
+	if err := os.Rename(file.Name(), file.pasta.DiskFilename); err != nil {
+		file.Abort()
+		return err
+	}
+	file.done = true
+	file.pasta.RecordedSize = size
+	if stat, err := os.Stat(file.pasta.DiskFilename); err == nil {
+		file.pasta.ModTime = stat.ModTime().Unix()
+	}
+	// Persist the rename
+	return syncDir(file.bowl.Directory)
+}
 
-	if _, err := file.Write([]byte("---\n")); err != nil {
+// Discard the pasta file. Does nothing, if the file has already been committed
+func (file *PastaFile) Abort() {
+	if file.done {
+		return
+	}
+	file.done = true
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
 		return err
 	}
+	defer file.Close()
 	return file.Sync()
 }
 
+// Create an empty pasta. Id and Token will be set, if not already done
+func (bowl *PastaBowl) InsertPasta(pasta *Pasta) error {
+	file, err := bowl.CreatePasta(pasta)
+	if err != nil {
+		return err
+	}
+	return file.Commit(0)
+}
+
 func (bowl *PastaBowl) DeletePasta(id string) error {
 	if !bowl.Exists(id) {
 		return nil
@@ -273,12 +480,49 @@ func (bowl *PastaBowl) DeletePasta(id string) error {
 	return os.Remove(bowl.filename(id))
 }
 
+/* Rewrite the metadata of an existing pasta. The content is copied to a temporary file, which replaces the pasta atomically */
+func (bowl *PastaBowl) UpdatePasta(pasta Pasta) error {
+	reader, err := bowl.GetPastaReader(pasta.Id)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tmp, err := os.CreateTemp(bowl.Directory, fmt.Sprintf(".tmp-%s-*", pasta.Id))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0640); err != nil {
+		return err
+	}
+	metadata, _ := formatMetadata(&pasta)
+	if _, err := tmp.Write(metadata); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, reader); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), bowl.filename(pasta.Id))
+}
+
+// Generate an id, that is neither used by a pasta nor by a pasta being written
 func (bowl *PastaBowl) GenerateRandomBinId(n int) string {
 	for {
 		id := RandomString(n)
-		if !bowl.Exists(id) {
-			return id
+		if bowl.Exists(id) {
+			continue
+		}
+		if pending, _ := filepath.Glob(bowl.filename(fmt.Sprintf(".tmp-%s-*", id))); len(pending) > 0 {
+			continue
 		}
+		return id
 	}
 }
 
@@ -310,7 +554,7 @@ func (bowl *PastaBowl) GetPublicPastas() ([]string, error) {
 // WritePublicPastas writes a list of public pastas to the public file
 func (bowl *PastaBowl) WritePublicPastaIDs(ids []string) error {
 	filename := fmt.Sprintf("%s/_public", bowl.Directory)
-	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0640)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
 	if err != nil {
 		return err
 	}
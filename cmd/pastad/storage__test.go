@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -13,14 +15,34 @@ var testBowl PastaBowl
 func TestMain(m *testing.M) {
 	// Initialisation
 	rand.Seed(time.Now().UnixNano())
-	testBowl.Directory = "pasta_test"
-	os.Mkdir(testBowl.Directory, os.ModePerm)
-	defer os.RemoveAll(testBowl.Directory)
-	// Run tests
+	dir, err := os.MkdirTemp("", "pasta_test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating test directory: %s\n", err)
+		os.Exit(1)
+	}
+	testBowl.Directory = dir
+	// Run tests. os.Exit doesn't run deferred functions, the test directory is removed explicitly
 	ret := m.Run()
+	os.RemoveAll(dir)
 	os.Exit(ret)
 }
 
+/* Use a temporary bowl and a copy of the current config, modified by setup, for the test. Both are restored when the test is done */
+func useTestBowl(t *testing.T, setup func(config *Config)) {
+	oldBowl, oldCf := bowl, cf()
+	t.Cleanup(func() {
+		bowl = oldBowl
+		setConfig(oldCf)
+	})
+	bowl = PastaBowl{Directory: t.TempDir()}
+	config := *oldCf
+	if setup != nil {
+		setup(&config)
+	}
+	config.PastaDir = bowl.Directory
+	setConfig(&config)
+}
+
 func TestMetadata(t *testing.T) {
 	var err error
 	var pasta, p1, p2, p3 Pasta
@@ -249,3 +271,126 @@ func TestBlobs(t *testing.T) {
 	}
 
 }
+
+func TestCreatePasta(t *testing.T) {
+	bowl := PastaBowl{Directory: t.TempDir()}
+	// Pastas being written are not visible and aborted pastas leave nothing behind
+	var aborted Pasta
+	file, err := bowl.CreatePasta(&aborted)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("incomplete"))
+	if bowl.Exists(aborted.Id) {
+		t.Fatal("Uncommitted pasta is visible")
+	}
+	file.Abort()
+	if files, _ := ioutil.ReadDir(bowl.Directory); len(files) != 0 {
+		t.Fatalf("Aborted pasta left %d files behind", len(files))
+	}
+
+	var pasta Pasta
+	file, err = bowl.CreatePasta(&pasta)
+	if err != nil {
+		t.Fatalf("Error creating pasta: %s", err)
+	}
+	file.Write([]byte("hello pasta"))
+	if err := file.Commit(11); err != nil {
+		t.Fatalf("Error committing pasta: %s", err)
+	}
+	file.Abort() // Must not remove the committed pasta
+	stored, err := bowl.GetPasta(pasta.Id)
+	if err != nil {
+		t.Fatalf("Error getting pasta: %s", err)
+	}
+	if stored.Id != pasta.Id || stored.Size != 11 || stored.RecordedSize != 11 || stored.Token != pasta.Token {
+		t.Fatalf("Committed pasta mismatch: %+v", stored)
+	}
+	if files, _ := ioutil.ReadDir(bowl.Directory); len(files) != 1 {
+		t.Fatalf("Unexpected files in bowl: %d", len(files))
+	}
+}
+
+func TestUpdatePasta(t *testing.T) {
+	var pasta Pasta
+	pasta.Mime = "text/plain"
+	if err := testBowl.InsertPasta(&pasta); err != nil {
+		t.Fatalf("Error inserting pasta: %s", err)
+	}
+	file, err := testBowl.GetPastaWriter(pasta.Id)
+	if err != nil {
+		t.Fatalf("Error getting pasta file: %s", err)
+	}
+	content := RandomString(4096)
+	if _, err := file.Write([]byte(content)); err != nil {
+		t.Fatalf("Error writing pasta: %s", err)
+	}
+	file.Close()
+
+	pasta.ExpireDate = time.Now().Unix() + 3600
+	if err := testBowl.UpdatePasta(pasta); err != nil {
+		t.Fatalf("Error updating pasta: %s", err)
+	}
+	updated, err := testBowl.GetPasta(pasta.Id)
+	if err != nil {
+		t.Fatalf("Error getting updated pasta: %s", err)
+	}
+	if updated.ExpireDate != pasta.ExpireDate || updated.Mime != pasta.Mime || updated.Token != pasta.Token {
+		t.Fatal("Metadata mismatch after update")
+	}
+	file, err = testBowl.GetPastaReader(pasta.Id)
+	if err != nil {
+		t.Fatalf("Error getting pasta reader: %s", err)
+	}
+	buf, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || string(buf) != content {
+		t.Fatal("Content mismatch after update")
+	}
+	// No temporary files must be left over
+	pastas, err := testBowl.ListPastas()
+	if err != nil {
+		t.Fatalf("Error listing pastas: %s", err)
+	}
+	files, _ := ioutil.ReadDir(testBowl.Directory)
+	if len(files) != len(pastas) {
+		t.Fatalf("Unexpected files in bowl: %d files, %d pastas", len(files), len(pastas))
+	}
+}
+
+func TestRemoveExpiredQuarantine(t *testing.T) {
+	bowl := PastaBowl{Directory: t.TempDir()}
+	expired := Pasta{ExpireDate: time.Now().Unix() - 10}
+	alive := Pasta{ExpireDate: time.Now().Unix() + 3600}
+	if err := bowl.InsertPasta(&expired); err != nil {
+		t.Fatalf("Error inserting pasta: %s", err)
+	}
+	if err := bowl.InsertPasta(&alive); err != nil {
+		t.Fatalf("Error inserting pasta: %s", err)
+	}
+	// Pasta without metadata terminator, sorted before the other pastas
+	if err := ioutil.WriteFile(bowl.filename("0corrupt"), []byte("token:abc\nno terminator"), 0640); err != nil {
+		t.Fatalf("Error writing corrupt pasta: %s", err)
+	}
+	if _, err := bowl.GetPasta("0corrupt"); !errors.Is(err, errCorruptPasta) {
+		t.Fatalf("Corrupt pasta not detected: %v", err)
+	}
+
+	removed, quarantined, err := bowl.RemoveExpired()
+	if err != nil {
+		t.Fatalf("RemoveExpired failed: %s", err)
+	}
+	if len(removed) != 1 || removed[0].Id != expired.Id {
+		t.Fatalf("Expired pasta not removed: %v", removed)
+	}
+	if len(quarantined) != 1 || quarantined[0] != "0corrupt" {
+		t.Fatalf("Corrupt pasta not quarantined: %v", quarantined)
+	}
+	if bowl.Exists("0corrupt") || !bowl.Exists(alive.Id) {
+		t.Fatal("Unexpected pastas after RemoveExpired")
+	}
+	files, err := ioutil.ReadDir(bowl.quarantineDir())
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Quarantine directory not populated: %v", err)
+	}
+}
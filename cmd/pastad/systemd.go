@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* systemd integration: readiness notification (sd_notify), watchdog and socket activation */
+
+/* ActivatedListener is a socket passed by systemd (socket activation) */
+type ActivatedListener struct {
+	Name     string // FileDescriptorName of the socket unit
+	listener net.Listener
+}
+
+/* Send a state to the service manager. Returns false, if pastad is not running as notify service */
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// Abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/* Get the watchdog interval of the service manager. Returns 0, if the watchdog is not enabled for pastad */
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/* Keep the watchdog of the service manager happy, as long as the pasta directory is accessible.
+ * A hanging or lost storage results in a restart by the service manager */
+func runWatchdog(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	slog.Info("systemd watchdog enabled", "interval", interval.String())
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdown.Stopping():
+			return
+		case <-ticker.C:
+			if _, err := os.Stat(bowl.Directory); err != nil {
+				slog.Error("pasta directory not accessible, skipping watchdog notification", "error", err)
+				continue
+			}
+			if _, err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("cannot notify watchdog", "error", err)
+			}
+		}
+	}
+}
+
+/* Get the sockets passed by systemd (socket activation). Returns an empty list, if pastad was not socket activated */
+func activationListeners() ([]ActivatedListener, error) {
+	listeners := make([]ActivatedListener, 0)
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// The sockets must not be passed to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	const firstFd = 3
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("LISTEN_FD_%d", firstFd+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(firstFd+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, activated := range listeners {
+				activated.listener.Close()
+			}
+			return nil, fmt.Errorf("socket %s: %s", name, err)
+		}
+		listeners = append(listeners, ActivatedListener{Name: name, listener: listener})
+	}
+	return listeners, nil
+}
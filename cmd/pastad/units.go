@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Settings with units. Plain numbers are in bytes, seconds or milliseconds, as before */
+
+// ByteSize is a size in bytes, e.g. "1048576", "25MiB" or "10MB"
+type ByteSize int64
+
+// Seconds is a duration in seconds, e.g. "3600", "1h" or "30d"
+type Seconds int64
+
+// Milliseconds is a duration in milliseconds, e.g. "2000", "2s" or "500ms"
+type Milliseconds int64
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"k":   1 << 10,
+	"m":   1 << 20,
+	"g":   1 << 30,
+	"t":   1 << 40,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms":  time.Millisecond,
+	"s":   time.Second,
+	"m":   time.Minute,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+	"w":   7 * 24 * time.Hour,
+}
+
+// Split a value into the leading number and the unit ("25MiB" -> "25", "MiB")
+func splitUnit(value string) (string, string) {
+	i := 0
+	for i < len(value) && (value[i] >= '0' && value[i] <= '9' || value[i] == '.') {
+		i++
+	}
+	return value[:i], strings.TrimSpace(value[i:])
+}
+
+/* Parse a size with an optional unit. KB, MB, GB and TB are decimal units, KiB, MiB, GiB and TiB (or K, M, G and T) binary units */
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return size, nil
+	}
+	number, unit := splitUnit(value)
+	factor, ok := byteUnits[strings.ToLower(unit)]
+	if number == "" || !ok {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return int64(size * float64(factor)), nil
+}
+
+/* Parse a duration given as plain number in the given base unit or as sequence of numbers with units (ms, s, m, h, d, w), e.g. "1h30m" */
+func parseDuration(value string, base time.Duration) (int64, error) {
+	value = strings.TrimSpace(value)
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return number, nil
+	}
+	if value == "" {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+	var duration time.Duration
+	for remaining := value; remaining != ""; {
+		number, rest := splitUnit(remaining)
+		i := 0
+		for i < len(rest) && (rest[i] < '0' || rest[i] > '9') {
+			i++
+		}
+		unit := strings.TrimSpace(rest[:i])
+		factor, ok := durationUnits[strings.ToLower(unit)]
+		if number == "" || !ok {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		duration += time.Duration(f * float64(factor))
+		remaining = rest[i:]
+	}
+	if duration%base != 0 {
+		return 0, fmt.Errorf("invalid duration: %s is not a multiple of %s", value, base)
+	}
+	return int64(duration / base), nil
+}
+
+// UnmarshalText parses a size with an optional unit
+func (size *ByteSize) UnmarshalText(text []byte) error {
+	value, err := parseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*size = ByteSize(value)
+	return nil
+}
+
+// UnmarshalText parses a duration in seconds
+func (seconds *Seconds) UnmarshalText(text []byte) error {
+	value, err := parseDuration(string(text), time.Second)
+	if err != nil {
+		return err
+	}
+	*seconds = Seconds(value)
+	return nil
+}
+
+// UnmarshalText parses a duration in milliseconds
+func (ms *Milliseconds) UnmarshalText(text []byte) error {
+	value, err := parseDuration(string(text), time.Millisecond)
+	if err != nil {
+		return err
+	}
+	*ms = Milliseconds(value)
+	return nil
+}
+
+// Duration returns the value as time.Duration
+func (seconds Seconds) Duration() time.Duration {
+	return time.Duration(seconds) * time.Second
+}
+
+// Duration returns the value as time.Duration
+func (ms Milliseconds) Duration() time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
@@ -4,45 +4,10 @@ import (
 	"bufio"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
+	"unicode"
 )
 
-// getenv reads a given environmental variable and returns it's value if present or defval if not present or empty
-func getenv(key string, defval string) string {
-	val := os.Getenv(key)
-	if val == "" {
-		return defval
-	}
-	return val
-}
-
-// getenv reads a given environmental variable as integer and returns it's value if present or defval if not present or empty
-func getenv_i(key string, defval int) int {
-	val := os.Getenv(key)
-	if val == "" {
-		return defval
-	}
-	if i32, err := strconv.Atoi(val); err != nil {
-		return defval
-	} else {
-		return i32
-	}
-}
-
-// getenv reads a given environmental variable as integer and returns it's value if present or defval if not present or empty
-func getenv_i64(key string, defval int64) int64 {
-	val := os.Getenv(key)
-	if val == "" {
-		return defval
-	}
-	if i64, err := strconv.ParseInt(val, 10, 64); err != nil {
-		return defval
-	} else {
-		return i64
-	}
-}
-
 func isAlphaNumeric(c rune) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
 }
@@ -66,6 +31,21 @@ func removeNonAlphaNumeric(input string) string {
 	return ret
 }
 
+// Checks if the given string contains control characters (e.g. CR or LF)
+func containsControl(input string) bool {
+	return strings.IndexFunc(input, unicode.IsControl) >= 0
+}
+
+// Replace control characters by '_', so that the value cannot break the metadata format
+func removeControl(input string) string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return '_'
+		}
+		return c
+	}, input)
+}
+
 func ExtractPastaId(path string) (string, error) {
 	var id string
 	i := strings.LastIndex(path, "/")
@@ -111,6 +91,17 @@ func loadMimeTypes(filename string) (map[string]string, error) {
 	return ret, scanner.Err()
 }
 
+/* Split a comma separated list and trim the elements. Empty elements are removed */
+func splitList(value string) []string {
+	ret := make([]string, 0)
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			ret = append(ret, element)
+		}
+	}
+	return ret
+}
+
 func takeFirst(arr []string) string {
 	if len(arr) == 0 {
 		return ""
@@ -125,6 +116,8 @@ func mimeByFilename(filename string) string {
 		return ""
 	}
 	extension := filename[i+1:]
+	mimeExtensionsMutex.RLock()
+	defer mimeExtensionsMutex.RUnlock()
 	if mime, ok := mimeExtensions[extension]; ok {
 		return mime
 	}
@@ -1,8 +1,10 @@
 module github.com/grisu48/pasta
 
-go 1.18
+go 1.21
 
 require (
 	github.com/BurntSushi/toml v1.4.0
 	github.com/akamensky/argparse v1.4.0
 )
+
+require github.com/klauspost/compress v1.17.11
@@ -1,8 +1,9 @@
 #!/bin/bash -e
 # Summary: Function test for pasta & pastad
 
-PASTAS=~/.pastas.dat               # pasta client dat file
+PASTAS=~/.pastas.dat               # legacy pasta client dat file
 PASTAS_TEMP=""                     # temp file, if present
+export XDG_DATA_HOME=`mktemp -d`   # isolated pasta client storage
 
 function cleanup() {
 	set +e
@@ -17,11 +18,15 @@ function cleanup() {
 	rm -rf pasta_test
 	rm -f pasta.json
 	rm -f test_config.toml
+	rm -rf "$XDG_DATA_HOME"
+	if [[ $PRIMARYPID != "" ]]; then kill $PRIMARYPID; fi
+	if [[ $REPLICAPID != "" ]]; then kill $REPLICAPID; fi
+	rm -rf replication_primary replication_replica
 }
 
 trap cleanup EXIT
 
-## Preparation: Safe old pastas.dat, if existing
+## Preparation: Safe old pastas.dat, if existing (it would be migrated otherwise)
 if [[ -s $PASTAS ]]; then
 	PASTAS_TEMP=`mktemp`
 	mv "$PASTAS" "$PASTAS_TEMP"
@@ -108,6 +113,53 @@ grep 'Cleanup[[:space:]]*=' test_config.toml
 grep 'RequestDelay[[:space:]]*=' test_config.toml
 echo "test_config.toml has been successfully created"
 
+## Test replication between a primary and a replica
+echo "Testing replication ... "
+rm -rf replication_primary replication_replica
+# Wait until the given url returns the given http status code
+function wait_for_status() {
+	for i in `seq 1 50`; do
+		if [[ `curl -s -o /dev/null -w "%{http_code}" "$1"` == "$2" ]]; then return 0; fi
+		sleep 0.2
+	done
+	echo "Timeout waiting for $1 to return $2"
+	return 1
+}
+function start_replica() {
+	PASTA_PASTADIR=replication_replica PASTA_BINDADDR=127.0.0.1:8203 PASTA_REPLICAOF=http://127.0.0.1:8202 PASTA_REPLICATIONKEY=replication-test ../pastad -m ../mime.types &
+	REPLICAPID=$!
+}
+PASTA_PASTADIR=replication_primary PASTA_BINDADDR=127.0.0.1:8202 PASTA_REPLICATIONKEY=replication-test ../pastad -m ../mime.types &
+PRIMARYPID=$!
+wait_for_status http://127.0.0.1:8202/health 200
+echo "replicated pasta" > testfile
+reply=`curl --fail -s -X POST http://127.0.0.1:8202/ --data-binary @testfile`
+id=`echo "$reply" | grep -Eo 'http://.*' | grep -Eo '[^/]+$'`
+token=`echo "$reply" | grep -Eo 'token: .*' | cut -d' ' -f2`
+start_replica
+# Initial sync
+wait_for_status http://127.0.0.1:8203/$id 200
+curl --fail -s -o testfile2 http://127.0.0.1:8203/$id
+diff testfile testfile2
+# Replicas are read-only
+test `curl -s -o /dev/null -w "%{http_code}" -X POST http://127.0.0.1:8203/ --data-binary @testfile` == "403"
+# Deletions are replicated
+curl --fail -s -X DELETE "http://127.0.0.1:8202/$id?token=$token" >/dev/null
+wait_for_status http://127.0.0.1:8203/$id 404
+# A restarted replica catches up with the changes made in the meantime
+kill $REPLICAPID
+wait $REPLICAPID || true
+echo "replicated while offline" > testfile
+id=`curl --fail -s -X POST http://127.0.0.1:8202/ --data-binary @testfile | grep -Eo 'http://.*' | grep -Eo '[^/]+$'`
+start_replica
+wait_for_status http://127.0.0.1:8203/$id 200
+curl --fail -s -o testfile2 http://127.0.0.1:8203/$id
+diff testfile testfile2
+kill $REPLICAPID $PRIMARYPID
+REPLICAPID=""
+PRIMARYPID=""
+echo "Replication works"
+
 ## Check the date handling of the pasta client
 ## Ensure there are no 1970 entries in ls
 ! ../pasta ls | grep '1970'